@@ -0,0 +1,118 @@
+/*
+Package address checks that an address can receive a currency before anything irreversible is done to send it there:
+EIP-55 checksummed hex addresses for EVM currencies, and base58 or bech32 addresses for Bitcoin.
+*/
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/GridPlus/phonon-client/internal/base58"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	ErrInvalid             = errors.New("invalid address")
+	ErrChecksum            = errors.New("address checksum mismatch")
+	ErrUnsupportedCurrency = errors.New("no address format known for currency type")
+)
+
+// EVM reports whether currencyType is held on an EVM chain, so takes hex addresses
+func EVM(currencyType model.CurrencyType) bool {
+	return currencyType == model.Ethereum || currencyType == model.Native
+}
+
+/*
+Validate checks that addr is a well formed address for currencyType, returning it in canonical form: EIP-55
+checksummed for EVM currencies and lower case for bech32 addresses.
+*/
+func Validate(currencyType model.CurrencyType, addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	switch {
+	case EVM(currencyType):
+		return validateEVM(addr)
+	case currencyType == model.Bitcoin:
+		return validateBitcoin(addr)
+	}
+	return "", fmt.Errorf("%w %d", ErrUnsupportedCurrency, currencyType)
+}
+
+/*
+validateEVM accepts a 0x prefixed hex address. A mixed case address must carry a valid EIP-55 checksum; an all lower
+or all upper case one has no checksum to verify.
+*/
+func validateEVM(addr string) (string, error) {
+	if !strings.HasPrefix(addr, "0x") || !common.IsHexAddress(addr) {
+		return "", fmt.Errorf("%w: %q is not a 0x prefixed 20 byte hex address", ErrInvalid, addr)
+	}
+	a := common.HexToAddress(addr)
+	if a == (common.Address{}) {
+		return "", fmt.Errorf("%w: the zero address cannot be spent from", ErrInvalid)
+	}
+	body := addr[2:]
+	mixedCase := strings.ToLower(body) != body && strings.ToUpper(body) != body
+	if mixedCase && a.Hex() != addr {
+		return "", fmt.Errorf("%w: %s, expected %s", ErrChecksum, addr, a.Hex())
+	}
+	return a.Hex(), nil
+}
+
+// version bytes of base58 Bitcoin addresses, P2PKH and P2SH on mainnet and testnet
+var bitcoinVersions = map[byte]bool{0x00: true, 0x05: true, 0x6f: true, 0xc4: true}
+
+// human readable parts of segwit addresses on mainnet, testnet and regtest
+var segwitHRPs = map[string]bool{"bc": true, "tb": true, "bcrt": true}
+
+func validateBitcoin(addr string) (string, error) {
+	lower := strings.ToLower(addr)
+	if i := strings.LastIndexByte(lower, '1'); i > 0 && segwitHRPs[lower[:i]] {
+		err := checkSegwit(addr)
+		if err != nil {
+			return "", err
+		}
+		return lower, nil
+	}
+	payload, version, err := base58.CheckDecode(addr)
+	if errors.Is(err, base58.ErrChecksum) {
+		return "", fmt.Errorf("%w: %s", ErrChecksum, addr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %q: %s", ErrInvalid, addr, err)
+	}
+	if !bitcoinVersions[version] || len(payload) != 20 {
+		return "", fmt.Errorf("%w: %q is not a Bitcoin address", ErrInvalid, addr)
+	}
+	return addr, nil
+}
+
+// checkSegwit verifies a segwit address as BIP 173 and BIP 350 specify
+func checkSegwit(addr string) error {
+	_, data, encoding, err := decodeBech32(addr)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return fmt.Errorf("%w: %q has no witness version", ErrInvalid, addr)
+	}
+	version := data[0]
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return fmt.Errorf("%w: %q: %s", ErrInvalid, addr, err)
+	}
+	switch {
+	case version > 16:
+		return fmt.Errorf("%w: %q has witness version %d", ErrInvalid, addr, version)
+	case len(program) < 2 || len(program) > 40:
+		return fmt.Errorf("%w: %q has a %d byte witness program", ErrInvalid, addr, len(program))
+	case version == 0 && len(program) != 20 && len(program) != 32:
+		return fmt.Errorf("%w: %q has a %d byte version 0 witness program", ErrInvalid, addr, len(program))
+	case version == 0 && encoding != bech32:
+		return fmt.Errorf("%w: version 0 witness address %q must use bech32", ErrChecksum, addr)
+	case version > 0 && encoding != bech32m:
+		return fmt.Errorf("%w: version %d witness address %q must use bech32m", ErrChecksum, version, addr)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package address
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+// valid bech32 and bech32m strings from BIP 173 and BIP 350
+func TestBech32Checksums(t *testing.T) {
+	for s, want := range map[string]encoding{
+		"A12UEL5L": bech32,
+		"a12uel5l": bech32,
+		"an83characterlonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1tt5tgs": bech32,
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw":                                              bech32,
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w":                               bech32,
+		"?1ezyfcl": bech32,
+		"A1LQFN3A": bech32m,
+		"a1lqfn3a": bech32m,
+		"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11sg7hg6": bech32m,
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx":                                              bech32m,
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v":                               bech32m,
+		"?1v759aa": bech32m,
+	} {
+		_, _, got, err := decodeBech32(s)
+		if err != nil || got != want {
+			t.Errorf("decodeBech32(%q) = %d, %v, want encoding %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{
+		"A12UEL5M",
+		"a12UEL5L",
+		"pzry9x0s0muk",
+		"1pzry9x0s0muk",
+		"x1b4n0q5v",
+		"li1dgmt3",
+		"A1G7SGD8",
+		"an84characterslonghumanreadablepartthatcontainsthenumber1andtheexcludedcharactersbio1569pvx",
+	} {
+		_, _, _, err := decodeBech32(s)
+		if err == nil {
+			t.Errorf("decodeBech32(%q) should fail", s)
+		}
+	}
+}
+
+// segwit addresses from BIP 350
+func TestSegwitAddresses(t *testing.T) {
+	for _, addr := range []string{
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4",
+		"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+		"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y",
+		"BC1SW50QGDZ25J",
+		"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs",
+		"tb1qqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesrxh6hy",
+		"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c",
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+	} {
+		got, err := Validate(model.Bitcoin, addr)
+		if err != nil {
+			t.Errorf("%s should be valid: %s", addr, err)
+		} else if got != strings.ToLower(addr) {
+			t.Errorf("%s should be returned in lower case, got %s", addr, got)
+		}
+	}
+	for addr, want := range map[string]error{
+		// unknown human readable part
+		"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut": ErrInvalid,
+		// version 1 with a bech32 checksum, and version 0 with bech32m
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd": ErrChecksum,
+		"tb1z0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqglt7rf": ErrChecksum,
+		"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL": ErrChecksum,
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh":                     ErrChecksum,
+		"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq24jc47": ErrChecksum,
+		"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4": ErrInvalid,
+		"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R": ErrInvalid,
+		"bc1pw5dgrnzv": ErrInvalid,
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v8n0nx0muaewav253zgeav": ErrInvalid,
+		"BC1QR508D6QEJXTDG4Y5R3ZARVARYV98GJ9P":                                         ErrInvalid,
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq":               ErrInvalid,
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7v07qwwzcrf":             ErrInvalid,
+		"tb1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vpggkg4j":               ErrInvalid,
+		"bc1gmk9yu": ErrInvalid,
+	} {
+		_, err := Validate(model.Bitcoin, addr)
+		if !errors.Is(err, want) {
+			t.Errorf("%s: expected %v, got %v", addr, want, err)
+		}
+	}
+}
+
+func TestBase58Addresses(t *testing.T) {
+	for _, addr := range []string{"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy"} {
+		_, err := Validate(model.Bitcoin, addr)
+		if err != nil {
+			t.Errorf("%s should be valid: %s", addr, err)
+		}
+	}
+	_, err := Validate(model.Bitcoin, "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN3")
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	// a valid WIF key is not an address
+	_, err = Validate(model.Bitcoin, "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ")
+	if !errors.Is(err, ErrInvalid) {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
+
+// checksummed addresses from EIP-55
+func TestEVMAddresses(t *testing.T) {
+	for _, addr := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	} {
+		got, err := Validate(model.Ethereum, strings.ToLower(addr))
+		if err != nil || got != addr {
+			t.Errorf("lower case %s should be accepted and checksummed, got %s, %v", addr, got, err)
+		}
+		_, err = Validate(model.Native, addr)
+		if err != nil {
+			t.Errorf("%s should be valid: %s", addr, err)
+		}
+	}
+	_, err := Validate(model.Ethereum, "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAeD")
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	for _, addr := range []string{"5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed", "0x0000000000000000000000000000000000000000", "0x5aAeb6"} {
+		_, err = Validate(model.Ethereum, addr)
+		if !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: expected ErrInvalid, got %v", addr, err)
+		}
+	}
+	_, err = Validate(model.Unspecified, "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed")
+	if !errors.Is(err, ErrUnsupportedCurrency) {
+		t.Errorf("expected ErrUnsupportedCurrency, got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package address
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+type encoding int
+
+const (
+	bech32 encoding = iota + 1
+	bech32m
+)
+
+// checksum constants of the two encodings, see BIP 350
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+func polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	ret := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]>>5)
+	}
+	ret = append(ret, 0)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]&31)
+	}
+	return ret
+}
+
+// decodeBech32 splits s into its human readable part and 5 bit data, without the checksum, reporting its encoding
+func decodeBech32(s string) (hrp string, data []byte, enc encoding, err error) {
+	if len(s) > 90 {
+		return "", nil, 0, fmt.Errorf("%w: %q is longer than 90 characters", ErrInvalid, s)
+	}
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, 0, fmt.Errorf("%w: %q mixes upper and lower case", ErrInvalid, s)
+	}
+	s = strings.ToLower(s)
+	sep := strings.LastIndexByte(s, '1')
+	if sep < 1 || sep+7 > len(s) {
+		return "", nil, 0, fmt.Errorf("%w: %q is too short for a bech32 checksum", ErrInvalid, s)
+	}
+	hrp = s[:sep]
+	for _, c := range s[sep+1:] {
+		d := strings.IndexRune(bech32Charset, c)
+		if d < 0 {
+			return "", nil, 0, fmt.Errorf("%w: %q has invalid bech32 character %q", ErrInvalid, s, c)
+		}
+		data = append(data, byte(d))
+	}
+	switch polymod(append(hrpExpand(hrp), data...)) {
+	case bech32Const:
+		enc = bech32
+	case bech32mConst:
+		enc = bech32m
+	default:
+		return "", nil, 0, fmt.Errorf("%w: %s", ErrChecksum, s)
+	}
+	return hrp, data[:len(data)-6], enc, nil
+}
+
+// convertBits regroups data from groups of from bits into groups of to bits
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	var acc uint32
+	var bits uint
+	var ret []byte
+	maxv := uint32(1)<<to - 1
+	for _, v := range data {
+		if uint32(v)>>from != 0 {
+			return nil, errors.New("data value out of range")
+		}
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			ret = append(ret, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid padding")
+	}
+	return ret, nil
+}
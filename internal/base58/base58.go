@@ -0,0 +1,85 @@
+// Package base58 implements the Bitcoin base58 alphabet and the checksummed encoding used by WIF keys and legacy addresses
+package base58
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var (
+	ErrInvalidCharacter = errors.New("invalid base58 character")
+	ErrChecksum         = errors.New("base58 checksum mismatch")
+	ErrTooShort         = errors.New("base58 data too short for a version and checksum")
+)
+
+var radix = big.NewInt(58)
+
+func Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	var out []byte
+	mod := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, alphabet[mod.Int64()])
+	}
+	// each leading zero byte is written as the first character
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	for i := 0; i < len(s); i++ {
+		d := bytes.IndexByte([]byte(alphabet), s[i])
+		if d < 0 {
+			return nil, ErrInvalidCharacter
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+func checksum(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:4]
+}
+
+// CheckEncode encodes a version byte and payload followed by a four byte double SHA-256 checksum
+func CheckEncode(payload []byte, version byte) string {
+	data := append([]byte{version}, payload...)
+	return Encode(append(data, checksum(data)...))
+}
+
+// CheckDecode reverses CheckEncode, verifying the checksum
+func CheckDecode(s string) (payload []byte, version byte, err error) {
+	data, err := Decode(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < 5 {
+		return nil, 0, ErrTooShort
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if !bytes.Equal(checksum(body), sum) {
+		return nil, 0, ErrChecksum
+	}
+	return body[1:], body[0], nil
+}
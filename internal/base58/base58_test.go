@@ -0,0 +1,77 @@
+package base58
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+// vectors from Bitcoin Core's base58_encode_decode.json
+var vectors = []struct {
+	hex     string
+	encoded string
+}{
+	{"", ""},
+	{"61", "2g"},
+	{"626262", "a3gV"},
+	{"636363", "aPEr"},
+	{"73696d706c792061206c6f6e6720737472696e67", "2cFupjhnEsSn59qHXstmK2ffpLv2"},
+	{"00eb15231dfceb60925886b67d065299925915aeb172c06647", "1NS17iag9jJgTHD1VXjvLCEnZuQ3rJDE9L"},
+	{"516b6fcd0f", "ABnLTmg"},
+	{"bf4f89001e670274dd", "3SEo3LWLoPntC"},
+	{"572e4794", "3EFU7m"},
+	{"ecac89cad93923c02321", "EJDM8drfXA6uyA"},
+	{"10c8511e", "Rt5zm"},
+	{"00000000000000000000", "1111111111"},
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		data, _ := hex.DecodeString(v.hex)
+		if got := Encode(data); got != v.encoded {
+			t.Errorf("Encode(%s) = %q, want %q", v.hex, got, v.encoded)
+		}
+		decoded, err := Decode(v.encoded)
+		if err != nil {
+			t.Errorf("Decode(%q): %s", v.encoded, err)
+			continue
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("Decode(%q) = %x, want %s", v.encoded, decoded, v.hex)
+		}
+	}
+	_, err := Decode("3SEo3LWLoPntC0")
+	if !errors.Is(err, ErrInvalidCharacter) {
+		t.Errorf("expected ErrInvalidCharacter, got %v", err)
+	}
+}
+
+// WIF vectors from the Bitcoin wiki's private key example
+func TestCheckEncodeWIF(t *testing.T) {
+	key, _ := hex.DecodeString("0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d")
+	for _, v := range []struct {
+		payload []byte
+		wif     string
+	}{
+		{key, "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ"},
+		{append(append([]byte{}, key...), 0x01), "KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617"},
+	} {
+		if got := CheckEncode(v.payload, 0x80); got != v.wif {
+			t.Errorf("CheckEncode = %q, want %q", got, v.wif)
+		}
+		payload, version, err := CheckDecode(v.wif)
+		if err != nil || version != 0x80 || !bytes.Equal(payload, v.payload) {
+			t.Errorf("CheckDecode(%q) = %x, %x, %v", v.wif, payload, version, err)
+		}
+	}
+	// one character changed
+	_, _, err := CheckDecode("5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTK")
+	if !errors.Is(err, ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	_, _, err = CheckDecode("2g")
+	if !errors.Is(err, ErrTooShort) {
+		t.Errorf("expected ErrTooShort, got %v", err)
+	}
+}
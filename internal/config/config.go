@@ -3,9 +3,13 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/GridPlus/phonon-client/internal/registry"
 	"github.com/PhononDAO/phonon-core/pkg/cert"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -17,12 +21,37 @@ type ConfigFile struct {
 	// log exporting
 	TelemetryKey string
 	LoggingLevel string
+	// directory to write card APDU traces to. Tracing is off when empty
+	APDUTraceDir string
+	// deadlines for API operations keyed by operation name, with "default" for the rest. 0 disables a deadline
+	OperationTimeouts map[string]time.Duration
+	// how long a transfer proposal waits for the receiver to accept it
+	ProposalExpiry time.Duration
+	// how long the token from an export or redeem preview stays valid, and whether the PIN must be re-entered with it
+	ConfirmationExpiry time.Duration
+	ConfirmWithPIN     bool
+	// browser origins besides the client's own that may preview, export and redeem phonons, e.g. a frontend dev server
+	AllowedOrigins []string
+	// currencies and chains added to or replacing the built-in ones
+	Currencies []registry.Currency
+	Chains     []registry.Chain
+	// JSON-RPC endpoints of chains this client validates phonons on, follows deposits on and submits redeem transactions to
+	RPCEndpoints []onchain.Endpoint
 }
 
 type Config struct {
-	TelemetryKey string
-	Certificate  []byte
-	Level        log.Level
+	TelemetryKey       string
+	Certificate        []byte
+	Level              log.Level
+	APDUTraceDir       string
+	OperationTimeouts  map[string]time.Duration
+	ProposalExpiry     time.Duration
+	ConfirmationExpiry time.Duration
+	ConfirmWithPIN     bool
+	AllowedOrigins     []string
+	Currencies         []registry.Currency
+	Chains             []registry.Chain
+	RPCEndpoints       []onchain.Endpoint
 }
 
 func DefaultConfig() Config {
@@ -82,6 +111,15 @@ func LoadConfig() (config Config, err error) {
 	}
 
 	config.TelemetryKey = configFile.TelemetryKey
+	config.APDUTraceDir = configFile.APDUTraceDir
+	config.OperationTimeouts = configFile.OperationTimeouts
+	config.ProposalExpiry = configFile.ProposalExpiry
+	config.ConfirmationExpiry = configFile.ConfirmationExpiry
+	config.ConfirmWithPIN = configFile.ConfirmWithPIN
+	config.AllowedOrigins = configFile.AllowedOrigins
+	config.Currencies = configFile.Currencies
+	config.Chains = configFile.Chains
+	config.RPCEndpoints = configFile.RPCEndpoints
 
 	if configFile.LoggingLevel == "" {
 		config.Level = log.ErrorLevel
@@ -112,6 +150,15 @@ func DefaultConfigPath() (string, error) {
 	return ret, nil
 }
 
+// DataPath returns the path of elem within the config directory, where the client keeps its local state
+func DataPath(elem ...string) (string, error) {
+	configPath, err := DefaultConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{configPath}, elem...)...), nil
+}
+
 func SaveConfig() error {
 	viper.SetConfigType("yml")
 	configPath, err := DefaultConfigPath()
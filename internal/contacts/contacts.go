@@ -0,0 +1,258 @@
+/*
+Package contacts keeps an address book of counterparty cards, so a card can be paired with or sent to by a friendly
+name. The first identity certificate a contact's card presents is remembered, and a later certificate that differs is
+reported, since a card ID is only a prefix of the card's public key and does not prove which card is on the other end.
+*/
+package contacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/cert"
+)
+
+var (
+	ErrNotFound      = errors.New("contact not found")
+	ErrExists        = errors.New("a contact with that name already exists")
+	ErrCardIDTaken   = errors.New("another contact has that card ID")
+	ErrInvalidName   = errors.New("contact name must not be empty")
+	ErrInvalidCardID = errors.New("card ID must be 16 hexadecimal characters")
+)
+
+var cardIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+
+type Contact struct {
+	Name   string
+	CardID string
+	// jumpbox to connect to before pairing, when the card is not already reachable
+	URL   string `json:",omitempty"`
+	Notes string `json:",omitempty"`
+	// fingerprint of the identity certificate the card presented when first paired
+	CertFingerprint string     `json:",omitempty"`
+	LastSeen        *time.Time `json:",omitempty"`
+	Added           time.Time
+}
+
+// Fingerprint identifies an identity certificate
+func Fingerprint(crt *cert.CardCertificate) string {
+	sum := sha256.Sum256(crt.Serialize())
+	return hex.EncodeToString(sum[:])
+}
+
+type Book struct {
+	path     string
+	mtex     sync.Mutex
+	contacts map[string]Contact
+}
+
+// Open reads the address book at path, creating it on first save. An empty path keeps the book in memory only
+func Open(path string) (*Book, error) {
+	b := &Book{path: path, contacts: make(map[string]Contact)}
+	if path == "" {
+		return b, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Contact
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read address book: %w", err)
+	}
+	for _, c := range list {
+		b.contacts[key(c.Name)] = c
+	}
+	return b, nil
+}
+
+// names are matched case insensitively
+func key(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// save writes the book to disk. Must be called with b.mtex held
+func (b *Book) save() error {
+	if b.path == "" {
+		return nil
+	}
+	return persist.WriteJSON(b.path, b.list())
+}
+
+// list returns the contacts ordered by name. Must be called with b.mtex held
+func (b *Book) list() []Contact {
+	ret := make([]Contact, 0, len(b.contacts))
+	for _, c := range b.contacts {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return key(ret[i].Name) < key(ret[j].Name)
+	})
+	return ret
+}
+
+func (b *Book) List() []Contact {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	return b.list()
+}
+
+func (b *Book) Get(name string) (Contact, error) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	c, ok := b.contacts[key(name)]
+	if !ok {
+		return c, ErrNotFound
+	}
+	return c, nil
+}
+
+// ByCardID returns the contact of cardID
+func (b *Book) ByCardID(cardID string) (Contact, bool) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	for _, c := range b.contacts {
+		if strings.EqualFold(c.CardID, cardID) {
+			return c, true
+		}
+	}
+	return Contact{}, false
+}
+
+// check validates c as a replacement for the contact named replacing, empty when c is new. Must be called with b.mtex held
+func (b *Book) check(c Contact, replacing string) error {
+	if key(c.Name) == "" {
+		return ErrInvalidName
+	}
+	if !cardIDPattern.MatchString(c.CardID) {
+		return ErrInvalidCardID
+	}
+	if _, ok := b.contacts[key(c.Name)]; ok && key(c.Name) != key(replacing) {
+		return ErrExists
+	}
+	for k, other := range b.contacts {
+		if k != key(replacing) && strings.EqualFold(other.CardID, c.CardID) {
+			return ErrCardIDTaken
+		}
+	}
+	return nil
+}
+
+// Add adds a contact. Only the name, card ID, URL and notes are taken from c
+func (b *Book) Add(c Contact) (Contact, error) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	c = Contact{
+		Name:   strings.TrimSpace(c.Name),
+		CardID: strings.ToLower(c.CardID),
+		URL:    c.URL,
+		Notes:  c.Notes,
+		Added:  time.Now().UTC(),
+	}
+	err := b.check(c, "")
+	if err != nil {
+		return c, err
+	}
+	b.contacts[key(c.Name)] = c
+	return c, b.save()
+}
+
+/*
+Update replaces the name, card ID, URL and notes of the contact called name. Changing the card ID forgets the
+certificate seen for the old card
+*/
+func (b *Book) Update(name string, c Contact) (Contact, error) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	old, ok := b.contacts[key(name)]
+	if !ok {
+		return old, ErrNotFound
+	}
+	updated := old
+	updated.Name = strings.TrimSpace(c.Name)
+	updated.CardID = strings.ToLower(c.CardID)
+	updated.URL = c.URL
+	updated.Notes = c.Notes
+	if updated.CardID != old.CardID {
+		updated.CertFingerprint = ""
+		updated.LastSeen = nil
+	}
+	err := b.check(updated, name)
+	if err != nil {
+		return old, err
+	}
+	delete(b.contacts, key(name))
+	b.contacts[key(updated.Name)] = updated
+	return updated, b.save()
+}
+
+func (b *Book) Remove(name string) error {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	if _, ok := b.contacts[key(name)]; !ok {
+		return ErrNotFound
+	}
+	delete(b.contacts, key(name))
+	return b.save()
+}
+
+// ForgetCertificate clears the certificate remembered for a contact, so the next one its card presents is trusted
+func (b *Book) ForgetCertificate(name string) (Contact, error) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	c, ok := b.contacts[key(name)]
+	if !ok {
+		return c, ErrNotFound
+	}
+	c.CertFingerprint = ""
+	b.contacts[key(name)] = c
+	return c, b.save()
+}
+
+/*
+Seen notes that the card cardID was paired presenting crt. For a contact's card it updates the last seen time and
+remembers the certificate if none was yet. It returns a warning when the certificate differs from the one remembered,
+which is kept until the user forgets it. Cards that are not contacts are ignored.
+*/
+func (b *Book) Seen(cardID string, crt *cert.CardCertificate) (warning string, err error) {
+	b.mtex.Lock()
+	defer b.mtex.Unlock()
+	for k, c := range b.contacts {
+		if !strings.EqualFold(c.CardID, cardID) {
+			continue
+		}
+		now := time.Now().UTC()
+		c.LastSeen = &now
+		fingerprint := Fingerprint(crt)
+		switch c.CertFingerprint {
+		case "":
+			c.CertFingerprint = fingerprint
+		case fingerprint:
+		default:
+			warning = fmt.Sprintf("card %s of contact %q presented certificate %s, not the certificate %s it presented before. "+
+				"It may be a different card", cardID, c.Name, fingerprint, c.CertFingerprint)
+		}
+		b.contacts[k] = c
+		return warning, b.save()
+	}
+	return "", nil
+}
@@ -0,0 +1,92 @@
+package contacts
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func newMock(t *testing.T) *mock.MockCard {
+	t.Helper()
+	c, err := mock.NewMockCard(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*mock.MockCard)
+}
+
+func TestCertificatePinned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	b, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, impostor := newMock(t), newMock(t)
+	cardID := fmt.Sprintf("%x", ethcrypto.FromECDSAPub(card.IdentityPubKey))[:16]
+	_, err = b.Add(Contact{Name: "Alice", CardID: strings.ToUpper(cardID)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warning, err := b.Seen(cardID, &card.IdentityCert)
+	if err != nil || warning != "" {
+		t.Fatalf("the first certificate should be remembered without a warning, got %q, %v", warning, err)
+	}
+	warning, _ = b.Seen(cardID, &card.IdentityCert)
+	if warning != "" {
+		t.Errorf("the same certificate should not warn, got %q", warning)
+	}
+
+	// the pin survives a restart and is kept when another certificate is presented
+	b, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warning, _ = b.Seen(cardID, &impostor.IdentityCert)
+	if !strings.Contains(warning, "Alice") {
+		t.Errorf("expected a warning about a different certificate, got %q", warning)
+	}
+	c, _ := b.Get("alice")
+	if c.CertFingerprint != Fingerprint(&card.IdentityCert) || c.LastSeen == nil {
+		t.Errorf("certificate remembered for the contact changed: %+v", c)
+	}
+
+	_, err = b.ForgetCertificate("ALICE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warning, _ = b.Seen(cardID, &impostor.IdentityCert)
+	if warning != "" {
+		t.Errorf("a forgotten certificate should be replaced without a warning, got %q", warning)
+	}
+}
+
+func TestAddChecks(t *testing.T) {
+	b, _ := Open("")
+	_, err := b.Add(Contact{Name: "Bob", CardID: "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		c    Contact
+		want error
+	}{
+		{Contact{Name: " ", CardID: "0123456789abcdee"}, ErrInvalidName},
+		{Contact{Name: "Carol", CardID: "0123"}, ErrInvalidCardID},
+		{Contact{Name: "bob", CardID: "0123456789abcdee"}, ErrExists},
+		{Contact{Name: "Carol", CardID: "0123456789ABCDEF"}, ErrCardIDTaken},
+	} {
+		_, err := b.Add(tc.c)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("adding %+v: expected %v, got %v", tc.c, tc.want, err)
+		}
+	}
+	if _, ok := b.ByCardID("0123456789ABCDEF"); !ok {
+		t.Error("contact not found by card ID")
+	}
+}
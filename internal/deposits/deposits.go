@@ -0,0 +1,381 @@
+/*
+Package deposits keeps the deposits a card has started and not yet finalized, and follows the funding of each on its
+chain. A deposit is a phonon created without a descriptor: once its address holds the phonon's denomination with the
+chain's required confirmations, the phonon can be finalized on the card. Deposits are kept on disk so that they are
+still followed after a restart, which is when they are most easily forgotten.
+*/
+package deposits
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/ethereum/go-ethereum/common"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNotFound = errors.New("deposit not found")
+
+// Status is how far a deposit has got from being created to being finalized on its card
+type Status string
+
+const (
+	// nothing has been received at the deposit address
+	StatusWaiting Status = "waiting"
+	// the address holds less than the phonon's denomination
+	StatusUnderfunded Status = "underfunded"
+	// the address holds the denomination, without enough confirmations yet
+	StatusConfirming Status = "confirming"
+	// funded with enough confirmations and waiting for the card to be unlocked to finalize it
+	StatusConfirmed Status = "confirmed"
+	StatusFinalized Status = "finalized"
+	// cannot be finalized, see Err. The deposit is no longer followed
+	StatusFailed Status = "failed"
+)
+
+// Deposit is a phonon waiting to be funded and finalized
+type Deposit struct {
+	ID     string
+	CardID string
+	// the phonon as created for the deposit, and as its descriptor is set when finalized
+	Phonon *model.Phonon
+	// the address to fund, derived from the phonon's public key
+	Address string
+	Status  Status
+	// balance of Address in base units at Block, the head of the chain when last checked
+	Balance string `json:",omitempty"`
+	Block   uint64 `json:",omitempty"`
+	// first block in which Address held the denomination, 0 until it does
+	FundedBlock   uint64 `json:",omitempty"`
+	Confirmations uint64
+	Required      int
+	// last error checking or finalizing the deposit
+	Err       string `json:",omitempty"`
+	Created   time.Time
+	Checked   *time.Time `json:",omitempty"`
+	Finalized *time.Time `json:",omitempty"`
+}
+
+// pending reports whether the deposit is still followed
+func (d Deposit) pending() bool {
+	return d.Status != StatusFinalized && d.Status != StatusFailed
+}
+
+type Store struct {
+	path     string
+	mtex     sync.Mutex
+	deposits map[string]*Deposit
+}
+
+// Open reads the deposits at path, creating the file on first save. An empty path keeps deposits in memory only
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, deposits: make(map[string]*Deposit)}
+	if path == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Deposit
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read deposits: %w", err)
+	}
+	for _, d := range list {
+		s.deposits[d.ID] = d
+	}
+	return s, nil
+}
+
+// save writes the deposits to disk. Must be called with s.mtex held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return persist.WriteJSON(s.path, s.list(""))
+}
+
+// list returns the deposits of cardID, or all of them when it is empty, newest first. Must be called with s.mtex held
+func (s *Store) list(cardID string) []Deposit {
+	ret := make([]Deposit, 0, len(s.deposits))
+	for _, d := range s.deposits {
+		if cardID == "" || strings.EqualFold(d.CardID, cardID) {
+			ret = append(ret, *d)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.After(ret[j].Created)
+	})
+	return ret
+}
+
+// List returns the deposits of cardID, or of every card when it is empty, newest first
+func (s *Store) List(cardID string) []Deposit {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	return s.list(cardID)
+}
+
+func (s *Store) Get(id string) (Deposit, error) {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	d, ok := s.deposits[id]
+	if !ok {
+		return Deposit{}, ErrNotFound
+	}
+	return *d, nil
+}
+
+// Add starts following the deposit of phonon p on cardID, which must have its public key, denomination and chain
+func (s *Store) Add(cardID string, p *model.Phonon, required int) (Deposit, error) {
+	if p.PubKey == nil {
+		return Deposit{}, errors.New("deposit phonon has no public key")
+	}
+	pubKey, err := model.PhononPubKeyToECDSA(p.PubKey)
+	if err != nil {
+		return Deposit{}, err
+	}
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return Deposit{}, err
+	}
+	d := &Deposit{
+		ID:       hex.EncodeToString(id),
+		CardID:   cardID,
+		Phonon:   p,
+		Address:  ethcrypto.PubkeyToAddress(*pubKey).Hex(),
+		Status:   StatusWaiting,
+		Required: required,
+		Created:  time.Now().UTC(),
+	}
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	s.deposits[d.ID] = d
+	return *d, s.save()
+}
+
+// Remove stops following a deposit. The phonon is left on the card as it is
+func (s *Store) Remove(id string) error {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	if _, ok := s.deposits[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.deposits, id)
+	return s.save()
+}
+
+// update applies fn to the deposit id and saves, doing nothing if it has been removed
+func (s *Store) update(id string, fn func(d *Deposit)) {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	d, ok := s.deposits[id]
+	if !ok {
+		return
+	}
+	fn(d)
+	err := s.save()
+	if err != nil {
+		log.Error("unable to save deposits: ", err)
+	}
+}
+
+// Finalized records that the deposit id was finalized on the card
+func (s *Store) Finalized(id string) {
+	s.update(id, func(d *Deposit) {
+		now := time.Now().UTC()
+		d.Status = StatusFinalized
+		d.Finalized = &now
+		d.Err = ""
+	})
+}
+
+// Failed stops following the deposit id, which cannot be finalized for reason
+func (s *Store) Failed(id string, reason string) {
+	s.update(id, func(d *Deposit) {
+		d.Status = StatusFailed
+		d.Err = reason
+	})
+}
+
+// SetErr records why the deposit id could not be finalized this time. It is tried again on the next poll
+func (s *Store) SetErr(id string, err error) {
+	s.update(id, func(d *Deposit) {
+		d.Err = err.Error()
+	})
+}
+
+/*
+Settle records the outcome of a deposit finalized outside the store, by public key since that is all a client sends.
+A deposit finalized on chain is marked finalized; one given up on is no longer followed, as its phonon is destroyed.
+*/
+func (s *Store) Settle(cardID string, pubKey string, confirmedOnChain bool) {
+	pubKey = strings.ToLower(strings.TrimPrefix(pubKey, "0x"))
+	s.mtex.Lock()
+	var id string
+	for _, d := range s.deposits {
+		if d.pending() && strings.EqualFold(d.CardID, cardID) && strings.ToLower(strings.TrimPrefix(d.Phonon.PubKey.String(), "0x")) == pubKey {
+			id = d.ID
+			break
+		}
+	}
+	s.mtex.Unlock()
+	if id == "" {
+		return
+	}
+	if confirmedOnChain {
+		s.Finalized(id)
+		return
+	}
+	err := s.Remove(id)
+	if err != nil {
+		log.Errorf("unable to stop following deposit %s: %s", id, err)
+	}
+}
+
+/*
+Poll checks the funding of every followed deposit on a chain with an endpoint, returning those funded with the
+required confirmations. Deposits on other chains are left as they are.
+*/
+func (s *Store) Poll(ctx context.Context, chains *onchain.Chains) []Deposit {
+	s.mtex.Lock()
+	var pending []Deposit
+	for _, d := range s.deposits {
+		if d.pending() && chains.Has(d.Phonon.ChainID) {
+			pending = append(pending, *d)
+		}
+	}
+	s.mtex.Unlock()
+	var ready []Deposit
+	for _, d := range pending {
+		d = check(ctx, chains, d)
+		if d.Status == StatusConfirmed {
+			ready = append(ready, d)
+		}
+		s.update(d.ID, func(stored *Deposit) {
+			// the deposit may have been finalized while it was checked
+			if stored.pending() {
+				*stored = d
+			}
+		})
+	}
+	return ready
+}
+
+// check reads the funding of d from its chain
+func check(ctx context.Context, chains *onchain.Chains, d Deposit) Deposit {
+	now := time.Now().UTC()
+	d.Checked = &now
+	d.Err = ""
+	f, err := funding(ctx, chains, d)
+	if err != nil {
+		d.Err = err.Error()
+		log.Debugf("unable to check deposit %s on chain %d: %s", d.ID, d.Phonon.ChainID, err)
+		return d
+	}
+	d.Balance, d.Block, d.FundedBlock = f.balance.String(), f.head, f.fundedBlock
+	d.Confirmations = 0
+	switch {
+	case f.funded:
+		d.Confirmations = f.head - f.fundedBlock + 1
+		d.Status = StatusConfirming
+		if d.Confirmations >= uint64(d.Required) {
+			d.Status = StatusConfirmed
+		}
+	case f.balance.Sign() > 0:
+		d.Status = StatusUnderfunded
+	default:
+		d.Status = StatusWaiting
+	}
+	return d
+}
+
+type fundingState struct {
+	balance     *big.Int
+	head        uint64
+	funded      bool
+	fundedBlock uint64
+}
+
+/*
+funding reads the balance of a deposit's address at the head of its chain and, when it covers the denomination, the
+first block since which it has. Blocks are searched back no further than the required confirmations, beyond which
+the deposit is confirmed whichever block funded it.
+*/
+func funding(ctx context.Context, chains *onchain.Chains, d Deposit) (fundingState, error) {
+	var f fundingState
+	backend, err := chains.Backend(ctx, d.Phonon.ChainID)
+	if err != nil {
+		return f, err
+	}
+	header, err := backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return f, fmt.Errorf("unable to read the head of chain %d: %w", d.Phonon.ChainID, err)
+	}
+	f.head = header.Number.Uint64()
+	addr := common.HexToAddress(d.Address)
+	want := d.Phonon.Denomination.Value()
+	funded := func(block uint64) (bool, *big.Int, error) {
+		balance, err := backend.BalanceAt(ctx, addr, new(big.Int).SetUint64(block))
+		if err != nil {
+			return false, nil, fmt.Errorf("unable to read the balance of %s: %w", addr.Hex(), err)
+		}
+		return balance.Cmp(want) >= 0, balance, nil
+	}
+	ok, balance, err := funded(f.head)
+	if err != nil {
+		return f, err
+	}
+	f.balance = balance
+	if !ok {
+		return f, nil
+	}
+	// the lowest block searched is the one the required confirmations reach back to
+	low := uint64(0)
+	if depth := uint64(d.Required - 1); f.head > depth {
+		low = f.head - depth
+	}
+	floor, high := low, f.head
+	for low < high {
+		mid := low + (high-low)/2
+		ok, _, err := funded(mid)
+		if err != nil {
+			return f, err
+		}
+		if ok {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	// funded since before the blocks searched, as the deposit was when last checked
+	if high == floor && d.FundedBlock > 0 && d.FundedBlock < floor {
+		high = d.FundedBlock
+	}
+	f.funded, f.fundedBlock = true, high
+	return f, nil
+}
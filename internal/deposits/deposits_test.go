@@ -0,0 +1,140 @@
+package deposits
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var chainID = int(params.AllEthashProtocolChanges.ChainID.Int64())
+
+func depositPhonon(t *testing.T, keyIndex model.PhononKeyIndex, value int64) *model.Phonon {
+	t.Helper()
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := model.NewPhononPubKey(ethcrypto.FromECDSAPub(&key.PublicKey), model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denomination, err := model.NewDenomination(big.NewInt(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.Phonon{KeyIndex: keyIndex, PubKey: pubKey, CurrencyType: model.Ethereum, ChainID: chainID, Denomination: denomination}
+}
+
+// fund sends value from the funder's key to addr in the next block
+func fund(t *testing.T, sim *backends.SimulatedBackend, funder *ecdsa.PrivateKey, addr string, value int64) {
+	t.Helper()
+	ctx := context.Background()
+	from := ethcrypto.PubkeyToAddress(funder.PublicKey)
+	nonce, _ := sim.PendingNonceAt(ctx, from)
+	gasPrice, _ := sim.SuggestGasPrice(ctx)
+	tx := types.NewTransaction(nonce, common.HexToAddress(addr), big.NewInt(value), onchain.SweepGasLimit, gasPrice, nil)
+	tx, err := types.SignTx(tx, types.NewEIP155Signer(big.NewInt(int64(chainID))), funder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sim.SendTransaction(ctx, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFundingFollowed(t *testing.T) {
+	ctx := context.Background()
+	funder, _ := ethcrypto.GenerateKey()
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{
+		ethcrypto.PubkeyToAddress(funder.PublicKey): {Balance: big.NewInt(params.Ether)},
+	}, 8000000)
+	defer sim.Close()
+	chains, _ := onchain.New(nil)
+	chains.Register(chainID, sim, 2)
+
+	path := filepath.Join(t.TempDir(), "deposits.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := s.Add("card", depositPhonon(t, 1, 1000), chains.Confirmations(chainID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func(want Status, confirmations uint64) {
+		t.Helper()
+		got, _ := s.Get(d.ID)
+		if got.Status != want || got.Confirmations != confirmations || got.Err != "" {
+			t.Fatalf("expected %s with %d confirmations, got %+v", want, confirmations, got)
+		}
+	}
+
+	if ready := s.Poll(ctx, chains); len(ready) != 0 {
+		t.Errorf("an unfunded deposit is not ready: %+v", ready)
+	}
+	status(StatusWaiting, 0)
+	fund(t, sim, funder, d.Address, 500)
+	sim.Commit()
+	s.Poll(ctx, chains)
+	status(StatusUnderfunded, 0)
+	fund(t, sim, funder, d.Address, 500)
+	sim.Commit()
+	s.Poll(ctx, chains)
+	status(StatusConfirming, 1)
+	sim.Commit()
+	ready := s.Poll(ctx, chains)
+	if len(ready) != 1 || ready[0].ID != d.ID || ready[0].FundedBlock != 2 {
+		t.Fatalf("expected the deposit funded in block 2 to be ready, got %+v", ready)
+	}
+	status(StatusConfirmed, 2)
+
+	// still followed after a restart, until it is finalized
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status(StatusConfirmed, 2)
+	s.Settle("CARD", "0x"+d.Phonon.PubKey.String(), true)
+	got, _ := s.Get(d.ID)
+	if got.Status != StatusFinalized || got.Finalized == nil {
+		t.Errorf("expected the deposit to be finalized, got %+v", got)
+	}
+	if ready := s.Poll(ctx, chains); len(ready) != 0 {
+		t.Errorf("a finalized deposit is no longer followed, got %+v", ready)
+	}
+}
+
+func TestSettleGivenUp(t *testing.T) {
+	s, _ := Open("")
+	p := depositPhonon(t, 1, 1000)
+	d, err := s.Add("card", p, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := s.Add("other", depositPhonon(t, 1, 1000), 1)
+	if len(s.List("CARD")) != 1 {
+		t.Errorf("expected one deposit on card, got %+v", s.List("card"))
+	}
+	s.Settle("card", p.PubKey.String(), false)
+	if _, err := s.Get(d.ID); err != ErrNotFound {
+		t.Errorf("a deposit given up on should no longer be followed, got %v", err)
+	}
+	if _, err := s.Get(other.ID); err != nil {
+		t.Errorf("the deposit of another card was settled: %v", err)
+	}
+	if _, err := s.Add("card", &model.Phonon{KeyIndex: 2}, 1); err == nil {
+		t.Error("expected a phonon without a public key to be refused")
+	}
+}
@@ -0,0 +1,104 @@
+package history
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+card records the events that happen inside card commands rather than in answer to an API request: phonons received
+from a counterparty and phonons mined in the background. Everything else is recorded by the API handlers.
+*/
+type card struct {
+	model.PhononCard
+	l      *Ledger
+	cardID string
+}
+
+// Card wraps the PhononCard identified as cardID so the phonons it receives and mines are recorded
+func (l *Ledger) Card(c model.PhononCard, cardID string) model.PhononCard {
+	return &card{PhononCard: c, l: l, cardID: cardID}
+}
+
+/*
+ReceivePhonons lists the card before and after accepting the transfer, since the packet is encrypted for the card
+and only the card knows what it contained. If the first listing fails the receipt is still recorded, without the
+phonons' details.
+*/
+func (c *card) ReceivePhonons(phononTransfer []byte) error {
+	before, listErr := c.PhononCard.ListPhonons(0, 0, 0, false)
+	err := c.PhononCard.ReceivePhonons(phononTransfer)
+	if err != nil {
+		return err
+	}
+	var events []Event
+	var after []*model.Phonon
+	if listErr == nil {
+		after, listErr = c.PhononCard.ListPhonons(0, 0, 0, false)
+	}
+	if listErr != nil {
+		events = append(events, Event{
+			Kind:   KindReceived,
+			CardID: c.cardID,
+			Note:   "the card could not be listed, so the received phonons are unknown: " + listErr.Error(),
+		})
+	} else {
+		existing := make(map[model.PhononKeyIndex]bool, len(before))
+		for _, p := range before {
+			existing[p.KeyIndex] = true
+		}
+		for _, p := range after {
+			if existing[p.KeyIndex] {
+				continue
+			}
+			if p.PubKey == nil {
+				p.PubKey, _ = c.PhononCard.GetPhononPubKey(p.KeyIndex, p.CurveType)
+			}
+			events = append(events, PhononEvent(KindReceived, c.cardID, p))
+		}
+	}
+	recordErr := c.l.Record(events...)
+	if recordErr != nil {
+		log.Errorf("unable to record phonons received by card %s: %s", c.cardID, recordErr)
+	}
+	return nil
+}
+
+/*
+MineNativePhonon lists the card after a phonon is mined, since the denomination the card gives it is not part of the
+answer to the mining command. If the listing fails the phonon is still recorded, without its amount.
+*/
+func (c *card) MineNativePhonon(difficulty uint8) (model.PhononKeyIndex, []byte, error) {
+	keyIndex, hash, err := c.PhononCard.MineNativePhonon(difficulty)
+	if err != nil {
+		return keyIndex, hash, err
+	}
+	e := Event{
+		Kind:         KindMined,
+		CardID:       c.cardID,
+		KeyIndex:     keyIndex,
+		CurrencyType: model.Native,
+		// the public key of a native phonon is its hash
+		PubKey: hex.EncodeToString(hash),
+		Note:   fmt.Sprintf("difficulty %d", difficulty),
+	}
+	phonons, listErr := c.PhononCard.ListPhonons(0, 0, 0, false)
+	if listErr != nil {
+		e.Note += "; the card could not be listed, so the amount is unknown: " + listErr.Error()
+	}
+	for _, p := range phonons {
+		if p.KeyIndex == keyIndex {
+			e.Amount = p.Denomination.Value().String()
+			e.ChainID = p.ChainID
+			break
+		}
+	}
+	recordErr := c.l.Record(e)
+	if recordErr != nil {
+		log.Errorf("unable to record phonon mined by card %s: %s", c.cardID, recordErr)
+	}
+	return keyIndex, hash, nil
+}
@@ -0,0 +1,294 @@
+/*
+Package history keeps an append-only ledger of what happened to phonons on this client: created, described, sent,
+received, redeemed, exported, mined and deposited. Each event is a JSON line that is never rewritten, so the ledger
+is a record of the client's actions rather than of what is on the cards now.
+*/
+package history
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+type Kind string
+
+const (
+	KindCreated   Kind = "created"
+	KindDescribed Kind = "described"
+	KindSent      Kind = "sent"
+	KindReceived  Kind = "received"
+	KindRedeemed  Kind = "redeemed"
+	KindExported  Kind = "exported"
+	KindMined     Kind = "mined"
+	KindDeposited Kind = "deposited"
+)
+
+// Kinds lists every event kind
+var Kinds = []Kind{KindCreated, KindDescribed, KindSent, KindReceived, KindRedeemed, KindExported, KindMined, KindDeposited}
+
+type Event struct {
+	ID           string
+	Time         time.Time
+	Kind         Kind
+	CardID       string
+	KeyIndex     model.PhononKeyIndex
+	PubKey       string             `json:",omitempty"`
+	CurrencyType model.CurrencyType `json:",omitempty"`
+	ChainID      int                `json:",omitempty"`
+	// value in base units
+	Amount string `json:",omitempty"`
+	// the other card of a transfer, or the address a phonon was redeemed to
+	Counterparty string `json:",omitempty"`
+	TransferID   string `json:",omitempty"`
+	Note         string `json:",omitempty"`
+}
+
+// PhononEvent describes an event of kind for phonon p on cardID
+func PhononEvent(kind Kind, cardID string, p *model.Phonon) Event {
+	e := Event{
+		Kind:         kind,
+		CardID:       cardID,
+		KeyIndex:     p.KeyIndex,
+		CurrencyType: p.CurrencyType,
+		ChainID:      p.ChainID,
+	}
+	if p.PubKey != nil {
+		e.PubKey = p.PubKey.String()
+	}
+	if p.CurrencyType != model.Unspecified {
+		e.Amount = p.Denomination.Value().String()
+	}
+	return e
+}
+
+type Ledger struct {
+	f      *os.File
+	mtex   sync.Mutex
+	events []Event
+	// called with each batch of recorded events
+	subscribers []func([]Event)
+}
+
+// Subscribe calls fn with the events of each later Record once they are written. fn must not block
+func (l *Ledger) Subscribe(fn func([]Event)) {
+	l.mtex.Lock()
+	defer l.mtex.Unlock()
+	l.subscribers = append(l.subscribers, fn)
+}
+
+// Open opens the ledger at path, creating it if needed. An empty path keeps the ledger in memory only
+func Open(path string) (*Ledger, error) {
+	l := &Ledger{}
+	if path == "" {
+		return l, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		var e Event
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// a crash can leave the last event half written, which is cut off below
+			log.Errorf("skipping unreadable history event on line %d: %s", line, err)
+			continue
+		}
+		l.events = append(l.events, e)
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = persist.DropPartialLine(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+func (l *Ledger) Close() error {
+	if l.f == nil {
+		return nil
+	}
+	return l.f.Close()
+}
+
+// Record appends events, filling in their IDs and times
+func (l *Ledger) Record(events ...Event) error {
+	subscribers, err := l.append(events)
+	if err != nil {
+		return err
+	}
+	for _, fn := range subscribers {
+		fn(events)
+	}
+	return nil
+}
+
+// append writes events, returning the subscribers to tell about them
+func (l *Ledger) append(events []Event) ([]func([]Event), error) {
+	l.mtex.Lock()
+	defer l.mtex.Unlock()
+	var buf []byte
+	now := time.Now().UTC()
+	for i := range events {
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		events[i].ID = hex.EncodeToString(id)
+		events[i].Time = now
+		data, err := json.Marshal(events[i])
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	if l.f != nil {
+		_, err := l.f.Write(buf)
+		if err != nil {
+			return nil, err
+		}
+		err = l.f.Sync()
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.events = append(l.events, events...)
+	return l.subscribers, nil
+}
+
+// Filter selects events. Zero fields match everything; From is inclusive and To exclusive
+type Filter struct {
+	CardID       string
+	Kinds        []Kind
+	CurrencyType *model.CurrencyType
+	KeyIndex     *model.PhononKeyIndex
+	PubKey       string
+	Counterparty string
+	From         time.Time
+	To           time.Time
+}
+
+func (f Filter) matches(e Event) bool {
+	if f.CardID != "" && !strings.EqualFold(e.CardID, f.CardID) {
+		return false
+	}
+	if len(f.Kinds) > 0 {
+		found := false
+		for _, k := range f.Kinds {
+			if e.Kind == k {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.CurrencyType != nil && e.CurrencyType != *f.CurrencyType {
+		return false
+	}
+	if f.KeyIndex != nil && e.KeyIndex != *f.KeyIndex {
+		return false
+	}
+	if f.PubKey != "" && !strings.EqualFold(strings.TrimPrefix(f.PubKey, "0x"), e.PubKey) {
+		return false
+	}
+	if f.Counterparty != "" && !strings.EqualFold(e.Counterparty, f.Counterparty) {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// Query returns the events matching f, oldest first
+func (l *Ledger) Query(f Filter) []Event {
+	l.mtex.Lock()
+	defer l.mtex.Unlock()
+	ret := []Event{}
+	for _, e := range l.events {
+		if f.matches(e) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// WriteCSV writes events as CSV with a header row
+func WriteCSV(w io.Writer, events []Event) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"id", "time", "kind", "cardID", "keyIndex", "pubKey", "currencyType", "chainID", "amount", "counterparty", "transferID", "note"})
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		err = cw.Write([]string{
+			e.ID,
+			e.Time.Format(time.RFC3339),
+			string(e.Kind),
+			e.CardID,
+			strconv.Itoa(int(e.KeyIndex)),
+			e.PubKey,
+			strconv.Itoa(int(e.CurrencyType)),
+			strconv.Itoa(e.ChainID),
+			e.Amount,
+			e.Counterparty,
+			e.TransferID,
+			e.Note,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ParseKinds reads a comma separated list of event kinds
+func ParseKinds(s string) ([]Kind, error) {
+	var kinds []Kind
+	for _, name := range strings.Split(s, ",") {
+		kind := Kind(strings.TrimSpace(name))
+		known := false
+		for _, k := range Kinds {
+			if kind == k {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown event kind %q", kind)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
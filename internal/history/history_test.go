@@ -0,0 +1,129 @@
+package history
+
+import (
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+func TestPartialLineDropped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Record(Event{Kind: KindCreated, CardID: "card", KeyIndex: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// a crash in the middle of writing the second event
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID":"half","Kind":"sent`)
+	f.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.Record(Event{Kind: KindSent, CardID: "card", KeyIndex: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	events := l.Query(Filter{})
+	if len(events) != 2 || events[0].Kind != KindCreated || events[1].Kind != KindSent {
+		t.Fatalf("expected the created and sent events to survive the crash, got %+v", events)
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	l, _ := Open("")
+	denomination, _ := model.NewDenomination(big.NewInt(2000))
+	l.Record(
+		PhononEvent(KindCreated, "card1", &model.Phonon{KeyIndex: 1}),
+		PhononEvent(KindDescribed, "card1", &model.Phonon{KeyIndex: 1, CurrencyType: model.Ethereum, ChainID: 1, Denomination: denomination}),
+		Event{Kind: KindSent, CardID: "card2", Counterparty: "CARD1"},
+	)
+	described := l.Query(Filter{Kinds: []Kind{KindDescribed}})
+	if len(described) != 1 || described[0].Amount != "2000" {
+		t.Fatalf("expected the described event with its amount, got %+v", described)
+	}
+	if got := l.Query(Filter{CardID: "CARD1"}); len(got) != 2 {
+		t.Errorf("expected 2 events of card1, got %d", len(got))
+	}
+	if got := l.Query(Filter{Counterparty: "card1"}); len(got) != 1 || got[0].CardID != "card2" {
+		t.Errorf("expected the send to card1, got %+v", got)
+	}
+	if created := l.Query(Filter{Kinds: []Kind{KindCreated}}); created[0].Amount != "" {
+		t.Errorf("a phonon without a currency should have no amount, got %q", created[0].Amount)
+	}
+	_, err := ParseKinds("sent, minted")
+	if err == nil {
+		t.Error("expected an unknown kind to be refused")
+	}
+}
+
+// miningCard mines a phonon at a fixed key index, which the card then lists with a denomination
+type miningCard struct {
+	*mock.MockCard
+	mined    *model.Phonon
+	listFail bool
+}
+
+func (c *miningCard) MineNativePhonon(difficulty uint8) (model.PhononKeyIndex, []byte, error) {
+	return c.mined.KeyIndex, make([]byte, 32), nil
+}
+
+func (c *miningCard) ListPhonons(currencyType model.CurrencyType, lessThanValue uint64, greaterThanValue uint64, continuation bool) ([]*model.Phonon, error) {
+	if c.listFail {
+		return nil, errors.New("card removed")
+	}
+	return []*model.Phonon{{KeyIndex: 2}, c.mined}, nil
+}
+
+func TestMinedAmountRecorded(t *testing.T) {
+	m, err := mock.NewMockCard(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denomination, _ := model.NewDenomination(big.NewInt(500))
+	mc := &miningCard{MockCard: m.(*mock.MockCard), mined: &model.Phonon{KeyIndex: 7, Denomination: denomination}}
+	l, _ := Open("")
+	c := l.Card(mc, "card")
+	_, _, err = c.MineNativePhonon(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.listFail = true
+	_, _, err = c.MineNativePhonon(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mined := l.Query(Filter{Kinds: []Kind{KindMined}})
+	if len(mined) != 2 {
+		t.Fatalf("expected 2 mined events, got %d", len(mined))
+	}
+	if mined[0].Amount != "500" || mined[0].KeyIndex != 7 || mined[0].CurrencyType != model.Native || mined[0].PubKey == "" {
+		t.Errorf("mined phonon recorded without its details: %+v", mined[0])
+	}
+	if mined[1].Amount != "" || !strings.Contains(mined[1].Note, "amount is unknown") {
+		t.Errorf("a mined phonon that could not be listed should be recorded without an amount: %+v", mined[1])
+	}
+}
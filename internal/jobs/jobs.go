@@ -0,0 +1,382 @@
+/*
+Package jobs tracks long running API operations that run after their request has returned. Each job is persisted as
+a JSON file so its outcome can still be queried after a restart. Secrets a job produces, such as the private keys of
+redeemed phonons, are not kept with its results: they are sealed under a token that only the job's creator receives
+and are handed back once, when the creator claims them. Files are only readable by the owner.
+*/
+package jobs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	log "github.com/sirupsen/logrus"
+)
+
+type State string
+
+const (
+	StatePending     State = "pending"
+	StateRunning     State = "running"
+	StateSucceeded   State = "succeeded"
+	StateFailed      State = "failed"
+	StateInterrupted State = "interrupted"
+)
+
+// finished jobs older than this are deleted when a store is opened
+const retention = 30 * 24 * time.Hour
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrWrongToken  = errors.New("wrong job token")
+	ErrNoSecrets   = errors.New("job holds no secrets, or they have already been claimed")
+)
+
+type Progress struct {
+	Done  int
+	Total int
+}
+
+// ItemResult is the outcome of one item of a job, such as one phonon of a redemption
+type ItemResult struct {
+	Index  int
+	Result json.RawMessage `json:",omitempty"`
+	Err    string          `json:",omitempty"`
+}
+
+type Job struct {
+	ID       string
+	Kind     string
+	CardID   string
+	State    State
+	Created  time.Time
+	Updated  time.Time
+	Progress Progress
+	Items    []ItemResult
+	Result   json.RawMessage `json:",omitempty"`
+	Err      string          `json:",omitempty"`
+	Finished bool
+	// indices of the items whose secrets are waiting to be claimed
+	SealedItems []int `json:",omitempty"`
+	// secrets by item index, each the nonce followed by the ciphertext under the token. Never listed
+	Sealed map[int]HexBytes `json:",omitempty"`
+	// SHA-256 of the token, to check a claim against. Never listed
+	TokenHash HexBytes `json:",omitempty"`
+	// the token, only known to the process that created the job
+	token []byte
+	store *Store
+}
+
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = data
+	return nil
+}
+
+type Store struct {
+	dir  string
+	mtex sync.Mutex
+	jobs map[string]*Job
+}
+
+/*
+NewStore opens the job store in dir, creating it if needed. Jobs that were pending or running when the previous
+process stopped are marked interrupted, since nothing is left to finish them. An empty dir keeps jobs in memory only.
+*/
+func NewStore(dir string) (*Store, error) {
+	s := &Store{
+		dir:  dir,
+		jobs: make(map[string]*Job),
+	}
+	if dir == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		j := &Job{}
+		err = json.Unmarshal(data, j)
+		if err != nil {
+			log.Errorf("skipping unreadable job file %s: %s", f, err)
+			continue
+		}
+		j.store = s
+		if j.Finished && time.Since(j.Updated) > retention {
+			os.Remove(f)
+			continue
+		}
+		if !j.Finished {
+			j.State = StateInterrupted
+			j.Err = "phonon-client stopped before the job finished; check the card to see which items completed"
+			j.Finished = true
+			j.Updated = time.Now()
+			err = s.save(j)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.jobs[j.ID] = j
+	}
+	return s, nil
+}
+
+/*
+Create records a new pending job of kind against the card cardID with total items. The job's token, see Token, is
+only available from the returned job.
+*/
+func (s *Store) Create(kind string, cardID string, total int) (*Job, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 32)
+	_, err = rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+	tokenHash := sha256.Sum256(token)
+	now := time.Now()
+	j := &Job{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		CardID:    cardID,
+		State:     StatePending,
+		Created:   now,
+		Updated:   now,
+		Progress:  Progress{Total: total},
+		Items:     []ItemResult{},
+		TokenHash: tokenHash[:],
+		token:     token,
+		store:     s,
+	}
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	err = s.save(j)
+	if err != nil {
+		return nil, err
+	}
+	s.jobs[j.ID] = j
+	return j, nil
+}
+
+// Get returns a snapshot of the job with id
+func (s *Store) Get(id string) (Job, error) {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return j.snapshot(), nil
+}
+
+// List returns snapshots of every job, newest first, optionally limited to one card
+func (s *Store) List(cardID string) []Job {
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	ret := []Job{}
+	for _, j := range s.jobs {
+		if cardID != "" && !strings.EqualFold(j.CardID, cardID) {
+			continue
+		}
+		ret = append(ret, j.snapshot())
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Created.After(ret[b].Created)
+	})
+	return ret
+}
+
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Items = append([]ItemResult{}, j.Items...)
+	c.SealedItems = append([]int(nil), j.SealedItems...)
+	c.Sealed, c.TokenHash, c.token, c.store = nil, nil, nil, nil
+	return c
+}
+
+// Token returns the token needed to claim the job's secrets, to be handed to the job's creator alone
+func (j *Job) Token() string {
+	return hex.EncodeToString(j.token)
+}
+
+// Seal keeps secret for item index until it is claimed with the job's token. It is never written in the clear
+func (j *Job) Seal(index int, secret []byte) error {
+	aead, err := tokenCipher(j.token)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, secret, nil)
+	j.update(func() {
+		if j.Sealed == nil {
+			j.Sealed = make(map[int]HexBytes)
+		}
+		if _, ok := j.Sealed[index]; !ok {
+			j.SealedItems = append(j.SealedItems, index)
+			sort.Ints(j.SealedItems)
+		}
+		j.Sealed[index] = sealed
+	})
+	return nil
+}
+
+// Claim returns the secrets of the job id by item index and forgets them, so they are only handed out once
+func (s *Store) Claim(id string, token string) (map[int][]byte, error) {
+	key, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, ErrWrongToken
+	}
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	tokenHash := sha256.Sum256(key)
+	if len(j.TokenHash) == 0 || subtle.ConstantTimeCompare(tokenHash[:], j.TokenHash) != 1 {
+		return nil, ErrWrongToken
+	}
+	if len(j.Sealed) == 0 {
+		return nil, ErrNoSecrets
+	}
+	aead, err := tokenCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[int][]byte, len(j.Sealed))
+	for index, sealed := range j.Sealed {
+		if len(sealed) < aead.NonceSize() {
+			return nil, fmt.Errorf("sealed secret of item %d is corrupted", index)
+		}
+		secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open sealed secret of item %d: %w", index, err)
+		}
+		secrets[index] = secret
+	}
+	j.Sealed, j.SealedItems = nil, nil
+	j.Updated = time.Now()
+	err = s.save(j)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// tokenCipher seals secrets with the token itself as the key. Tokens are random, so there is nothing to stretch
+func tokenCipher(token []byte) (cipher.AEAD, error) {
+	if len(token) != 32 {
+		return nil, ErrWrongToken
+	}
+	block, err := aes.NewCipher(token)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Start marks the job as running
+func (j *Job) Start() {
+	j.update(func() {
+		j.State = StateRunning
+	})
+}
+
+// SetItem records the result of item index. result is encoded as JSON
+func (j *Job) SetItem(index int, result interface{}, err error) {
+	item := ItemResult{Index: index}
+	if result != nil {
+		data, encErr := json.Marshal(result)
+		if encErr != nil {
+			log.Error("unable to encode job item result: ", encErr)
+		}
+		item.Result = data
+	}
+	if err != nil {
+		item.Err = err.Error()
+	}
+	j.update(func() {
+		j.Items = append(j.Items, item)
+		j.Progress.Done = len(j.Items)
+	})
+}
+
+// Finish marks the job as done with result, which is encoded as JSON. The job fails if err is not nil
+func (j *Job) Finish(result interface{}, err error) {
+	var data json.RawMessage
+	if result != nil {
+		var encErr error
+		data, encErr = json.Marshal(result)
+		if encErr != nil {
+			log.Error("unable to encode job result: ", encErr)
+		}
+	}
+	j.update(func() {
+		j.Result = data
+		j.Finished = true
+		if err != nil {
+			j.State = StateFailed
+			j.Err = err.Error()
+		} else {
+			j.State = StateSucceeded
+		}
+	})
+}
+
+func (j *Job) update(f func()) {
+	j.store.mtex.Lock()
+	defer j.store.mtex.Unlock()
+	f()
+	j.Updated = time.Now()
+	err := j.store.save(j)
+	if err != nil {
+		log.Errorf("unable to persist job %s: %s", j.ID, err)
+	}
+}
+
+// save writes j to disk, replacing the previous file atomically. Must be called with s.mtex held
+func (s *Store) save(j *Job) error {
+	if s.dir == "" {
+		return nil
+	}
+	return persist.WriteJSON(filepath.Join(s.dir, j.ID+".json"), j)
+}
@@ -0,0 +1,113 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSealAndClaim(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := s.Create("redeemPhonons", "card", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	err = j.Seal(1, []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.SetItem(1, map[string]string{"TransactionData": "tx"}, nil)
+	j.Finish(nil, nil)
+
+	data, err := os.ReadFile(filepath.Join(dir, j.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), key) {
+		t.Error("job file holds the secret in the clear")
+	}
+	listed, err := json.Marshal(s.List(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(listed), "Sealed\"") || strings.Contains(string(listed), "TokenHash") {
+		t.Errorf("listed jobs carry sealed secrets: %s", listed)
+	}
+	got, err := s.Get(j.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.SealedItems) != 1 || got.SealedItems[0] != 1 {
+		t.Errorf("expected item 1 to be sealed, got %v", got.SealedItems)
+	}
+
+	// a restart keeps the sealed secret, which the creator's token still opens
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Claim(j.ID, strings.Repeat("00", 32))
+	if !errors.Is(err, ErrWrongToken) {
+		t.Fatalf("expected ErrWrongToken, got %v", err)
+	}
+	secrets, err := s.Claim(j.ID, j.Token())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(secrets[1]) != key || len(secrets) != 1 {
+		t.Errorf("unexpected secrets %q", secrets)
+	}
+	_, err = s.Claim(j.ID, j.Token())
+	if !errors.Is(err, ErrNoSecrets) {
+		t.Fatalf("secrets should only be claimed once, got %v", err)
+	}
+	got, _ = s.Get(j.ID)
+	if len(got.SealedItems) != 0 {
+		t.Errorf("claimed items still listed as sealed: %v", got.SealedItems)
+	}
+}
+
+func TestInterruptedOnRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := s.Create("send", "card", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.Start()
+	done, err := s.Create("send", "card", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done.Finish(nil, nil)
+
+	s, err = NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Get(running.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.State != StateInterrupted || !got.Finished {
+		t.Errorf("running job should be interrupted after a restart, got %s", got.State)
+	}
+	got, _ = s.Get(done.ID)
+	if got.State != StateSucceeded {
+		t.Errorf("finished job should keep its state, got %s", got.State)
+	}
+	if list := s.List("other"); len(list) != 0 {
+		t.Errorf("expected no jobs for another card, got %d", len(list))
+	}
+}
@@ -0,0 +1,89 @@
+package journal
+
+import (
+	"fmt"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+/*
+card journals the transfers of a PhononCard around the card commands that move phonons. A transfer that cannot be
+written to the journal is not started.
+*/
+type card struct {
+	model.PhononCard
+	j      *Journal
+	cardID string
+}
+
+// Card wraps the PhononCard identified as cardID so that the phonons it sends and receives are journaled
+func (j *Journal) Card(c model.PhononCard, cardID string) model.PhononCard {
+	return &card{PhononCard: c, j: j, cardID: cardID}
+}
+
+func (c *card) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	refs, err := c.describe(keyIndices)
+	if err != nil {
+		return nil, fmt.Errorf("unable to journal transfer, phonons not sent: %w", err)
+	}
+	t, err := c.j.beginOutgoing(c.cardID, keyIndices, refs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to journal transfer, phonons not sent: %w", err)
+	}
+	packet, err := c.PhononCard.SendPhonons(keyIndices, extendedRequest)
+	c.j.sent(t, packet, err)
+	return packet, err
+}
+
+func (c *card) ReceivePhonons(phononTransfer []byte) error {
+	t, err := c.j.beginIncoming(c.cardID, phononTransfer)
+	if err != nil {
+		return fmt.Errorf("unable to journal transfer, phonons not received: %w", err)
+	}
+	err = c.PhononCard.ReceivePhonons(phononTransfer)
+	c.j.received(t, err)
+	return err
+}
+
+/*
+describe returns the descriptions of the phonons at keyIndices, as given to PrepareSend or else listed from the card,
+with the public keys the caller did not give read from the card. Without them a transfer could not be reconciled.
+*/
+func (c *card) describe(keyIndices []model.PhononKeyIndex) ([]PhononRef, error) {
+	refs := make([]PhononRef, 0, len(keyIndices))
+	var listed map[model.PhononKeyIndex]*model.Phonon
+	for _, keyIndex := range keyIndices {
+		ref, ok := c.j.preparedRef(c.cardID, keyIndex)
+		if !ok {
+			if listed == nil {
+				phonons, err := c.PhononCard.ListPhonons(0, 0, 0, false)
+				if err != nil {
+					return nil, fmt.Errorf("unable to list phonons: %w", err)
+				}
+				listed = make(map[model.PhononKeyIndex]*model.Phonon)
+				for _, p := range phonons {
+					listed[p.KeyIndex] = p
+				}
+			}
+			p, onCard := listed[keyIndex]
+			if !onCard {
+				return nil, fmt.Errorf("no phonon at key index %d", keyIndex)
+			}
+			ref = PhononRef{
+				KeyIndex:     keyIndex,
+				CurveType:    p.CurveType,
+				CurrencyType: p.CurrencyType,
+				Denomination: p.Denomination,
+			}
+		}
+		if ref.PubKey == "" {
+			pubKey, err := c.PhononCard.GetPhononPubKey(keyIndex, ref.CurveType)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the public key of key index %d: %w", keyIndex, err)
+			}
+			ref.PubKey = pubKey.String()
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
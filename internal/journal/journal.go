@@ -0,0 +1,563 @@
+/*
+Package journal keeps a write-ahead record of phonon transfers. A transfer is written before the card is asked to
+release or accept phonons and again once it has, so a transfer interrupted by a crash or a lost counterparty can be
+found and reconciled against the card afterwards.
+
+Outgoing transfers keep the encrypted transfer packet the card produced. It can only be opened by the counterparty
+card it was made for, but it is the only copy of the phonons once they have left the card, so the journal is only
+readable by the owner.
+*/
+package journal
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+type Direction string
+
+const (
+	Outgoing Direction = "outgoing"
+	Incoming Direction = "incoming"
+)
+
+type Stage string
+
+const (
+	// the card is about to be asked to release the phonons
+	StagePrepared Stage = "prepared"
+	// the card released the phonons and returned the transfer packet
+	StageSent Stage = "sent"
+	// the counterparty confirmed receipt
+	StageDelivered Stage = "delivered"
+	// the counterparty did not confirm receipt. The phonons are only in the recorded packet
+	StageUndelivered Stage = "undelivered"
+	// the card refused to release the phonons, which are still on it
+	StageAborted Stage = "aborted"
+	// the card is about to be given a transfer packet
+	StageReceiving Stage = "receiving"
+	// the card accepted the packet
+	StageReceived Stage = "received"
+	// the card refused the packet
+	StageRejected Stage = "rejected"
+	// recovery could not settle the transfer on its own
+	StageAttention Stage = "attention"
+	// the transfer was settled by recovery or by hand
+	StageResolved Stage = "resolved"
+)
+
+// pending reports whether a transfer in stage s has not been settled
+func (s Stage) pending() bool {
+	switch s {
+	case StagePrepared, StageSent, StageUndelivered, StageReceiving, StageAttention:
+		return true
+	}
+	return false
+}
+
+var ErrTransferNotFound = errors.New("transfer not found")
+var ErrTransferSettled = errors.New("transfer is already settled")
+
+/*
+PhononRef identifies a phonon in a transfer. Key indices are reused once a phonon leaves the card, so only the
+public key tells a phonon from one stored at the same key index later.
+*/
+type PhononRef struct {
+	KeyIndex     model.PhononKeyIndex
+	PubKey       string          `json:",omitempty"`
+	CurveType    model.CurveType `json:",omitempty"`
+	CurrencyType model.CurrencyType
+	Denomination model.Denomination
+}
+
+// PhononRefs describes phonons given by an API caller. The public keys of those without one are read from the card
+func PhononRefs(phonons []model.Phonon) []PhononRef {
+	refs := make([]PhononRef, 0, len(phonons))
+	for _, p := range phonons {
+		ref := PhononRef{
+			KeyIndex:     p.KeyIndex,
+			CurveType:    p.CurveType,
+			CurrencyType: p.CurrencyType,
+			Denomination: p.Denomination,
+		}
+		if p.PubKey != nil {
+			ref.PubKey = p.PubKey.String()
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// Record is one line of the journal, describing a transfer entering a stage
+type Record struct {
+	TransferID string
+	Time       time.Time
+	CardID     string
+	Direction  Direction
+	Stage      Stage
+	KeyIndices []model.PhononKeyIndex `json:",omitempty"`
+	Phonons    []PhononRef            `json:",omitempty"`
+	Packet     []byte                 `json:",omitempty"`
+	Note       string                 `json:",omitempty"`
+	Err        string                 `json:",omitempty"`
+}
+
+// Transfer is the current state of a transfer, built from its records
+type Transfer struct {
+	ID         string
+	CardID     string
+	Direction  Direction
+	Stage      Stage
+	Started    time.Time
+	Updated    time.Time
+	KeyIndices []model.PhononKeyIndex `json:",omitempty"`
+	Phonons    []PhononRef            `json:",omitempty"`
+	Packet     []byte                 `json:",omitempty"`
+	Note       string                 `json:",omitempty"`
+	Err        string                 `json:",omitempty"`
+}
+
+type Journal struct {
+	mtex      sync.Mutex
+	f         *os.File
+	transfers map[string]*Transfer
+	order     []string
+	// outgoing transfers started since the last FinishSend, by card
+	inFlight map[string]*Transfer
+	// phonon descriptions for the next outgoing transfer, by card
+	prepared map[string][]PhononRef
+}
+
+/*
+Open opens the journal at path, creating it if needed, and rebuilds the state of every transfer. Outgoing transfers
+the previous process left waiting on a counterparty are marked undelivered. Transfers that are still pending must be
+settled with Reconcile once their card is unlocked. An empty path keeps the journal in memory only.
+*/
+func Open(path string) (*Journal, error) {
+	j := &Journal{
+		transfers: make(map[string]*Transfer),
+		inFlight:  make(map[string]*Transfer),
+		prepared:  make(map[string][]PhononRef),
+	}
+	if path == "" {
+		return j, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	// records carry transfer packets, which can be large
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		var r Record
+		err = json.Unmarshal(scanner.Bytes(), &r)
+		if err != nil {
+			// a crash can leave the last record half written
+			log.Errorf("skipping unreadable journal record on line %d: %s", line, err)
+			continue
+		}
+		j.apply(r)
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = persist.DropPartialLine(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+
+	for _, id := range j.order {
+		t := j.transfers[id]
+		if t.Stage == StageSent {
+			err = j.append(t, StageUndelivered, nil, "phonon-client stopped before the counterparty confirmed receipt", nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return j, nil
+}
+
+func (j *Journal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
+
+func (j *Journal) apply(r Record) {
+	t, ok := j.transfers[r.TransferID]
+	if !ok {
+		t = &Transfer{
+			ID:        r.TransferID,
+			CardID:    r.CardID,
+			Direction: r.Direction,
+			Started:   r.Time,
+		}
+		j.transfers[r.TransferID] = t
+		j.order = append(j.order, r.TransferID)
+	}
+	t.Stage = r.Stage
+	t.Updated = r.Time
+	if r.KeyIndices != nil {
+		t.KeyIndices = r.KeyIndices
+	}
+	if r.Phonons != nil {
+		t.Phonons = r.Phonons
+	}
+	if r.Packet != nil {
+		t.Packet = r.Packet
+	}
+	t.Note = r.Note
+	t.Err = r.Err
+}
+
+// append writes a record moving t to stage and syncs it to disk before applying it. Must be called with j.mtex held
+func (j *Journal) append(t *Transfer, stage Stage, packet []byte, note string, transferErr error) error {
+	r := Record{
+		TransferID: t.ID,
+		Time:       time.Now().UTC(),
+		CardID:     t.CardID,
+		Direction:  t.Direction,
+		Stage:      stage,
+		Packet:     packet,
+		Note:       note,
+	}
+	if t.Stage == "" {
+		r.KeyIndices = t.KeyIndices
+		r.Phonons = t.Phonons
+	}
+	if transferErr != nil {
+		r.Err = transferErr.Error()
+	}
+	if j.f != nil {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		_, err = j.f.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+		err = j.f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	if t.Stage == "" {
+		t.Started = r.Time
+		j.transfers[t.ID] = t
+		j.order = append(j.order, t.ID)
+	}
+	j.apply(r)
+	return nil
+}
+
+func newTransferID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+/*
+PrepareSend describes the phonons of the next outgoing transfer from cardID, so the journal records more than their
+key indices. It does not write anything; the transfer is recorded when the card is asked to send.
+*/
+func (j *Journal) PrepareSend(cardID string, phonons []PhononRef) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	j.prepared[cardID] = phonons
+}
+
+/*
+FinishSend records whether the counterparty accepted the transfer most recently sent from cardID and returns the
+transfer. ok is false if the send failed before the card was asked to release any phonons.
+*/
+func (j *Journal) FinishSend(cardID string, sendErr error) (transfer Transfer, ok bool) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	delete(j.prepared, cardID)
+	t, ok := j.inFlight[cardID]
+	if !ok {
+		return Transfer{}, false
+	}
+	delete(j.inFlight, cardID)
+	if t.Stage != StageSent {
+		return *t, true
+	}
+	var err error
+	if sendErr == nil {
+		err = j.append(t, StageDelivered, nil, "", nil)
+	} else {
+		err = j.append(t, StageUndelivered, nil, "the phonons left the card but the counterparty did not accept them", sendErr)
+	}
+	if err != nil {
+		log.Errorf("unable to journal outcome of transfer %s: %s", t.ID, err)
+	}
+	return *t, true
+}
+
+/*
+Holds returns the ID of a pending outgoing transfer from cardID that may still involve the phonon at keyIndex. The
+phonon's public key is compared when both it and the transfer's record of it are known.
+*/
+func (j *Journal) Holds(cardID string, keyIndex model.PhononKeyIndex, pubKey string) (transferID string, ok bool) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	for _, id := range j.order {
+		t := j.transfers[id]
+		if t.CardID != cardID || t.Direction != Outgoing || !t.Stage.pending() {
+			continue
+		}
+		for _, i := range t.KeyIndices {
+			if i != keyIndex {
+				continue
+			}
+			recorded := ""
+			for _, ref := range t.Phonons {
+				if ref.KeyIndex == keyIndex {
+					recorded = ref.PubKey
+				}
+			}
+			if recorded == "" || pubKey == "" || recorded == pubKey {
+				return t.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// beginOutgoing records that cardID is about to release the phonons described by refs at keyIndices
+func (j *Journal) beginOutgoing(cardID string, keyIndices []model.PhononKeyIndex, refs []PhononRef) (*Transfer, error) {
+	id, err := newTransferID()
+	if err != nil {
+		return nil, err
+	}
+	t := &Transfer{
+		ID:         id,
+		CardID:     cardID,
+		Direction:  Outgoing,
+		KeyIndices: keyIndices,
+		Phonons:    refs,
+	}
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	err = j.append(t, StagePrepared, nil, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	j.inFlight[cardID] = t
+	return t, nil
+}
+
+// preparedRef returns the description given by PrepareSend of the phonon at keyIndex on cardID
+func (j *Journal) preparedRef(cardID string, keyIndex model.PhononKeyIndex) (PhononRef, bool) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	for _, ref := range j.prepared[cardID] {
+		if ref.KeyIndex == keyIndex {
+			return ref, true
+		}
+	}
+	return PhononRef{}, false
+}
+
+// sent records the card's answer to an outgoing transfer
+func (j *Journal) sent(t *Transfer, packet []byte, sendErr error) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	var err error
+	if sendErr != nil {
+		err = j.append(t, StageAborted, nil, "", sendErr)
+	} else {
+		err = j.append(t, StageSent, packet, "", nil)
+	}
+	if err != nil {
+		log.Errorf("unable to journal transfer %s after the card released its phonons: %s", t.ID, err)
+	}
+}
+
+// beginIncoming records that cardID is about to be given packet
+func (j *Journal) beginIncoming(cardID string, packet []byte) (*Transfer, error) {
+	id, err := newTransferID()
+	if err != nil {
+		return nil, err
+	}
+	t := &Transfer{
+		ID:        id,
+		CardID:    cardID,
+		Direction: Incoming,
+	}
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	err = j.append(t, StageReceiving, packet, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (j *Journal) received(t *Transfer, receiveErr error) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	var err error
+	if receiveErr != nil {
+		err = j.append(t, StageRejected, nil, "", receiveErr)
+	} else {
+		err = j.append(t, StageReceived, nil, "", nil)
+	}
+	if err != nil {
+		log.Errorf("unable to journal outcome of incoming transfer %s: %s", t.ID, err)
+	}
+}
+
+// List returns the transfers in the order they started. Settled transfers are only included when all is true
+func (j *Journal) List(all bool) []Transfer {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	ret := []Transfer{}
+	for _, id := range j.order {
+		t := j.transfers[id]
+		if all || t.Stage.pending() {
+			ret = append(ret, *t)
+		}
+	}
+	return ret
+}
+
+// Resolve settles a pending transfer by hand, recording note as the reason
+func (j *Journal) Resolve(id string, note string) (Transfer, error) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	t, ok := j.transfers[id]
+	if !ok {
+		return Transfer{}, ErrTransferNotFound
+	}
+	if !t.Stage.pending() {
+		return Transfer{}, ErrTransferSettled
+	}
+	if j.inFlight[t.CardID] == t {
+		return Transfer{}, fmt.Errorf("transfer %s is still in progress", id)
+	}
+	err := j.append(t, StageResolved, nil, note, nil)
+	if err != nil {
+		return Transfer{}, err
+	}
+	return *t, nil
+}
+
+/*
+PhononLookup reports whether the card holds a phonon at keyIndex. pubKey is only needed, and only fetched, when
+wantPubKey is true.
+*/
+type PhononLookup func(keyIndex model.PhononKeyIndex, wantPubKey bool) (present bool, pubKey string, err error)
+
+/*
+Reconcile checks the pending transfers of cardID against the phonons on the card and settles those it can. A
+transfer whose phonons are all still on the card never happened. One whose phonons left the card cannot be settled
+here: the counterparty has to confirm it has them or the recorded packet has to be delivered again. Incoming
+transfers cannot be checked since their contents are only known to the card. Returns the transfers that still need
+attention.
+*/
+func (j *Journal) Reconcile(cardID string, lookup PhononLookup) ([]Transfer, error) {
+	j.mtex.Lock()
+	defer j.mtex.Unlock()
+	attention := []Transfer{}
+	for _, id := range j.order {
+		t := j.transfers[id]
+		if t.CardID != cardID || !t.Stage.pending() {
+			continue
+		}
+		// transfers still in progress in this process are not interrupted
+		if j.inFlight[cardID] == t {
+			continue
+		}
+		var note string
+		stage := StageAttention
+		switch t.Direction {
+		case Outgoing:
+			onCard, unknown, err := j.countOnCard(t, lookup)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case onCard == len(t.KeyIndices):
+				stage = StageResolved
+				note = "all phonons are still on the card, the transfer did not happen"
+			case unknown > 0:
+				note = fmt.Sprintf("%d of %d phonons were recorded without a public key, so whether the card still holds them cannot be told from their key indices. Check the card's phonons", unknown, len(t.KeyIndices))
+			case onCard > 0:
+				note = fmt.Sprintf("%d of %d phonons are still on the card", onCard, len(t.KeyIndices))
+			case t.Packet == nil:
+				note = "the phonons left the card before the transfer packet was recorded. Check with the counterparty"
+			default:
+				note = "the phonons left the card but the counterparty never confirmed receipt. Check with the counterparty; the recorded packet can be delivered again"
+			}
+		case Incoming:
+			note = "the card was given a transfer packet but did not confirm accepting it. Check the card's phonons; the recorded packet can be given to the card again"
+		}
+		if stage == t.Stage && note == t.Note {
+			attention = append(attention, *t)
+			continue
+		}
+		err := j.append(t, stage, nil, note, nil)
+		if err != nil {
+			return nil, err
+		}
+		if stage == StageAttention {
+			attention = append(attention, *t)
+		}
+	}
+	return attention, nil
+}
+
+/*
+countOnCard returns how many of the phonons of outgoing transfer t are still on the card, matched on their public
+keys, and how many have a phonon at their key index but no recorded public key to tell whether it is the one sent.
+*/
+func (j *Journal) countOnCard(t *Transfer, lookup PhononLookup) (onCard int, unknown int, err error) {
+	for _, keyIndex := range t.KeyIndices {
+		var wantPubKey string
+		for _, ref := range t.Phonons {
+			if ref.KeyIndex == keyIndex {
+				wantPubKey = ref.PubKey
+			}
+		}
+		present, pubKey, err := lookup(keyIndex, wantPubKey != "")
+		if err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case !present:
+		case wantPubKey == "":
+			unknown += 1
+		case pubKey == wantPubKey:
+			onCard += 1
+		}
+	}
+	return onCard, unknown, nil
+}
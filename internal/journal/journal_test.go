@@ -0,0 +1,193 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// sendingCard releases phonons by destroying them, standing in for a card paired to a counterparty
+type sendingCard struct {
+	*mock.MockCard
+}
+
+func (c *sendingCard) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	for _, k := range keyIndices {
+		_, err := c.DestroyPhonon(k)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte("packet"), nil
+}
+
+func newUnlockedMock(t *testing.T) *mock.MockCard {
+	t.Helper()
+	c, err := mock.NewMockCard(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := c.(*mock.MockCard)
+	err = m.VerifyPIN("111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSendReadsPubKeysFromCard(t *testing.T) {
+	m := newUnlockedMock(t)
+	keyIndex, pubKey, err := m.CreatePhonon(model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := Open(filepath.Join(t.TempDir(), "transfers.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	cardID := fmt.Sprintf("%x", ethcrypto.FromECDSAPub(m.IdentityPubKey))[:16]
+	c := j.Card(&sendingCard{m}, cardID)
+
+	// the caller only gave the key index
+	j.PrepareSend(cardID, PhononRefs([]model.Phonon{{KeyIndex: keyIndex}}))
+	_, err = c.SendPhonons([]model.PhononKeyIndex{keyIndex}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, ok := j.FinishSend(cardID, errors.New("counterparty went away"))
+	if !ok {
+		t.Fatal("send was not journaled")
+	}
+	if transfer.Stage != StageUndelivered {
+		t.Errorf("expected stage %s, got %s", StageUndelivered, transfer.Stage)
+	}
+	if len(transfer.Phonons) != 1 || transfer.Phonons[0].PubKey != pubKey.String() {
+		t.Fatalf("expected the public key read from the card, got %+v", transfer.Phonons)
+	}
+	if string(transfer.Packet) != "packet" {
+		t.Errorf("packet not recorded")
+	}
+}
+
+func TestSendRefusedWithoutPubKey(t *testing.T) {
+	m := newUnlockedMock(t)
+	j, _ := Open("")
+	c := j.Card(&sendingCard{m}, "card")
+	// nothing at the key index, so neither a description nor a public key can be found
+	_, err := c.SendPhonons([]model.PhononKeyIndex{3}, false)
+	if err == nil {
+		t.Fatal("send of an unknown phonon was journaled")
+	}
+	if len(j.List(true)) != 0 {
+		t.Error("refused send was recorded")
+	}
+}
+
+// writeRecords writes an outgoing transfer in stage prepared for each set of refs, as a crash would leave it
+func writeRecords(t *testing.T, path string, refs ...[]PhononRef) []string {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ids []string
+	for i, phonons := range refs {
+		r := Record{
+			TransferID: fmt.Sprintf("transfer%d", i),
+			Time:       time.Now().UTC(),
+			CardID:     "card",
+			Direction:  Outgoing,
+			Stage:      StagePrepared,
+			Phonons:    phonons,
+		}
+		for _, p := range phonons {
+			r.KeyIndices = append(r.KeyIndices, p.KeyIndex)
+		}
+		data, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(append(data, '\n'))
+		ids = append(ids, r.TransferID)
+	}
+	// a record cut short by a crash
+	f.WriteString(`{"TransferID":"trunc`)
+	return ids
+}
+
+func TestReconcileMatchesPubKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transfers.jsonl")
+	ids := writeRecords(t, path,
+		[]PhononRef{{KeyIndex: 1, PubKey: "aa"}},
+		[]PhononRef{{KeyIndex: 2, PubKey: "bb"}},
+		[]PhononRef{{KeyIndex: 3}},
+	)
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if n := len(j.List(false)); n != 3 {
+		t.Fatalf("expected 3 pending transfers, got %d", n)
+	}
+	// key index 1 now holds another phonon, 2 still holds the one sent, 3 holds one of unknown origin
+	onCard := map[model.PhononKeyIndex]string{1: "cc", 2: "bb", 3: "dd"}
+	lookup := func(keyIndex model.PhononKeyIndex, wantPubKey bool) (bool, string, error) {
+		pubKey, ok := onCard[keyIndex]
+		if !wantPubKey {
+			pubKey = ""
+		}
+		return ok, pubKey, nil
+	}
+	attention, err := j.Reconcile("card", lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stages := make(map[string]Transfer)
+	for _, tr := range j.List(true) {
+		stages[tr.ID] = tr
+	}
+	if stages[ids[0]].Stage != StageAttention {
+		t.Errorf("a reused key index was taken for the phonon sent: %s", stages[ids[0]].Stage)
+	}
+	if stages[ids[1]].Stage != StageResolved {
+		t.Errorf("a phonon still on the card should resolve its transfer: %s", stages[ids[1]].Stage)
+	}
+	if tr := stages[ids[2]]; tr.Stage != StageAttention || !strings.Contains(tr.Note, "without a public key") {
+		t.Errorf("a phonon without a public key was resolved on its key index: %s %q", tr.Stage, tr.Note)
+	}
+	if len(attention) != 2 {
+		t.Errorf("expected 2 transfers needing attention, got %d", len(attention))
+	}
+
+	// settled stages survive a restart
+	j.Close()
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range j.List(true) {
+		if tr.Stage != stages[tr.ID].Stage {
+			t.Errorf("transfer %s reopened in stage %s, was %s", tr.ID, tr.Stage, stages[tr.ID].Stage)
+		}
+	}
+	_, err = j.Resolve(ids[0], "checked with the counterparty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = j.Resolve(ids[0], "again")
+	if !errors.Is(err, ErrTransferSettled) {
+		t.Errorf("expected ErrTransferSettled, got %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+/*
+Package keycache remembers the public keys of the phonons on each card, so listing phonons does not read every key
+from the card one command at a time. Entries are kept per card ID in a JSON file and dropped whenever a card command
+may have put a different phonon at their key index. The card may have been used by another client since the file
+was written, so an entry read from disk is only trusted once the card has given the same key again, or has listed
+the phonon at its key index with the curve and descriptor the entry recorded.
+*/
+package keycache
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// entry is what is known about the phonon at one key index
+type entry struct {
+	PubKey    string
+	CurveType model.CurveType
+	// the descriptor last listed for the phonon, compared with later listings to notice a replaced phonon. Empty
+	// until the phonon has been listed
+	Listed       bool               `json:",omitempty"`
+	CurrencyType model.CurrencyType `json:",omitempty"`
+	Denomination string             `json:",omitempty"`
+	// whether the card gave this key, or listed its phonon as recorded, since the cache was opened. Entries loaded
+	// from disk are read from the card again on first use until then
+	verified bool
+}
+
+type Cache struct {
+	dir   string
+	mtex  sync.Mutex
+	cards map[string]map[model.PhononKeyIndex]entry
+}
+
+// Open returns the cache kept in dir, creating dir if needed. An empty dir keeps the cache in memory only
+func Open(dir string) (*Cache, error) {
+	c := &Cache{
+		dir:   dir,
+		cards: make(map[string]map[model.PhononKeyIndex]entry),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// entries returns the entries of cardID, loading them from disk the first time. Must be called with c.mtex held
+func (c *Cache) entries(cardID string) map[model.PhononKeyIndex]entry {
+	if e, ok := c.cards[cardID]; ok {
+		return e
+	}
+	e := make(map[model.PhononKeyIndex]entry)
+	c.cards[cardID] = e
+	if c.dir == "" {
+		return e
+	}
+	data, err := os.ReadFile(c.path(cardID))
+	if os.IsNotExist(err) {
+		return e
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &e)
+	}
+	if err != nil {
+		log.Errorf("ignoring unreadable public key cache of card %s: %s", cardID, err)
+		e = make(map[model.PhononKeyIndex]entry)
+		c.cards[cardID] = e
+	}
+	return e
+}
+
+// save writes the entries of cardID to disk. Must be called with c.mtex held
+func (c *Cache) save(cardID string) {
+	if c.dir == "" {
+		return
+	}
+	err := persist.WriteJSON(c.path(cardID), c.cards[cardID])
+	if err != nil {
+		log.Errorf("unable to persist public key cache of card %s: %s", cardID, err)
+	}
+}
+
+func (c *Cache) path(cardID string) string {
+	return filepath.Join(c.dir, cardID+".json")
+}
+
+func (c *Cache) get(cardID string, keyIndex model.PhononKeyIndex, crv model.CurveType) (model.PhononPubKey, bool) {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	e, ok := c.entries(cardID)[keyIndex]
+	if !ok || !e.verified || e.CurveType != crv {
+		return nil, false
+	}
+	keyBytes, err := hex.DecodeString(e.PubKey)
+	if err != nil {
+		return nil, false
+	}
+	pubKey, err := model.NewPhononPubKey(keyBytes, crv)
+	if err != nil {
+		return nil, false
+	}
+	return pubKey, true
+}
+
+func (c *Cache) put(cardID string, keyIndex model.PhononKeyIndex, pubKey model.PhononPubKey, crv model.CurveType) {
+	if pubKey == nil {
+		return
+	}
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	entries := c.entries(cardID)
+	e := entries[keyIndex]
+	changed := e.PubKey != pubKey.String() || e.CurveType != crv
+	if changed {
+		// a different key means a different phonon, whose descriptor has not been listed yet
+		e = entry{}
+	}
+	e.PubKey = pubKey.String()
+	e.CurveType = crv
+	e.verified = true
+	entries[keyIndex] = e
+	if changed {
+		c.save(cardID)
+	}
+}
+
+// invalidate drops the entries of keyIndices, or of the whole card when none are given
+func (c *Cache) invalidate(cardID string, keyIndices ...model.PhononKeyIndex) {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	entries := c.entries(cardID)
+	if len(keyIndices) == 0 {
+		for k := range entries {
+			delete(entries, k)
+		}
+	}
+	for _, k := range keyIndices {
+		delete(entries, k)
+	}
+	c.save(cardID)
+}
+
+/*
+listed checks cached entries against phonons the card listed. An entry whose phonon now has another curve or
+descriptor belongs to a phonon that has been replaced, by this client or any other, and is dropped. An entry loaded
+from disk whose recorded descriptor the card lists unchanged is trusted from then on. When the listing covered the
+whole card, entries for key indices missing from it are dropped too.
+*/
+func (c *Cache) listed(cardID string, phonons []*model.Phonon, complete bool) {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	entries := c.entries(cardID)
+	present := make(map[model.PhononKeyIndex]bool, len(phonons))
+	for _, p := range phonons {
+		present[p.KeyIndex] = true
+		e, ok := entries[p.KeyIndex]
+		if !ok {
+			continue
+		}
+		denomination := p.Denomination.String()
+		if e.CurveType != p.CurveType || (e.Listed && (e.CurrencyType != p.CurrencyType || e.Denomination != denomination)) {
+			delete(entries, p.KeyIndex)
+			continue
+		}
+		if !e.verified {
+			// recording a descriptor for a key the card has not given this session would vouch for it next time
+			if e.Listed {
+				e.verified = true
+				entries[p.KeyIndex] = e
+			}
+			continue
+		}
+		e.Listed = true
+		e.CurrencyType = p.CurrencyType
+		e.Denomination = denomination
+		entries[p.KeyIndex] = e
+	}
+	if complete {
+		for k := range entries {
+			if !present[k] {
+				delete(entries, k)
+			}
+		}
+	}
+	c.save(cardID)
+}
+
+// described records the descriptor this client set, so the next listing does not mistake it for a replaced phonon
+func (c *Cache) described(cardID string, p *model.Phonon) {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	entries := c.entries(cardID)
+	e, ok := entries[p.KeyIndex]
+	if !ok {
+		return
+	}
+	e.Listed = true
+	e.CurrencyType = p.CurrencyType
+	e.Denomination = p.Denomination.String()
+	entries[p.KeyIndex] = e
+	c.save(cardID)
+}
+
+// card serves GetPhononPubKey from the cache and keeps the cache in step with the commands that change phonons
+type card struct {
+	model.PhononCard
+	c      *Cache
+	cardID string
+}
+
+// Card wraps the PhononCard identified as cardID so its phonons' public keys are cached
+func (c *Cache) Card(pc model.PhononCard, cardID string) model.PhononCard {
+	return &card{PhononCard: pc, c: c, cardID: cardID}
+}
+
+func (cc *card) GetPhononPubKey(keyIndex model.PhononKeyIndex, crv model.CurveType) (model.PhononPubKey, error) {
+	if pubKey, ok := cc.c.get(cc.cardID, keyIndex, crv); ok {
+		return pubKey, nil
+	}
+	pubKey, err := cc.PhononCard.GetPhononPubKey(keyIndex, crv)
+	if err == nil {
+		cc.c.put(cc.cardID, keyIndex, pubKey, crv)
+	}
+	return pubKey, err
+}
+
+func (cc *card) ListPhonons(currencyType model.CurrencyType, lessThanValue uint64, greaterThanValue uint64, continuation bool) ([]*model.Phonon, error) {
+	phonons, err := cc.PhononCard.ListPhonons(currencyType, lessThanValue, greaterThanValue, continuation)
+	if err == nil {
+		complete := currencyType == 0 && lessThanValue == 0 && greaterThanValue == 0 && !continuation
+		cc.c.listed(cc.cardID, phonons, complete)
+	}
+	return phonons, err
+}
+
+func (cc *card) CreatePhonon(curveType model.CurveType) (model.PhononKeyIndex, model.PhononPubKey, error) {
+	keyIndex, pubKey, err := cc.PhononCard.CreatePhonon(curveType)
+	if err == nil {
+		cc.c.invalidate(cc.cardID, keyIndex)
+		cc.c.put(cc.cardID, keyIndex, pubKey, curveType)
+	}
+	return keyIndex, pubKey, err
+}
+
+func (cc *card) SetDescriptor(phonon *model.Phonon) error {
+	err := cc.PhononCard.SetDescriptor(phonon)
+	if err == nil {
+		cc.c.described(cc.cardID, phonon)
+	}
+	return err
+}
+
+func (cc *card) MineNativePhonon(difficulty uint8) (model.PhononKeyIndex, []byte, error) {
+	keyIndex, hash, err := cc.PhononCard.MineNativePhonon(difficulty)
+	if err == nil {
+		cc.c.invalidate(cc.cardID, keyIndex)
+	}
+	return keyIndex, hash, err
+}
+
+func (cc *card) DestroyPhonon(keyIndex model.PhononKeyIndex) (*ecdsa.PrivateKey, error) {
+	// dropped whatever the outcome, since a failed command may still have reached the card
+	cc.c.invalidate(cc.cardID, keyIndex)
+	return cc.PhononCard.DestroyPhonon(keyIndex)
+}
+
+func (cc *card) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	if len(keyIndices) > 0 {
+		cc.c.invalidate(cc.cardID, keyIndices...)
+	}
+	return cc.PhononCard.SendPhonons(keyIndices, extendedRequest)
+}
+
+func (cc *card) ReceivePhonons(phononTransfer []byte) error {
+	// received phonons land on key indices that are not known until the card is listed again
+	defer cc.c.invalidate(cc.cardID)
+	return cc.PhononCard.ReceivePhonons(phononTransfer)
+}
+
+func (cc *card) Init(pin string) error {
+	defer cc.c.invalidate(cc.cardID)
+	return cc.PhononCard.Init(pin)
+}
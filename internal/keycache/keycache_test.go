@@ -0,0 +1,185 @@
+package keycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// countingCard counts the public keys read from the card
+type countingCard struct {
+	*mock.MockCard
+	reads int
+}
+
+func (c *countingCard) GetPhononPubKey(keyIndex model.PhononKeyIndex, crv model.CurveType) (model.PhononPubKey, error) {
+	c.reads += 1
+	return c.MockCard.GetPhononPubKey(keyIndex, crv)
+}
+
+func newCard(t *testing.T) *countingCard {
+	t.Helper()
+	c, err := mock.NewMockCard(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := c.(*mock.MockCard)
+	err = m.VerifyPIN("111111")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingCard{MockCard: m}
+}
+
+func cardID(m *mock.MockCard) string {
+	return fmt.Sprintf("%x", ethcrypto.FromECDSAPub(m.IdentityPubKey))[:16]
+}
+
+func TestCachedWithinSession(t *testing.T) {
+	cc := newCard(t)
+	cache, _ := Open("")
+	card := cache.Card(cc, cardID(cc.MockCard))
+	keyIndex, pubKey, err := card.CreatePhonon(model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := card.GetPhononPubKey(keyIndex, model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != pubKey.String() || cc.reads != 0 {
+		t.Errorf("key of a phonon created this session should come from the cache, read %d times", cc.reads)
+	}
+	_, err = card.DestroyPhonon(keyIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = card.GetPhononPubKey(keyIndex, model.Secp256k1)
+	if err == nil {
+		t.Error("key of a destroyed phonon served from the cache")
+	}
+}
+
+func TestDiskEntriesRevalidated(t *testing.T) {
+	dir := t.TempDir()
+	cc := newCard(t)
+	cache, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := cache.Card(cc, cardID(cc.MockCard))
+	first, firstKey, err := card.CreatePhonon(model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, secondKey, err := card.CreatePhonon(model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another client replaced the phonon at the second key index while this one was not running
+	path := filepath.Join(dir, cardID(cc.MockCard)+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries map[model.PhononKeyIndex]entry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := entries[second]
+	stale.PubKey = firstKey.String()
+	entries[second] = stale
+	data, _ = json.Marshal(entries)
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card = cache.Card(cc, cardID(cc.MockCard))
+	cc.reads = 0
+	for i := 0; i < 2; i++ {
+		got, err := card.GetPhononPubKey(first, model.Secp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != firstKey.String() {
+			t.Errorf("wrong key for the first phonon")
+		}
+		got, err = card.GetPhononPubKey(second, model.Secp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != secondKey.String() {
+			t.Errorf("stale key from disk served for the second phonon")
+		}
+	}
+	if cc.reads != 2 {
+		t.Errorf("expected each key read from the card once after reopening, got %d reads", cc.reads)
+	}
+}
+
+func TestDiskEntriesTrustedOnceListed(t *testing.T) {
+	dir := t.TempDir()
+	cc := newCard(t)
+	cache, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := cache.Card(cc, cardID(cc.MockCard))
+	keys := make(map[model.PhononKeyIndex]string)
+	for i := int64(1); i <= 2; i++ {
+		keyIndex, pubKey, err := card.CreatePhonon(model.Secp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		den, _ := model.NewDenomination(big.NewInt(i * 100))
+		err = card.SetDescriptor(&model.Phonon{KeyIndex: keyIndex, CurrencyType: model.Ethereum, Denomination: den})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[keyIndex] = pubKey.String()
+	}
+
+	// another client set a new descriptor on the second phonon while this one was not running
+	den, _ := model.NewDenomination(big.NewInt(5))
+	err = cc.MockCard.SetDescriptor(&model.Phonon{KeyIndex: 1, CurrencyType: model.Bitcoin, Denomination: den})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	card = cache.Card(cc, cardID(cc.MockCard))
+	_, err = card.ListPhonons(0, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc.reads = 0
+	for keyIndex, pubKey := range keys {
+		got, err := card.GetPhononPubKey(keyIndex, model.Secp256k1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != pubKey {
+			t.Errorf("wrong key for key index %d", keyIndex)
+		}
+	}
+	if cc.reads != 1 {
+		t.Errorf("expected only the key of the phonon listed with another descriptor to be read from the card, got %d reads", cc.reads)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Package keyexport encodes the private key of an exported phonon so it does not have to be handled as bare hex: as an
+Ethereum keystore V3 file, as a Bitcoin WIF key, or as a blob encrypted with a passphrase.
+*/
+package keyexport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/GridPlus/phonon-client/internal/base58"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/scrypt"
+)
+
+type Format string
+
+const (
+	// the private key as bare hex, as exports have always returned it
+	FormatHex = Format("hex")
+	// Ethereum keystore V3 JSON, encrypted with the passphrase
+	FormatKeystore = Format("keystore")
+	// Bitcoin wallet import format. Not encrypted
+	FormatWIF = Format("wif")
+	// the key encrypted with the passphrase, see Blob
+	FormatEncrypted = Format("encrypted")
+)
+
+// MinPassphraseLength is the shortest passphrase accepted for the encrypted formats
+const MinPassphraseLength = 8
+
+var (
+	ErrUnknownFormat      = errors.New("unknown export format, use hex, keystore, wif or encrypted")
+	ErrPassphraseRequired = fmt.Errorf("the keystore and encrypted formats need a passphrase of at least %d characters", MinPassphraseLength)
+	ErrUnknownNetwork     = errors.New("unknown network, use mainnet or testnet")
+	ErrWrongPassphrase    = errors.New("wrong passphrase or corrupted blob")
+)
+
+// Options choose how a key is exported
+type Options struct {
+	Format     Format
+	Passphrase string
+	// Bitcoin network of a WIF key, mainnet or testnet. Defaults to mainnet
+	Network string
+	// whether a WIF key is marked for a compressed public key. Defaults to true
+	Uncompressed bool
+}
+
+// Check validates opts, so an export can be refused before the phonon is destroyed
+func (opts Options) Check() error {
+	switch opts.Format {
+	case "", FormatHex:
+	case FormatKeystore, FormatEncrypted:
+		if len(opts.Passphrase) < MinPassphraseLength {
+			return ErrPassphraseRequired
+		}
+	case FormatWIF:
+		if _, err := wifVersion(opts.Network); err != nil {
+			return err
+		}
+	default:
+		return ErrUnknownFormat
+	}
+	return nil
+}
+
+func wifVersion(network string) (byte, error) {
+	switch network {
+	case "", "mainnet":
+		return 0x80, nil
+	case "testnet":
+		return 0xef, nil
+	}
+	return 0, ErrUnknownNetwork
+}
+
+// Export encodes key as opts ask. The result is a string for hex and WIF keys, and a JSON object otherwise
+func Export(key *ecdsa.PrivateKey, opts Options) (interface{}, error) {
+	err := opts.Check()
+	if err != nil {
+		return nil, err
+	}
+	switch opts.Format {
+	case FormatKeystore:
+		id, err := uuid.NewRandom()
+		if err != nil {
+			return nil, err
+		}
+		data, err := keystore.EncryptKey(&keystore.Key{
+			Id:         id,
+			Address:    ethcrypto.PubkeyToAddress(key.PublicKey),
+			PrivateKey: key,
+		}, opts.Passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(data), nil
+	case FormatWIF:
+		version, _ := wifVersion(opts.Network)
+		payload := ethcrypto.FromECDSA(key)
+		if !opts.Uncompressed {
+			payload = append(payload, 0x01)
+		}
+		return base58.CheckEncode(payload, version), nil
+	case FormatEncrypted:
+		return Encrypt(ethcrypto.FromECDSA(key), opts.Passphrase)
+	}
+	// padded to 32 bytes, as a key with leading zero bytes must still be written in full
+	return hex.EncodeToString(ethcrypto.FromECDSA(key)), nil
+}
+
+// scrypt parameters of blobs, the same as Ethereum keystores use
+const (
+	scryptN      = keystore.StandardScryptN
+	scryptR      = 8
+	scryptP      = keystore.StandardScryptP
+	scryptKeyLen = 32
+)
+
+/*
+Blob is a secret encrypted with AES-256-GCM under a key derived from a passphrase with scrypt. All byte fields are
+hex encoded.
+*/
+type Blob struct {
+	Version    int
+	KDF        string
+	N          int
+	R          int
+	P          int
+	Salt       string
+	Cipher     string
+	Nonce      string
+	Ciphertext string
+}
+
+func Encrypt(secret []byte, passphrase string) (*Blob, error) {
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := blobCipher(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{
+		Version:    1,
+		KDF:        "scrypt",
+		N:          scryptN,
+		R:          scryptR,
+		P:          scryptP,
+		Salt:       hex.EncodeToString(salt),
+		Cipher:     "aes-256-gcm",
+		Nonce:      hex.EncodeToString(nonce),
+		Ciphertext: hex.EncodeToString(aead.Seal(nil, nonce, secret, nil)),
+	}, nil
+}
+
+// Decrypt recovers the secret of a blob made by Encrypt
+func Decrypt(b *Blob, passphrase string) ([]byte, error) {
+	if b.Version != 1 || b.KDF != "scrypt" || b.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("unsupported blob: version %d, kdf %q, cipher %q", b.Version, b.KDF, b.Cipher)
+	}
+	salt, err := hex.DecodeString(b.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hex.DecodeString(b.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := hex.DecodeString(b.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := blobCipher(passphrase, salt, b.N, b.R, b.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	secret, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return secret, nil
+}
+
+func blobCipher(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,119 @@
+package keyexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+const testPassphrase = "correct horse"
+
+func TestHexPadded(t *testing.T) {
+	// a key whose first byte is zero
+	key, err := ethcrypto.HexToECDSA("00f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Export(key, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "00f1a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f" {
+		t.Errorf("hex key not padded to 32 bytes: %s", got)
+	}
+}
+
+func TestWIF(t *testing.T) {
+	key, err := ethcrypto.HexToECDSA("0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		opts Options
+		want string
+	}{
+		{Options{Format: FormatWIF}, "KwdMAjGmerYanjeui5SHS7JkmpZvVipYvB2LJGU1ZxJwYvP98617"},
+		{Options{Format: FormatWIF, Uncompressed: true}, "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ"},
+		{Options{Format: FormatWIF, Network: "testnet"}, "cMzLdeGd5vEqxB8B6VFQoRopQ3sLAAvEzDAoQgvX54xwofSWj1fx"},
+	} {
+		got, err := Export(key, v.opts)
+		if err != nil || got != v.want {
+			t.Errorf("Export(%+v) = %v, %v, want %s", v.opts, got, err, v.want)
+		}
+	}
+}
+
+func TestOptionsChecked(t *testing.T) {
+	for opts, want := range map[Options]error{
+		{Format: "pem"}: ErrUnknownFormat,
+		{Format: FormatKeystore, Passphrase: "short"}: ErrPassphraseRequired,
+		{Format: FormatEncrypted}:                     ErrPassphraseRequired,
+		{Format: FormatWIF, Network: "regtest"}:       ErrUnknownNetwork,
+	} {
+		if err := opts.Check(); !errors.Is(err, want) {
+			t.Errorf("%+v: expected %v, got %v", opts, want, err)
+		}
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := Export(key, Options{Format: FormatEncrypted, Passphrase: testPassphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the blob as a client receives it
+	data, err := json.Marshal(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blob Blob
+	err = json.Unmarshal(data, &blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := Decrypt(&blob, testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, ethcrypto.FromECDSA(key)) {
+		t.Error("decrypted secret differs from the key")
+	}
+	_, err = Decrypt(&blob, "wrong passphrase")
+	if !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("expected ErrWrongPassphrase, got %v", err)
+	}
+	blob.Cipher = "aes-128-cbc"
+	_, err = Decrypt(&blob, testPassphrase)
+	if err == nil {
+		t.Error("expected an unsupported cipher to be refused")
+	}
+}
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := Export(key, Options{Format: FormatKeystore, Passphrase: testPassphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := keystore.DecryptKey(exported.(json.RawMessage), testPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ethcrypto.FromECDSA(decrypted.PrivateKey), ethcrypto.FromECDSA(key)) {
+		t.Error("keystore holds a different key")
+	}
+	if decrypted.Address != ethcrypto.PubkeyToAddress(key.PublicKey) {
+		t.Errorf("keystore address %s does not match the key", decrypted.Address.Hex())
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Package labels keeps notes about phonons that the card has no room for: a label, tags, a free-form note and where
+the phonon came from. Labels are keyed by card ID and phonon public key rather than key index, since key indices are
+reused once a phonon leaves the card, and follow a phonon to another card when this client sees the transfer.
+*/
+package labels
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+)
+
+var ErrNotFound = errors.New("phonon has no label")
+
+type Label struct {
+	Label string   `json:",omitempty"`
+	Tags  []string `json:",omitempty"`
+	Note  string   `json:",omitempty"`
+	// where the phonon came from, e.g. "mined" or "received from 04a1b2c3d4e5f607"
+	Origin  string `json:",omitempty"`
+	Updated time.Time
+}
+
+func (l Label) empty() bool {
+	return l.Label == "" && len(l.Tags) == 0 && l.Note == "" && l.Origin == ""
+}
+
+func (l Label) HasTag(tag string) bool {
+	for _, t := range l.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Entry is the label of one phonon
+type Entry struct {
+	CardID string
+	PubKey string
+	Label
+}
+
+type Store struct {
+	path string
+	mtex sync.Mutex
+	// by card ID, then public key
+	labels map[string]map[string]Label
+}
+
+// Open reads the labels kept at path, creating the file on first save. An empty path keeps labels in memory only
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, labels: make(map[string]map[string]Label)}
+	if path == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.labels)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read phonon labels: %w", err)
+	}
+	return s, nil
+}
+
+// save writes the labels to disk. Must be called with s.mtex held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return persist.WriteJSON(s.path, s.labels)
+}
+
+// card IDs and public keys are compared as lower case hex
+func normalize(cardID, pubKey string) (string, string) {
+	return strings.ToLower(cardID), strings.ToLower(strings.TrimPrefix(pubKey, "0x"))
+}
+
+// cleanTags trims tags and drops empty and repeated ones
+func cleanTags(tags []string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[strings.ToLower(t)] {
+			continue
+		}
+		seen[strings.ToLower(t)] = true
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+func (s *Store) Get(cardID, pubKey string) (Label, bool) {
+	cardID, pubKey = normalize(cardID, pubKey)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	l, ok := s.labels[cardID][pubKey]
+	return l, ok
+}
+
+// Set replaces the label of a phonon. An empty label removes it
+func (s *Store) Set(cardID, pubKey string, l Label) (Label, error) {
+	cardID, pubKey = normalize(cardID, pubKey)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	l.Tags = cleanTags(l.Tags)
+	l.Updated = time.Now().UTC()
+	if l.empty() {
+		delete(s.labels[cardID], pubKey)
+		return l, s.save()
+	}
+	if s.labels[cardID] == nil {
+		s.labels[cardID] = make(map[string]Label)
+	}
+	s.labels[cardID][pubKey] = l
+	return l, s.save()
+}
+
+func (s *Store) Delete(cardID, pubKey string) error {
+	cardID, pubKey = normalize(cardID, pubKey)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	if _, ok := s.labels[cardID][pubKey]; !ok {
+		return ErrNotFound
+	}
+	delete(s.labels[cardID], pubKey)
+	if len(s.labels[cardID]) == 0 {
+		delete(s.labels, cardID)
+	}
+	return s.save()
+}
+
+// List returns the labels of cardID, or of every card when it is empty, optionally only those tagged tag
+func (s *Store) List(cardID, tag string) []Entry {
+	cardID, _ = normalize(cardID, "")
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	ret := []Entry{}
+	for c, byKey := range s.labels {
+		if cardID != "" && c != cardID {
+			continue
+		}
+		for pubKey, l := range byKey {
+			if tag == "" || l.HasTag(tag) {
+				ret = append(ret, Entry{CardID: c, PubKey: pubKey, Label: l})
+			}
+		}
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		if ret[a].CardID != ret[b].CardID {
+			return ret[a].CardID < ret[b].CardID
+		}
+		return ret[a].PubKey < ret[b].PubKey
+	})
+	return ret
+}
+
+/*
+Move carries the label of a phonon sent from one card to another. The phonon keeps its public key, so the label is
+filed under the receiving card with the origin set to the sending card, unless an origin was already recorded.
+*/
+func (s *Store) Move(fromCardID, toCardID, pubKey string) error {
+	fromCardID, pubKey = normalize(fromCardID, pubKey)
+	toCardID, _ = normalize(toCardID, "")
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	l := s.labels[fromCardID][pubKey]
+	delete(s.labels[fromCardID], pubKey)
+	if len(s.labels[fromCardID]) == 0 {
+		delete(s.labels, fromCardID)
+	}
+	if l.Origin == "" {
+		l.Origin = "received from " + fromCardID
+	}
+	l.Updated = time.Now().UTC()
+	if s.labels[toCardID] == nil {
+		s.labels[toCardID] = make(map[string]Label)
+	}
+	s.labels[toCardID][pubKey] = l
+	return s.save()
+}
+
+// SetOrigin records where a phonon came from, keeping the rest of its label
+func (s *Store) SetOrigin(cardID, pubKey, origin string) error {
+	cardID, pubKey = normalize(cardID, pubKey)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	if s.labels[cardID] == nil {
+		s.labels[cardID] = make(map[string]Label)
+	}
+	l := s.labels[cardID][pubKey]
+	l.Origin = origin
+	l.Updated = time.Now().UTC()
+	s.labels[cardID][pubKey] = l
+	return s.save()
+}
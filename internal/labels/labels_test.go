@@ -0,0 +1,63 @@
+package labels
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLabelFollowsPhonon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Set("SENDER", "0xABCD", Label{Label: "rent", Tags: []string{"bills", " ", "Bills"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the receiving card records the phonon before the send is seen to complete
+	err = s.SetOrigin("receiver", "abcd", "received")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Move("sender", "receiver", "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Get("sender", "abcd"); ok {
+		t.Error("label left on the sending card")
+	}
+	l, ok := s.Get("Receiver", "0xabcd")
+	if !ok {
+		t.Fatal("label not moved to the receiving card")
+	}
+	if l.Label != "rent" || len(l.Tags) != 1 || l.Origin != "received from sender" {
+		t.Errorf("unexpected moved label %+v", l)
+	}
+	if got := s.List("", "BILLS"); len(got) != 1 || got[0].CardID != "receiver" {
+		t.Errorf("expected the moved label tagged bills, got %+v", got)
+	}
+}
+
+func TestSetOriginKeepsLabel(t *testing.T) {
+	s, _ := Open("")
+	s.Set("card", "01", Label{Note: "kept"})
+	err := s.SetOrigin("card", "01", "mined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := s.Get("card", "01")
+	if l.Note != "kept" || l.Origin != "mined" {
+		t.Errorf("unexpected label %+v", l)
+	}
+	// clearing everything removes the label
+	s.Set("card", "01", Label{})
+	if err := s.Delete("card", "01"); err != ErrNotFound {
+		t.Errorf("expected an empty label to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Package onchain talks to EVM chains through JSON-RPC endpoints configured per chain in phonon.yml. It reads the
+confirmed balance of a phonon's address, sweeps the balance of a redeemed phonon's address to the redeem address and
+follows the transaction until it has enough confirmations. Chains without an endpoint are left to the card's own
+chain service.
+*/
+package onchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// DefaultConfirmations is how many blocks must include or follow a transaction before it counts as confirmed
+const DefaultConfirmations = 12
+
+var ErrNoEndpoint = errors.New("no RPC endpoint configured for chain")
+
+// Endpoint is the JSON-RPC endpoint of one chain
+type Endpoint struct {
+	ChainID int
+	URL     string
+	// confirmations a transaction needs. Defaults to DefaultConfirmations
+	Confirmations int
+}
+
+/*
+Backend is the subset of an Ethereum client the package uses. It is satisfied by ethclient.Client and by
+go-ethereum's simulated backend, so the package can be exercised without a node.
+*/
+type Backend interface {
+	PendingNonceAt(ctx context.Context, account common.Address) (uint64, error)
+	BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (*big.Int, error)
+	SuggestGasPrice(ctx context.Context) (*big.Int, error)
+	SendTransaction(ctx context.Context, tx *types.Transaction) error
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+type chain struct {
+	endpoint Endpoint
+	backend  Backend
+}
+
+// Chains holds a backend for each chain with an endpoint, dialling it on first use
+type Chains struct {
+	mtex   sync.Mutex
+	chains map[int]*chain
+}
+
+// New checks endpoints and returns Chains for them. Nothing is dialled until a chain is used
+func New(endpoints []Endpoint) (*Chains, error) {
+	c := &Chains{chains: make(map[int]*chain)}
+	for _, e := range endpoints {
+		if e.URL == "" {
+			return nil, fmt.Errorf("RPC endpoint for chain %d has no URL", e.ChainID)
+		}
+		if _, ok := c.chains[e.ChainID]; ok {
+			return nil, fmt.Errorf("chain %d has more than one RPC endpoint", e.ChainID)
+		}
+		if e.Confirmations <= 0 {
+			e.Confirmations = DefaultConfirmations
+		}
+		c.chains[e.ChainID] = &chain{endpoint: e}
+	}
+	return c, nil
+}
+
+// Register uses backend for chainID in place of dialling an endpoint
+func (c *Chains) Register(chainID int, backend Backend, confirmations int) {
+	if confirmations <= 0 {
+		confirmations = DefaultConfirmations
+	}
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	c.chains[chainID] = &chain{
+		endpoint: Endpoint{ChainID: chainID, Confirmations: confirmations},
+		backend:  backend,
+	}
+}
+
+// Has reports whether chainID has an endpoint
+func (c *Chains) Has(chainID int) bool {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	_, ok := c.chains[chainID]
+	return ok
+}
+
+// IDs lists the chains with an endpoint
+func (c *Chains) IDs() []int {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	ret := make([]int, 0, len(c.chains))
+	for id := range c.chains {
+		ret = append(ret, id)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// Confirmations returns how many confirmations a transaction on chainID needs
+func (c *Chains) Confirmations(chainID int) int {
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	if ch, ok := c.chains[chainID]; ok {
+		return ch.endpoint.Confirmations
+	}
+	return DefaultConfirmations
+}
+
+/*
+Backend returns the backend of chainID, dialling its endpoint the first time. A dialled endpoint must report
+chainID as its chain ID, so a transaction is never signed for one chain and sent to another. The endpoint is dialled
+without holding c.mtex, so a slow endpoint does not hold up other chains.
+*/
+func (c *Chains) Backend(ctx context.Context, chainID int) (Backend, error) {
+	c.mtex.Lock()
+	ch, ok := c.chains[chainID]
+	var backend Backend
+	var endpoint Endpoint
+	if ok {
+		backend, endpoint = ch.backend, ch.endpoint
+	}
+	c.mtex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrNoEndpoint, chainID)
+	}
+	if backend != nil {
+		return backend, nil
+	}
+	cl, err := dial(ctx, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c.mtex.Lock()
+	defer c.mtex.Unlock()
+	// another caller may have dialled the chain, or a backend been registered for it, in the meantime
+	if cur := c.chains[chainID]; cur.backend != nil {
+		cl.Close()
+		return cur.backend, nil
+	}
+	ch.backend = cl
+	return cl, nil
+}
+
+// dial connects to the endpoint and checks that it serves the chain it is configured for
+func dial(ctx context.Context, e Endpoint) (*ethclient.Client, error) {
+	cl, err := ethclient.DialContext(ctx, e.URL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial RPC endpoint of chain %d: %w", e.ChainID, err)
+	}
+	id, err := cl.ChainID(ctx)
+	if err != nil {
+		cl.Close()
+		return nil, fmt.Errorf("unable to read the chain ID of the RPC endpoint of chain %d: %w", e.ChainID, err)
+	}
+	if id.Cmp(big.NewInt(int64(e.ChainID))) != 0 {
+		cl.Close()
+		return nil, fmt.Errorf("RPC endpoint configured for chain %d serves chain %s", e.ChainID, id)
+	}
+	return cl, nil
+}
+
+/*
+ConfirmedBalance returns the balance of addr as of the newest block of chainID with the confirmations the chain
+requires, along with that block's number
+*/
+func (c *Chains) ConfirmedBalance(ctx context.Context, chainID int, addr common.Address) (*big.Int, uint64, error) {
+	backend, err := c.Backend(ctx, chainID)
+	if err != nil {
+		return nil, 0, err
+	}
+	head, err := backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read the head of chain %d: %w", chainID, err)
+	}
+	block := new(big.Int).Sub(head.Number, big.NewInt(int64(c.Confirmations(chainID)-1)))
+	if block.Sign() < 0 {
+		block.SetInt64(0)
+	}
+	balance, err := backend.BalanceAt(ctx, addr, block)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to read the balance of %s: %w", addr, err)
+	}
+	return balance, block.Uint64(), nil
+}
@@ -0,0 +1,152 @@
+package onchain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestSweepConfirmed(t *testing.T) {
+	ctx := context.Background()
+	key, _ := ethcrypto.GenerateKey()
+	from := ethcrypto.PubkeyToAddress(key.PublicKey)
+	to := ethcrypto.PubkeyToAddress(mustKey(t).PublicKey)
+	funds := big.NewInt(params.Ether)
+	sim := backends.NewSimulatedBackend(core.GenesisAlloc{from: {Balance: funds}}, 8000000)
+	defer sim.Close()
+	chainID := int(params.AllEthashProtocolChanges.ChainID.Int64())
+	chains, _ := New(nil)
+	chains.Register(chainID, sim, 2)
+
+	balance, block, err := chains.ConfirmedBalance(ctx, chainID, from)
+	if err != nil || balance.Cmp(funds) != 0 || block != 0 {
+		t.Fatalf("expected the genesis balance, got %s at block %d, %v", balance, block, err)
+	}
+	if _, err := chains.PlanSweep(ctx, chainID, to, from); !errors.Is(err, ErrBalanceTooLow) {
+		t.Errorf("expected sweeping an empty address to be refused, got %v", err)
+	}
+	sweep, err := chains.PlanSweep(ctx, chainID, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sweep.Sign(mustKey(t)); err != ErrWrongKey {
+		t.Errorf("expected a sweep signed with another key to be refused, got %v", err)
+	}
+	tx, err := sweep.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = chains.Send(ctx, chainID, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "transactions.json")
+	tracker, err := OpenTracker(chains, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Track(chainID, tx.Hash(), "sweep")
+	tracker.Poll(ctx)
+	if got, _ := tracker.Get(tx.Hash()); got.State != StatePending || got.Block != 0 {
+		t.Errorf("an unmined transaction should be pending, got %+v", got)
+	}
+	sim.Commit()
+	tracker.Poll(ctx)
+	if got, _ := tracker.Get(tx.Hash()); got.State != StatePending || got.Block != 1 || got.Confirmations != 1 {
+		t.Errorf("a transaction with one of two confirmations should be pending, got %+v", got)
+	}
+	if balance, _, _ := chains.ConfirmedBalance(ctx, chainID, to); balance.Sign() != 0 {
+		t.Errorf("an unconfirmed sweep counted in the balance: %s", balance)
+	}
+	sim.Commit()
+	tracker.Poll(ctx)
+	if balance, _, _ := chains.ConfirmedBalance(ctx, chainID, to); balance.Cmp(sweep.Value) != 0 {
+		t.Errorf("expected the swept %s, got %s", sweep.Value, balance)
+	}
+
+	// the transaction is still known after a restart
+	tracker, err = OpenTracker(chains, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := tracker.Get(tx.Hash())
+	if !ok || got.State != StateConfirmed || got.Confirmations != 2 || got.Note != "sweep" {
+		t.Errorf("expected the confirmed transaction after reopening, got %+v", got)
+	}
+}
+
+func mustKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// rpcServer is a JSON-RPC endpoint answering every call, such as eth_chainId, with chainID
+func rpcServer(t *testing.T, chainID string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": chainID})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBackendDialled(t *testing.T) {
+	ctx := context.Background()
+	chains, err := New([]Endpoint{
+		{ChainID: 5, URL: rpcServer(t, "0x5").URL},
+		{ChainID: 1, URL: rpcServer(t, "0x5").URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chains.Backend(ctx, 1); err == nil || !strings.Contains(err.Error(), "serves chain 5") {
+		t.Errorf("expected an endpoint serving another chain to be refused, got %v", err)
+	}
+	if _, err := chains.Backend(ctx, 10); !errors.Is(err, ErrNoEndpoint) {
+		t.Errorf("expected ErrNoEndpoint, got %v", err)
+	}
+
+	// callers racing to dial the same chain all get the one backend that was kept
+	dialled := make([]Backend, 8)
+	var wg sync.WaitGroup
+	for i := range dialled {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dialled[i], _ = chains.Backend(ctx, 5)
+		}(i)
+	}
+	wg.Wait()
+	kept, err := chains.Backend(ctx, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range dialled {
+		if b != kept {
+			t.Errorf("caller %d got a backend that was not kept", i)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package onchain
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// SweepGasLimit is the gas of a plain value transfer
+const SweepGasLimit = 21000
+
+var (
+	ErrBalanceTooLow = errors.New("on chain balance does not cover the transaction fee")
+	ErrWrongKey      = errors.New("private key does not control the sweep address")
+)
+
+/*
+Sweep is a transaction moving the whole balance of From to To less the fee, as a legacy transaction at the
+suggested gas price
+*/
+type Sweep struct {
+	ChainID  int
+	From     common.Address
+	To       common.Address
+	Nonce    uint64
+	Balance  *big.Int
+	GasPrice *big.Int
+	GasLimit uint64
+	Fee      *big.Int
+	// Balance less Fee
+	Value *big.Int
+}
+
+// PlanSweep reads what is needed to sweep from to to on chainID, refusing when the balance would not pay the fee
+func (c *Chains) PlanSweep(ctx context.Context, chainID int, from, to common.Address) (*Sweep, error) {
+	backend, err := c.Backend(ctx, chainID)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := backend.PendingNonceAt(ctx, from)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the nonce of %s: %w", from, err)
+	}
+	balance, err := backend.BalanceAt(ctx, from, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the balance of %s: %w", from, err)
+	}
+	gasPrice, err := backend.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the gas price: %w", err)
+	}
+	s := &Sweep{
+		ChainID:  chainID,
+		From:     from,
+		To:       to,
+		Nonce:    nonce,
+		Balance:  balance,
+		GasPrice: gasPrice,
+		GasLimit: SweepGasLimit,
+		Fee:      new(big.Int).Mul(gasPrice, big.NewInt(SweepGasLimit)),
+	}
+	s.Value = new(big.Int).Sub(balance, s.Fee)
+	if s.Value.Sign() <= 0 {
+		return s, fmt.Errorf("%w: %s has %s wei, the fee is %s wei", ErrBalanceTooLow, from, balance, s.Fee)
+	}
+	return s, nil
+}
+
+// Sign signs the sweep with the key of From
+func (s *Sweep) Sign(key *ecdsa.PrivateKey) (*types.Transaction, error) {
+	if ethcrypto.PubkeyToAddress(key.PublicKey) != s.From {
+		return nil, ErrWrongKey
+	}
+	tx := types.NewTransaction(s.Nonce, s.To, s.Value, s.GasLimit, s.GasPrice, nil)
+	return types.SignTx(tx, types.NewEIP155Signer(big.NewInt(int64(s.ChainID))), key)
+}
+
+// Send submits a signed transaction to chainID
+func (c *Chains) Send(ctx context.Context, chainID int, tx *types.Transaction) error {
+	backend, err := c.Backend(ctx, chainID)
+	if err != nil {
+		return err
+	}
+	return backend.SendTransaction(ctx, tx)
+}
@@ -0,0 +1,226 @@
+package onchain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+)
+
+type State string
+
+const (
+	// submitted and not yet mined, or mined with too few confirmations
+	StatePending   State = "pending"
+	StateConfirmed State = "confirmed"
+	// mined but reverted
+	StateFailed State = "failed"
+)
+
+// Transaction is a submitted transaction and how far it has got
+type Transaction struct {
+	Hash      common.Hash
+	ChainID   int
+	Submitted time.Time
+	// what the transaction was for, such as the phonon it redeemed
+	Note string `json:",omitempty"`
+	// block the transaction was mined in, 0 until it is
+	Block         uint64 `json:",omitempty"`
+	Confirmations uint64
+	Required      int
+	State         State
+	// last error checking on the transaction
+	Err     string `json:",omitempty"`
+	Checked time.Time
+}
+
+// Tracker follows submitted transactions until they are confirmed or fail. They are kept on disk so that a redeem
+// transaction submitted before a restart can still be looked up and followed after it
+type Tracker struct {
+	chains *Chains
+	path   string
+	mtex   sync.Mutex
+	txs    map[common.Hash]*Transaction
+}
+
+// OpenTracker reads the transactions at path, creating the file on first save. An empty path keeps them in memory only
+func OpenTracker(chains *Chains, path string) (*Tracker, error) {
+	t := &Tracker{
+		chains: chains,
+		path:   path,
+		txs:    make(map[common.Hash]*Transaction),
+	}
+	if path == "" {
+		return t, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*Transaction
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read transactions: %w", err)
+	}
+	for _, tx := range list {
+		t.txs[tx.Hash] = tx
+	}
+	return t, nil
+}
+
+// save writes the transactions to disk. Must be called with t.mtex held
+func (t *Tracker) save() error {
+	if t.path == "" {
+		return nil
+	}
+	return persist.WriteJSON(t.path, t.list())
+}
+
+// Track starts following hash on chainID
+func (t *Tracker) Track(chainID int, hash common.Hash, note string) Transaction {
+	tx := &Transaction{
+		Hash:      hash,
+		ChainID:   chainID,
+		Submitted: time.Now().UTC(),
+		Note:      note,
+		Required:  t.chains.Confirmations(chainID),
+		State:     StatePending,
+	}
+	t.mtex.Lock()
+	defer t.mtex.Unlock()
+	t.txs[hash] = tx
+	err := t.save()
+	if err != nil {
+		log.Error("unable to save submitted transaction, it will not be followed after a restart: ", err)
+	}
+	return *tx
+}
+
+func (t *Tracker) Get(hash common.Hash) (Transaction, bool) {
+	t.mtex.Lock()
+	defer t.mtex.Unlock()
+	tx, ok := t.txs[hash]
+	if !ok {
+		return Transaction{}, false
+	}
+	return *tx, true
+}
+
+// List returns every tracked transaction, most recently submitted first
+func (t *Tracker) List() []Transaction {
+	t.mtex.Lock()
+	defer t.mtex.Unlock()
+	return t.list()
+}
+
+// list is List with t.mtex held
+func (t *Tracker) list() []Transaction {
+	ret := make([]Transaction, 0, len(t.txs))
+	for _, tx := range t.txs {
+		ret = append(ret, *tx)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Submitted.After(ret[b].Submitted)
+	})
+	return ret
+}
+
+// Poll checks every pending transaction once
+func (t *Tracker) Poll(ctx context.Context) {
+	t.mtex.Lock()
+	var pending []Transaction
+	for _, tx := range t.txs {
+		if tx.State == StatePending {
+			pending = append(pending, *tx)
+		}
+	}
+	t.mtex.Unlock()
+	for _, tx := range pending {
+		t.check(ctx, tx)
+	}
+}
+
+func (t *Tracker) check(ctx context.Context, tx Transaction) {
+	tx.Checked = time.Now().UTC()
+	tx.Err = ""
+	block, confirmations, failed, err := t.chains.confirmations(ctx, tx.ChainID, tx.Hash)
+	if err != nil {
+		tx.Err = err.Error()
+		log.Debugf("unable to check transaction %s on chain %d: %s", tx.Hash, tx.ChainID, err)
+	} else {
+		tx.Block, tx.Confirmations = block, confirmations
+		switch {
+		case failed:
+			tx.State = StateFailed
+		case block > 0 && confirmations >= uint64(tx.Required):
+			tx.State = StateConfirmed
+		}
+	}
+	t.mtex.Lock()
+	defer t.mtex.Unlock()
+	t.txs[tx.Hash] = &tx
+	err = t.save()
+	if err != nil {
+		log.Error("unable to save transaction state: ", err)
+	}
+}
+
+// Run polls every interval until ctx is done
+func (t *Tracker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Poll(ctx)
+		}
+	}
+}
+
+/*
+confirmations reports the block hash was mined in and how many blocks include or follow it, both 0 while it is not
+mined, and whether it was reverted
+*/
+func (c *Chains) confirmations(ctx context.Context, chainID int, hash common.Hash) (block uint64, confirmations uint64, failed bool, err error) {
+	backend, err := c.Backend(ctx, chainID)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	receipt, err := backend.TransactionReceipt(ctx, hash)
+	if errors.Is(err, ethereum.NotFound) || (err == nil && receipt == nil) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	head, err := backend.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	block = receipt.BlockNumber.Uint64()
+	if head.Number.Cmp(receipt.BlockNumber) >= 0 {
+		confirmations = new(big.Int).Sub(head.Number, receipt.BlockNumber).Uint64() + 1
+	}
+	return block, confirmations, receipt.Status == types.ReceiptStatusFailed, nil
+}
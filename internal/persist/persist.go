@@ -0,0 +1,58 @@
+/*
+Package persist holds what the client's stores share in keeping their files: writing a JSON file so that a crash
+leaves either the old or the new contents, and repairing an append-only log whose last line a crash cut short.
+*/
+package persist
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+)
+
+/*
+WriteJSON writes v to path as indented JSON, readable only by the user. The JSON is written to a temporary file
+that then replaces path, so path is never left half written.
+*/
+func WriteJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DropPartialLine cuts off a line left half written by a crash at the end of f, so that the next line appended to f
+// starts on a line of its own
+func DropPartialLine(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = f.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	return f.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+}
@@ -0,0 +1,65 @@
+package persist
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	for _, v := range []map[string]int{{"a": 1}, {"b": 2}} {
+		err := WriteJSON(path, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]int
+	err = json.Unmarshal(data, &got)
+	if err != nil || len(got) != 1 || got["b"] != 2 {
+		t.Errorf("expected the last value written, got %s, %v", data, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the file to be readable by the user only, got %v", info.Mode())
+	}
+	if err := WriteJSON(path, func() {}); err == nil {
+		t.Error("expected a value that cannot be encoded to be refused")
+	}
+	if data2, _ := os.ReadFile(path); string(data2) != string(data) {
+		t.Error("a failed write changed the file")
+	}
+}
+
+func TestDropPartialLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.jsonl")
+	for contents, want := range map[string]string{
+		"":               "",
+		"{}\n":           "{}\n",
+		"{}\n{\"half\":": "{}\n",
+		"{\"half\":":     "",
+	} {
+		os.WriteFile(path, []byte(contents), 0600)
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = DropPartialLine(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := os.ReadFile(path)
+		if string(got) != want {
+			t.Errorf("%q: expected %q, got %q", contents, want, got)
+		}
+	}
+}
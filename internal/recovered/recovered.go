@@ -0,0 +1,189 @@
+/*
+Package recovered keeps the private keys of destroyed phonons that could not be handed back, such as when the request
+that destroyed them went away before it was answered. Like the secrets of jobs, each key is sealed under a token its
+caller already holds, the confirmation token of the request or the token of the job, and is handed back once, when
+claimed with that token. Keys are never written in the clear.
+*/
+package recovered
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/persist"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+var (
+	ErrWrongToken = errors.New("recovery token is not a confirmation or job token")
+	ErrNoKeys     = errors.New("no keys are kept under this token, or they have already been claimed")
+)
+
+// Key is a recovered private key, as it would have been returned by the request that destroyed its phonon
+type Key struct {
+	CardID    string
+	KeyIndex  model.PhononKeyIndex
+	Recovered time.Time
+	// how PrivateKey is encoded: hex, or the export format the request asked for, such as a keystore file
+	Format     string
+	PrivateKey string
+}
+
+type sealedKey struct {
+	CardID    string
+	KeyIndex  model.PhononKeyIndex
+	Recovered time.Time
+	Format    string
+	// SHA-256 of the token, to find the keys of a claim
+	TokenHash HexBytes
+	// the nonce followed by the ciphertext of the key under the token
+	Sealed HexBytes
+}
+
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = data
+	return nil
+}
+
+type Store struct {
+	path string
+	mtex sync.Mutex
+	keys []sealedKey
+}
+
+// Open reads the keys kept at path, creating the file on first save. An empty path keeps keys in memory only
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read recovered keys: %w", err)
+	}
+	return s, nil
+}
+
+// save writes the sealed keys to disk. Must be called with s.mtex held
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	return persist.WriteJSON(s.path, s.keys)
+}
+
+// Keep seals privKey, the key of the phonon at keyIndex of cardID encoded as format, under token until it is claimed
+func (s *Store) Keep(token string, cardID string, keyIndex model.PhononKeyIndex, format string, privKey string) error {
+	key, err := hex.DecodeString(token)
+	if err != nil {
+		return ErrWrongToken
+	}
+	aead, err := tokenCipher(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	tokenHash := sha256.Sum256(key)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	s.keys = append(s.keys, sealedKey{
+		CardID:    cardID,
+		KeyIndex:  keyIndex,
+		Recovered: time.Now(),
+		Format:    format,
+		TokenHash: tokenHash[:],
+		Sealed:    aead.Seal(nonce, nonce, []byte(privKey), nil),
+	})
+	return s.save()
+}
+
+// Claim returns the keys kept under token and forgets them, so they are only handed out once
+func (s *Store) Claim(token string) ([]Key, error) {
+	key, err := hex.DecodeString(token)
+	if err != nil {
+		return nil, ErrWrongToken
+	}
+	aead, err := tokenCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	tokenHash := sha256.Sum256(key)
+	s.mtex.Lock()
+	defer s.mtex.Unlock()
+	var claimed []Key
+	var kept []sealedKey
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare(tokenHash[:], k.TokenHash) != 1 {
+			kept = append(kept, k)
+			continue
+		}
+		if len(k.Sealed) < aead.NonceSize() {
+			return nil, fmt.Errorf("sealed key of key index %d of card %s is corrupted", k.KeyIndex, k.CardID)
+		}
+		privKey, err := aead.Open(nil, k.Sealed[:aead.NonceSize()], k.Sealed[aead.NonceSize():], nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open sealed key of key index %d of card %s: %w", k.KeyIndex, k.CardID, err)
+		}
+		claimed = append(claimed, Key{CardID: k.CardID, KeyIndex: k.KeyIndex, Recovered: k.Recovered, Format: k.Format, PrivateKey: string(privKey)})
+	}
+	if len(claimed) == 0 {
+		return nil, ErrNoKeys
+	}
+	s.keys = kept
+	err = s.save()
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+/*
+tokenCipher seals keys with the token itself as the key. Tokens are random, so there is nothing to stretch: 16 bytes
+for confirmation tokens and 32 for job tokens.
+*/
+func tokenCipher(token []byte) (cipher.AEAD, error) {
+	if len(token) != 16 && len(token) != 32 {
+		return nil, ErrWrongToken
+	}
+	block, err := aes.NewCipher(token)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
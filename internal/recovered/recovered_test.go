@@ -0,0 +1,63 @@
+package recovered
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+const (
+	confirmationToken = "00112233445566778899aabbccddeeff"
+	jobToken          = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	privKey           = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+)
+
+func TestClaim(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "recovered.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, token := range []string{confirmationToken, confirmationToken, jobToken} {
+		err = s.Keep(token, "card", model.PhononKeyIndex(1+i), "hex", privKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte(privKey)) {
+		t.Fatal("a recovered key was written in the clear")
+	}
+
+	// kept after a restart, and only handed to the holder of the token
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Claim("ffeeddccbbaa99887766554433221100"); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys for another token, got %v", err)
+	}
+	if _, err := s.Claim("not hex"); err != ErrWrongToken {
+		t.Errorf("expected ErrWrongToken, got %v", err)
+	}
+	if err := s.Keep("0011", "card", 4, "hex", privKey); err != ErrWrongToken {
+		t.Errorf("expected a short token to be refused, got %v", err)
+	}
+	keys, err := s.Claim(confirmationToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].KeyIndex != 1 || keys[1].KeyIndex != 2 || keys[0].PrivateKey != privKey || keys[0].Format != "hex" || keys[0].CardID != "card" {
+		t.Errorf("expected the two keys kept under the confirmation token, got %+v", keys)
+	}
+	if _, err := s.Claim(confirmationToken); err != ErrNoKeys {
+		t.Errorf("expected keys to be handed out once, got %v", err)
+	}
+	keys, err = s.Claim(jobToken)
+	if err != nil || len(keys) != 1 || keys[0].KeyIndex != 3 {
+		t.Errorf("expected the key kept under the job token, got %+v, %v", keys, err)
+	}
+}
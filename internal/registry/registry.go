@@ -0,0 +1,157 @@
+/*
+Package registry describes the currencies and chains phonons can hold, so amounts can be checked and shown in whole
+units rather than as raw currency types and base units. The built-in entries can be extended or overridden from
+phonon.yml.
+*/
+package registry
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+// MaxDecimals bounds a currency's decimal places, well above ether's 18
+const MaxDecimals = 77
+
+type Currency struct {
+	Type     model.CurrencyType
+	Name     string
+	Ticker   string
+	Decimals int
+}
+
+type Chain struct {
+	ID      int
+	Name    string
+	Testnet bool
+}
+
+var builtinCurrencies = []Currency{
+	{Type: model.Bitcoin, Name: "Bitcoin", Ticker: "BTC", Decimals: 8},
+	{Type: model.Ethereum, Name: "Ether", Ticker: "ETH", Decimals: 18},
+	{Type: model.Native, Name: "Matic", Ticker: "MATIC", Decimals: 18},
+}
+
+var builtinChains = []Chain{
+	{ID: 0, Name: "Native"},
+	{ID: 1, Name: "Mainnet"},
+	{ID: 3, Name: "Ropsten", Testnet: true},
+	{ID: 4, Name: "Rinkeby", Testnet: true},
+	{ID: 5, Name: "Goerli", Testnet: true},
+	{ID: 42, Name: "Kovan", Testnet: true},
+	{ID: 56, Name: "Binance"},
+	{ID: 97, Name: "Binance-testnet", Testnet: true},
+	{ID: 137, Name: "polygon"},
+	{ID: 4002, Name: "fantom-testnet", Testnet: true},
+	{ID: 43113, Name: "avalanche-testnet", Testnet: true},
+	{ID: 43114, Name: "avalanche"},
+	{ID: 80001, Name: "polygon-testnet", Testnet: true},
+}
+
+type Registry struct {
+	currencies map[model.CurrencyType]Currency
+	chains     map[int]Chain
+}
+
+// New returns the built-in registry with currencies and chains added, replacing built-in entries with the same key
+func New(currencies []Currency, chains []Chain) (*Registry, error) {
+	r := &Registry{
+		currencies: make(map[model.CurrencyType]Currency),
+		chains:     make(map[int]Chain),
+	}
+	for _, c := range builtinCurrencies {
+		r.currencies[c.Type] = c
+	}
+	for _, c := range builtinChains {
+		r.chains[c.ID] = c
+	}
+	for _, c := range currencies {
+		if c.Type == model.Unspecified {
+			return nil, fmt.Errorf("currency %q cannot use the unspecified currency type", c.Name)
+		}
+		if c.Decimals < 0 || c.Decimals > MaxDecimals {
+			return nil, fmt.Errorf("currency %q has invalid decimals %d", c.Name, c.Decimals)
+		}
+		if c.Ticker == "" {
+			return nil, fmt.Errorf("currency type %d has no ticker", c.Type)
+		}
+		r.currencies[c.Type] = c
+	}
+	for _, c := range chains {
+		if c.Name == "" {
+			return nil, fmt.Errorf("chain %d has no name", c.ID)
+		}
+		r.chains[c.ID] = c
+	}
+	return r, nil
+}
+
+// Currency returns the currency with currencyType, if it is known
+func (r *Registry) Currency(currencyType model.CurrencyType) (Currency, bool) {
+	c, ok := r.currencies[currencyType]
+	return c, ok
+}
+
+// Currencies returns every known currency ordered by type
+func (r *Registry) Currencies() []Currency {
+	ret := make([]Currency, 0, len(r.currencies))
+	for _, c := range r.currencies {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Type < ret[b].Type
+	})
+	return ret
+}
+
+// Chain returns the chain with id, if it is known
+func (r *Registry) Chain(id int) (Chain, bool) {
+	c, ok := r.chains[id]
+	return c, ok
+}
+
+// Chains returns every known chain ordered by ID
+func (r *Registry) Chains() []Chain {
+	ret := make([]Chain, 0, len(r.chains))
+	for _, c := range r.chains {
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].ID < ret[b].ID
+	})
+	return ret
+}
+
+// FormatAmount writes base units of currencyType as whole units with the ticker, such as "1.5 ETH"
+func (r *Registry) FormatAmount(currencyType model.CurrencyType, v *big.Int) string {
+	c, ok := r.currencies[currencyType]
+	if !ok {
+		return fmt.Sprintf("%s base units of currency type %d", v, currencyType)
+	}
+	return FormatDecimal(v, c.Decimals) + " " + c.Ticker
+}
+
+// FormatDecimal writes base units as an amount in whole units with decimals places, without trailing zeros
+func FormatDecimal(v *big.Int, decimals int) string {
+	s := v.String()
+	if decimals <= 0 {
+		return s
+	}
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if len(s) <= decimals {
+		s = strings.Repeat("0", decimals-len(s)+1) + s
+	}
+	whole, frac := s[:len(s)-decimals], strings.TrimRight(s[len(s)-decimals:], "0")
+	if frac != "" {
+		whole += "." + frac
+	}
+	if neg {
+		whole = "-" + whole
+	}
+	return whole
+}
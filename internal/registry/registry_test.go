@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+func TestFormatDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		v        string
+		decimals int
+		want     string
+	}{
+		{"1500000000000000000", 18, "1.5"},
+		{"1", 18, "0.000000000000000001"},
+		{"100000000", 8, "1"},
+		{"-250", 2, "-2.5"},
+		{"0", 8, "0"},
+		{"42", 0, "42"},
+	} {
+		v, _ := new(big.Int).SetString(tc.v, 10)
+		if got := FormatDecimal(v, tc.decimals); got != tc.want {
+			t.Errorf("%s with %d decimals: expected %s, got %s", tc.v, tc.decimals, tc.want, got)
+		}
+	}
+}
+
+func TestConfiguredEntries(t *testing.T) {
+	r, err := New([]Currency{{Type: model.Native, Name: "Fantom", Ticker: "FTM", Decimals: 18}}, []Chain{{ID: 250, Name: "fantom"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, _ := r.Currency(model.Native); c.Ticker != "FTM" {
+		t.Errorf("expected the configured currency to replace the built-in one, got %+v", c)
+	}
+	if _, ok := r.Chain(250); !ok {
+		t.Error("configured chain missing")
+	}
+	if _, ok := r.Chain(1); !ok {
+		t.Error("built-in chain missing")
+	}
+	chains := r.Chains()
+	for i := 1; i < len(chains); i++ {
+		if chains[i-1].ID >= chains[i].ID {
+			t.Fatalf("chains not ordered by ID: %+v", chains)
+		}
+	}
+	if got := r.FormatAmount(model.Ethereum, big.NewInt(2e18)); got != "2 ETH" {
+		t.Errorf("expected 2 ETH, got %s", got)
+	}
+	if got := r.FormatAmount(model.CurrencyType(9), big.NewInt(5)); got != "5 base units of currency type 9" {
+		t.Errorf("unexpected amount of an unknown currency %q", got)
+	}
+
+	for _, tc := range []struct {
+		currencies []Currency
+		chains     []Chain
+	}{
+		{currencies: []Currency{{Type: model.Unspecified, Name: "none", Ticker: "N"}}},
+		{currencies: []Currency{{Type: 9, Name: "big", Ticker: "B", Decimals: MaxDecimals + 1}}},
+		{currencies: []Currency{{Type: 9, Name: "no ticker"}}},
+		{chains: []Chain{{ID: 250}}},
+	} {
+		if _, err := New(tc.currencies, tc.chains); err == nil {
+			t.Errorf("expected %+v %+v to be refused", tc.currencies, tc.chains)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package report
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+var statementTemplate = template.Must(template.New("statement").Funcs(template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "first recorded event"
+		}
+		return t.Format("2006-01-02 15:04 MST")
+	},
+	"either": func(a, b string) string {
+		if a != "" {
+			return a
+		}
+		return b
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Phonon statement</title>
+<style>
+body { font-family: sans-serif; font-size: 11pt; margin: 2em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { border-bottom: 1px solid #ccc; padding: 0.3em 0.5em; text-align: left; }
+td.num { text-align: right; font-family: monospace; }
+.note { color: #a40; }
+section { page-break-inside: avoid; }
+@media print { body { margin: 0; } section { page-break-after: always; } }
+</style>
+</head>
+<body>
+<h1>Phonon statement</h1>
+<p>Period: {{date .From}} to {{date .To}}<br>Generated: {{date .Generated}}</p>
+{{range .Statements}}
+<section>
+<h2>Card {{.CardID}}{{if .Name}} ({{.Name}}){{end}}</h2>
+{{range .Notes}}<p class="note">{{.}}</p>{{end}}
+<table>
+<tr><th>Currency</th><th>Opening</th><th>In</th><th>Out</th><th>Closing</th></tr>
+{{range .Balances}}<tr><td>{{either .Ticker "currency"}} {{if not .Ticker}}{{.CurrencyType}}{{end}}</td><td class="num">{{either .OpeningAmount .Opening}}</td><td class="num">{{either .InAmount .In}}</td><td class="num">{{either .OutAmount .Out}}</td><td class="num">{{either .ClosingAmount .Closing}}</td></tr>
+{{end}}</table>
+{{if .Movements}}<table>
+<tr><th>Time</th><th>Kind</th><th>Key index</th><th>Amount</th><th>Counterparty</th><th>Note</th></tr>
+{{range .Movements}}<tr><td>{{date .Time}}</td><td>{{.Kind}}</td><td>{{.KeyIndex}}</td><td class="num">{{either .SignedAmount .Value}} {{.Ticker}}</td><td>{{.Counterparty}}</td><td>{{.Note}}</td></tr>
+{{end}}</table>{{else}}<p>No movements in this period.</p>{{end}}
+</section>
+{{end}}
+{{if .Totals}}<section>
+<h2>All cards</h2>
+<table>
+<tr><th>Currency</th><th>Opening</th><th>In</th><th>Out</th><th>Closing</th></tr>
+{{range .Totals}}<tr><td>{{either .Ticker "currency"}} {{if not .Ticker}}{{.CurrencyType}}{{end}}</td><td class="num">{{either .OpeningAmount .Opening}}</td><td class="num">{{either .InAmount .In}}</td><td class="num">{{either .OutAmount .Out}}</td><td class="num">{{either .ClosingAmount .Closing}}</td></tr>
+{{end}}</table>
+</section>{{end}}
+</body>
+</html>
+`))
+
+// WriteHTML writes the report as a printable HTML statement, one section per card
+func WriteHTML(w io.Writer, rep Report) error {
+	return statementTemplate.Execute(w, rep)
+}
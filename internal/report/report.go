@@ -0,0 +1,373 @@
+/*
+Package report builds statements of phonon holdings and movements for a period. Only the current holdings of a card
+are known for certain, so balances are worked backwards from the card's listing through the history ledger: the
+closing balance is what the card holds now less what arrived after the period, plus what left, and the opening
+balance is the closing balance less the period's net movements.
+*/
+package report
+
+import (
+	"encoding/csv"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+// inflows and outflows are the event kinds that change what a card holds
+var (
+	inflows  = []history.Kind{history.KindDescribed, history.KindReceived, history.KindMined, history.KindDeposited}
+	outflows = []history.Kind{history.KindSent, history.KindRedeemed, history.KindExported}
+)
+
+// Kinds lists the event kinds a statement reports as movements
+var Kinds = append(append([]history.Kind{}, inflows...), outflows...)
+
+func direction(k history.Kind) int {
+	for _, in := range inflows {
+		if k == in {
+			return 1
+		}
+	}
+	for _, out := range outflows {
+		if k == out {
+			return -1
+		}
+	}
+	return 0
+}
+
+// Holdings is what a card holds now. Phonons is nil when the card could not be listed, with the reason in Err
+type Holdings struct {
+	CardID  string
+	Name    string
+	Phonons []*model.Phonon
+	// public keys of the phonons on the card whose deposits have not been funded, which hold nothing yet
+	Unfunded []string
+	Err      error
+}
+
+// currencyOf is the currency a phonon holds. Mined phonons are native whether or not the card says so
+func currencyOf(p *model.Phonon) model.CurrencyType {
+	if p.CurrencyType == model.Unspecified && p.CurveType == model.NativeCurve {
+		return model.Native
+	}
+	return p.CurrencyType
+}
+
+// Balance is one currency's balances and movements over the period. Values are in base units
+type Balance struct {
+	CurrencyType model.CurrencyType
+	Ticker       string `json:",omitempty"`
+	// empty when the card's holdings are unknown
+	Opening string `json:",omitempty"`
+	In      string
+	Out     string
+	Closing string `json:",omitempty"`
+	// the same in whole units, when the currency is registered
+	OpeningAmount string `json:",omitempty"`
+	InAmount      string `json:",omitempty"`
+	OutAmount     string `json:",omitempty"`
+	ClosingAmount string `json:",omitempty"`
+}
+
+// Movement is an event that changed a card's holdings, with its value signed by direction
+type Movement struct {
+	history.Event
+	// base units, negative for outflows. Empty when the event did not record an amount
+	Value string `json:",omitempty"`
+	// whole units, when the currency is registered
+	SignedAmount string `json:",omitempty"`
+	Ticker       string `json:",omitempty"`
+}
+
+type Statement struct {
+	CardID string
+	Name   string `json:",omitempty"`
+	// false when the card could not be listed, so only its movements are reported
+	BalancesKnown bool
+	Balances      []Balance
+	Movements     []Movement
+	// anything that makes the statement less than complete
+	Notes []string `json:",omitempty"`
+}
+
+type Report struct {
+	Generated time.Time
+	// zero when the period starts with the first recorded event
+	From time.Time
+	To   time.Time
+	// one per card, ordered by card ID
+	Statements []Statement
+	// balances summed over the cards whose balances are known
+	Totals []Balance
+}
+
+type tally struct {
+	opening, in, out, closing *big.Int
+}
+
+func newTally() *tally {
+	return &tally{new(big.Int), new(big.Int), new(big.Int), new(big.Int)}
+}
+
+/*
+Build reports on the period [from, to) for each of cards. events must include every event of those cards from the
+start of the period until now, since later movements are needed to work back from the current holdings; events of
+other cards and kinds are ignored.
+*/
+func Build(reg *registry.Registry, cards []Holdings, events []history.Event, from, to, now time.Time) Report {
+	if to.IsZero() || to.After(now) {
+		to = now
+	}
+	rep := Report{Generated: now, From: from, To: to, Statements: []Statement{}}
+	totals := make(map[model.CurrencyType]*tally)
+	for _, c := range cards {
+		s, tallies := statement(reg, c, events, from, to)
+		if s.BalancesKnown {
+			for ct, t := range tallies {
+				sum, ok := totals[ct]
+				if !ok {
+					sum = newTally()
+					totals[ct] = sum
+				}
+				sum.opening.Add(sum.opening, t.opening)
+				sum.in.Add(sum.in, t.in)
+				sum.out.Add(sum.out, t.out)
+				sum.closing.Add(sum.closing, t.closing)
+			}
+		}
+		rep.Statements = append(rep.Statements, s)
+	}
+	sort.Slice(rep.Statements, func(a, b int) bool {
+		return rep.Statements[a].CardID < rep.Statements[b].CardID
+	})
+	rep.Totals = balances(reg, totals, true)
+	return rep
+}
+
+func statement(reg *registry.Registry, c Holdings, events []history.Event, from, to time.Time) (Statement, map[model.CurrencyType]*tally) {
+	s := Statement{
+		CardID:        c.CardID,
+		Name:          c.Name,
+		BalancesKnown: c.Phonons != nil,
+		Movements:     []Movement{},
+	}
+	tallies := make(map[model.CurrencyType]*tally)
+	get := func(ct model.CurrencyType) *tally {
+		t, ok := tallies[ct]
+		if !ok {
+			t = newTally()
+			tallies[ct] = t
+		}
+		return t
+	}
+	if c.Err != nil {
+		s.Notes = append(s.Notes, "balances are unknown because the card could not be listed: "+c.Err.Error())
+	}
+	unfunded := make(map[string]bool, len(c.Unfunded))
+	for _, pubKey := range c.Unfunded {
+		unfunded[strings.ToLower(strings.TrimPrefix(pubKey, "0x"))] = true
+	}
+	skipped := 0
+	for _, p := range c.Phonons {
+		if p.PubKey != nil && unfunded[strings.ToLower(strings.TrimPrefix(p.PubKey.String(), "0x"))] {
+			skipped++
+			continue
+		}
+		ct := currencyOf(p)
+		if ct == model.Unspecified {
+			continue
+		}
+		t := get(ct)
+		t.closing.Add(t.closing, p.Denomination.Value())
+	}
+	if skipped > 0 {
+		s.Notes = append(s.Notes, strconv.Itoa(skipped)+" deposits waiting to be funded are not included in the balances")
+	}
+
+	unknown, unknownMined := 0, 0
+	for _, e := range events {
+		dir := direction(e.Kind)
+		if e.CardID != c.CardID || dir == 0 || e.Time.Before(from) {
+			continue
+		}
+		if e.Kind == history.KindMined {
+			e.CurrencyType = model.Native
+		}
+		inPeriod := e.Time.Before(to)
+		value, ok := new(big.Int).SetString(e.Amount, 10)
+		if !ok || e.CurrencyType == model.Unspecified {
+			if !inPeriod {
+				continue
+			}
+			if e.Kind == history.KindMined {
+				unknownMined++
+			} else {
+				unknown++
+			}
+			m := Movement{Event: e}
+			if cur, ok := reg.Currency(e.CurrencyType); ok {
+				m.Ticker = cur.Ticker
+			}
+			s.Movements = append(s.Movements, m)
+			continue
+		}
+		t := get(e.CurrencyType)
+		if !inPeriod {
+			// undo what happened after the period to get back to the closing balance
+			if dir > 0 {
+				t.closing.Sub(t.closing, value)
+			} else {
+				t.closing.Add(t.closing, value)
+			}
+			continue
+		}
+		if dir > 0 {
+			t.in.Add(t.in, value)
+		} else {
+			t.out.Add(t.out, value)
+		}
+		signed := new(big.Int).Mul(value, big.NewInt(int64(dir)))
+		m := Movement{Event: e, Value: signed.String()}
+		if cur, ok := reg.Currency(e.CurrencyType); ok {
+			m.SignedAmount = registry.FormatDecimal(signed, cur.Decimals)
+			m.Ticker = cur.Ticker
+		}
+		s.Movements = append(s.Movements, m)
+	}
+	negative := false
+	for _, t := range tallies {
+		t.opening.Sub(t.closing, t.in)
+		t.opening.Add(t.opening, t.out)
+		negative = negative || t.opening.Sign() < 0 || t.closing.Sign() < 0
+	}
+	if unknown > 0 {
+		s.Notes = append(s.Notes, strconv.Itoa(unknown)+" movements recorded no amount and are not included in the balances")
+	}
+	if unknownMined > 0 {
+		s.Notes = append(s.Notes, strconv.Itoa(unknownMined)+" phonons were mined without their amount being recorded, so they are counted in the opening balance")
+	}
+	if negative && s.BalancesKnown {
+		s.Notes = append(s.Notes, "a negative balance means the history does not cover every movement of the card")
+	}
+	s.Balances = balances(reg, tallies, s.BalancesKnown)
+	return s, tallies
+}
+
+// balances lists tallies by currency type, leaving out opening and closing balances unless they are known
+func balances(reg *registry.Registry, tallies map[model.CurrencyType]*tally, known bool) []Balance {
+	ret := []Balance{}
+	for ct, t := range tallies {
+		b := Balance{CurrencyType: ct, In: t.in.String(), Out: t.out.String()}
+		if known {
+			b.Opening = t.opening.String()
+			b.Closing = t.closing.String()
+		}
+		if cur, ok := reg.Currency(ct); ok {
+			b.Ticker = cur.Ticker
+			b.InAmount = registry.FormatDecimal(t.in, cur.Decimals)
+			b.OutAmount = registry.FormatDecimal(t.out, cur.Decimals)
+			if known {
+				b.OpeningAmount = registry.FormatDecimal(t.opening, cur.Decimals)
+				b.ClosingAmount = registry.FormatDecimal(t.closing, cur.Decimals)
+			}
+		}
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].CurrencyType < ret[b].CurrencyType
+	})
+	return ret
+}
+
+/*
+WriteCSV writes the report as one table: for each card and currency an opening row, the period's movements and a
+closing row, followed by the totals across cards with the card ID left empty
+*/
+func WriteCSV(w io.Writer, rep Report) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"record", "cardID", "time", "kind", "currencyType", "ticker", "value", "amount", "keyIndex", "pubKey", "counterparty", "transferID", "note"})
+	if err != nil {
+		return err
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	balanceRow := func(record, cardID string, t time.Time, b Balance, value, amount string) []string {
+		return []string{record, cardID, formatTime(t), "", strconv.Itoa(int(b.CurrencyType)), b.Ticker, value, amount, "", "", "", "", ""}
+	}
+	for _, s := range rep.Statements {
+		var rows [][]string
+		for _, b := range s.Balances {
+			rows = append(rows, balanceRow("opening", s.CardID, rep.From, b, b.Opening, b.OpeningAmount))
+			for _, m := range s.Movements {
+				if m.CurrencyType != b.CurrencyType {
+					continue
+				}
+				rows = append(rows, movementRow(m))
+			}
+			rows = append(rows, balanceRow("closing", s.CardID, rep.To, b, b.Closing, b.ClosingAmount))
+		}
+		// movements without an amount may be of a currency with no other movements
+		for _, m := range s.Movements {
+			if m.Value == "" && !hasBalance(s.Balances, m.CurrencyType) {
+				rows = append(rows, movementRow(m))
+			}
+		}
+		for _, note := range s.Notes {
+			rows = append(rows, []string{"note", s.CardID, "", "", "", "", "", "", "", "", "", "", note})
+		}
+		err = cw.WriteAll(rows)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range rep.Totals {
+		err = cw.Write(balanceRow("opening", "", rep.From, b, b.Opening, b.OpeningAmount))
+		if err == nil {
+			err = cw.Write(balanceRow("closing", "", rep.To, b, b.Closing, b.ClosingAmount))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func movementRow(m Movement) []string {
+	return []string{
+		"movement",
+		m.CardID,
+		m.Time.Format(time.RFC3339),
+		string(m.Kind),
+		strconv.Itoa(int(m.CurrencyType)),
+		m.Ticker,
+		m.Value,
+		m.SignedAmount,
+		strconv.Itoa(int(m.KeyIndex)),
+		m.PubKey,
+		m.Counterparty,
+		m.TransferID,
+		m.Note,
+	}
+}
+
+func hasBalance(balances []Balance, ct model.CurrencyType) bool {
+	for _, b := range balances {
+		if b.CurrencyType == ct {
+			return true
+		}
+	}
+	return false
+}
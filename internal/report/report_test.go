@@ -0,0 +1,144 @@
+package report
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+func phonon(t *testing.T, keyIndex model.PhononKeyIndex, ct model.CurrencyType, value int64) *model.Phonon {
+	t.Helper()
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := model.NewPhononPubKey(ethcrypto.FromECDSAPub(&key.PublicKey), model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denomination, err := model.NewDenomination(big.NewInt(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.Phonon{KeyIndex: keyIndex, PubKey: pubKey, CurrencyType: ct, Denomination: denomination}
+}
+
+func event(kind history.Kind, at time.Time, keyIndex model.PhononKeyIndex, ct model.CurrencyType, amount string) history.Event {
+	return history.Event{Kind: kind, Time: at, CardID: "card", KeyIndex: keyIndex, CurrencyType: ct, Amount: amount}
+}
+
+func balanceOf(t *testing.T, balances []Balance, ct model.CurrencyType) Balance {
+	t.Helper()
+	for _, b := range balances {
+		if b.CurrencyType == ct {
+			return b
+		}
+	}
+	t.Fatalf("no balance for currency %d in %+v", ct, balances)
+	return Balance{}
+}
+
+func TestStatement(t *testing.T) {
+	reg, err := registry.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.AddDate(0, 1, 0)
+	now := to.AddDate(0, 1, 0)
+
+	described := phonon(t, 1, model.Ethereum, 1000)
+	receivedLater := phonon(t, 2, model.Ethereum, 200)
+	// the card lists a mined phonon without a currency
+	mined := phonon(t, 3, model.Unspecified, 10)
+	mined.CurveType = model.NativeCurve
+	unfunded := phonon(t, 4, model.Ethereum, 5000)
+	card := Holdings{
+		CardID:   "card",
+		Phonons:  []*model.Phonon{described, receivedLater, mined, unfunded},
+		Unfunded: []string{"0x" + unfunded.PubKey.String()},
+	}
+	events := []history.Event{
+		event(history.KindDescribed, from.Add(time.Hour), 1, model.Ethereum, "1000"),
+		event(history.KindSent, from.Add(2*time.Hour), 5, model.Ethereum, "50"),
+		event(history.KindMined, from.Add(3*time.Hour), 3, model.Native, "10"),
+		// mined before amounts were recorded
+		event(history.KindMined, from.Add(4*time.Hour), 6, model.Native, ""),
+		event(history.KindReceived, to.Add(time.Hour), 2, model.Ethereum, "200"),
+		{Kind: history.KindSent, Time: from.Add(time.Hour), CardID: "other", CurrencyType: model.Ethereum, Amount: "7"},
+	}
+	rep := Build(reg, []Holdings{card}, events, from, to, now)
+	if len(rep.Statements) != 1 {
+		t.Fatalf("expected one statement, got %d", len(rep.Statements))
+	}
+	s := rep.Statements[0]
+	if !s.BalancesKnown {
+		t.Fatal("balances should be known")
+	}
+
+	eth := balanceOf(t, s.Balances, model.Ethereum)
+	if eth.Closing != "1000" || eth.In != "1000" || eth.Out != "50" || eth.Opening != "50" {
+		t.Errorf("unexpected ether balance %+v", eth)
+	}
+	native := balanceOf(t, s.Balances, model.Native)
+	if native.Closing != "10" || native.In != "10" || native.Opening != "0" {
+		t.Errorf("unexpected native balance %+v", native)
+	}
+	if total := balanceOf(t, rep.Totals, model.Ethereum); total.Closing != "1000" {
+		t.Errorf("unfunded deposit counted in the totals: %+v", total)
+	}
+
+	if len(s.Movements) != 4 {
+		t.Fatalf("expected the period's 4 movements, got %+v", s.Movements)
+	}
+	for _, m := range s.Movements {
+		if m.Kind == history.KindMined && (m.CurrencyType != model.Native || m.Ticker == "") {
+			t.Errorf("mined movement not reported as native: %+v", m)
+		}
+	}
+	notes := strings.Join(s.Notes, "\n")
+	for _, want := range []string{"1 deposits waiting to be funded", "1 phonons were mined without their amount"} {
+		if !strings.Contains(notes, want) {
+			t.Errorf("expected a note about %q, got %q", want, notes)
+		}
+	}
+	if strings.Contains(notes, "movements recorded no amount") {
+		t.Errorf("mined movements counted as unknown: %q", notes)
+	}
+
+	var buf bytes.Buffer
+	err = WriteCSV(&buf, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "opening,card,2022-01-01T00:00:00Z,,2,ETH,50,") {
+		t.Errorf("csv has no ether opening row:\n%s", buf.String())
+	}
+}
+
+func TestUnknownHoldings(t *testing.T) {
+	reg, _ := registry.New(nil, nil)
+	now := time.Now().UTC()
+	card := Holdings{CardID: "card", Err: errors.New("card is locked")}
+	events := []history.Event{event(history.KindSent, now.Add(-time.Hour), 1, model.Ethereum, "50")}
+	rep := Build(reg, []Holdings{card}, events, time.Time{}, time.Time{}, now)
+	s := rep.Statements[0]
+	if s.BalancesKnown || len(s.Notes) == 0 {
+		t.Fatalf("balances of a card that could not be listed should be unknown: %+v", s)
+	}
+	b := balanceOf(t, s.Balances, model.Ethereum)
+	if b.Opening != "" || b.Closing != "" || b.Out != "50" {
+		t.Errorf("expected only the movements of an unlisted card, got %+v", b)
+	}
+	if len(rep.Totals) != 0 {
+		t.Errorf("cards with unknown balances should not be totalled, got %+v", rep.Totals)
+	}
+}
@@ -0,0 +1,367 @@
+package trace
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"time"
+
+	"github.com/PhononDAO/phonon-core/pkg/cert"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+/*
+card records every PhononCard call made by the orchestrator. IdentifyCard is promoted from the wrapped card
+without being recorded, since its signature type cannot be named outside of phonon-core; the identity public key
+is recorded once in the trace's card entry instead.
+*/
+type card struct {
+	model.PhononCard
+	r *Recorder
+}
+
+// Card wraps a PhononCard with the identity public key identityPubKey so that its calls and their results are written to the trace
+func (r *Recorder) Card(c model.PhononCard, identityPubKey *ecdsa.PublicKey) model.PhononCard {
+	r.write(newCallEntry(KindCard, "IdentifyCard", nil, identityResult{PubKey: ethcrypto.FromECDSAPub(identityPubKey)}, nil))
+	return &card{PhononCard: c, r: r}
+}
+
+func newCallEntry(kind string, method string, args interface{}, results interface{}, err error) *Entry {
+	e := &Entry{
+		Time:   time.Now().UTC(),
+		Kind:   kind,
+		Method: method,
+	}
+	if args != nil {
+		e.Args, _ = json.Marshal(args)
+	}
+	if results != nil {
+		e.Results, _ = json.Marshal(results)
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	return e
+}
+
+func (c *card) record(method string, args interface{}, results interface{}, err error) {
+	c.r.write(newCallEntry(KindCall, method, args, results, err))
+}
+
+// recorded argument and result shapes, shared with the replay backend
+
+type identityResult struct {
+	PubKey HexBytes `json:"pubKey,omitempty"`
+}
+
+type selectResult struct {
+	InstanceUID     HexBytes `json:"instanceUID,omitempty"`
+	CardPubKey      HexBytes `json:"cardPubKey,omitempty"`
+	CardInitialized bool     `json:"cardInitialized"`
+}
+
+// certificates are redacted, leaving their length. Traces recorded before that hold the certificate itself
+type certResult struct {
+	Cert     HexBytes `json:"cert,omitempty"`
+	Redacted bool     `json:"redacted,omitempty"`
+	Len      int      `json:"len,omitempty"`
+}
+
+type keyIndexArgs struct {
+	KeyIndex  model.PhononKeyIndex `json:"keyIndex"`
+	CurveType model.CurveType      `json:"curveType"`
+}
+
+type keyIndicesArgs struct {
+	KeyIndices []model.PhononKeyIndex `json:"keyIndices"`
+	Extended   bool                   `json:"extended,omitempty"`
+}
+
+type createPhononResult struct {
+	KeyIndex model.PhononKeyIndex `json:"keyIndex"`
+	PubKey   *pubKey              `json:"pubKey,omitempty"`
+}
+
+type listPhononsArgs struct {
+	CurrencyType     model.CurrencyType `json:"currencyType"`
+	LessThanValue    uint64             `json:"lessThanValue"`
+	GreaterThanValue uint64             `json:"greaterThanValue"`
+	Continuation     bool               `json:"continuation"`
+}
+
+type dataMsg struct {
+	Data     HexBytes `json:"data,omitempty"`
+	Redacted bool     `json:"redacted,omitempty"`
+	Len      int      `json:"len,omitempty"`
+}
+
+type nameMsg struct {
+	Name string `json:"name"`
+}
+
+type memoryResult struct {
+	Persistent int `json:"persistent"`
+	OnReset    int `json:"onReset"`
+	OnDeselect int `json:"onDeselect"`
+}
+
+type mineResult struct {
+	KeyIndex model.PhononKeyIndex `json:"keyIndex"`
+	Hash     HexBytes             `json:"hash,omitempty"`
+}
+
+type pubKey struct {
+	CurveType model.CurveType `json:"curveType"`
+	Key       HexBytes        `json:"key"`
+}
+
+func newPubKey(k model.PhononPubKey, crv model.CurveType) *pubKey {
+	if k == nil {
+		return nil
+	}
+	return &pubKey{CurveType: crv, Key: k.Bytes()}
+}
+
+func (k *pubKey) phononPubKey() (model.PhononPubKey, error) {
+	if k == nil {
+		return nil, nil
+	}
+	return model.NewPhononPubKey(k.Key, k.CurveType)
+}
+
+// phonon mirrors model.Phonon. model.Phonon's own JSON encoding cannot represent a phonon without a public key,
+// which is what ListPhonons returns
+type phonon struct {
+	KeyIndex              model.PhononKeyIndex `json:"keyIndex"`
+	PubKey                *pubKey              `json:"pubKey,omitempty"`
+	CurveType             model.CurveType      `json:"curveType"`
+	SchemaVersion         uint8                `json:"schemaVersion"`
+	ExtendedSchemaVersion uint8                `json:"extendedSchemaVersion"`
+	Base                  uint8                `json:"base"`
+	Exponent              uint8                `json:"exponent"`
+	CurrencyType          model.CurrencyType   `json:"currencyType"`
+	ChainID               int                  `json:"chainID"`
+}
+
+func newPhonon(p *model.Phonon) phonon {
+	return phonon{
+		KeyIndex:              p.KeyIndex,
+		PubKey:                newPubKey(p.PubKey, p.CurveType),
+		CurveType:             p.CurveType,
+		SchemaVersion:         p.SchemaVersion,
+		ExtendedSchemaVersion: p.ExtendedSchemaVersion,
+		Base:                  p.Denomination.Base,
+		Exponent:              p.Denomination.Exponent,
+		CurrencyType:          p.CurrencyType,
+		ChainID:               p.ChainID,
+	}
+}
+
+func (p phonon) phonon() (*model.Phonon, error) {
+	k, err := p.PubKey.phononPubKey()
+	if err != nil {
+		return nil, err
+	}
+	return &model.Phonon{
+		KeyIndex:              p.KeyIndex,
+		PubKey:                k,
+		CurveType:             p.CurveType,
+		SchemaVersion:         p.SchemaVersion,
+		ExtendedSchemaVersion: p.ExtendedSchemaVersion,
+		Denomination:          model.Denomination{Base: p.Base, Exponent: p.Exponent},
+		CurrencyType:          p.CurrencyType,
+		ChainID:               p.ChainID,
+	}, nil
+}
+
+func redacted(data []byte) dataMsg {
+	return dataMsg{Redacted: true, Len: len(data)}
+}
+
+// PhononCard methods
+
+func (c *card) Select() (instanceUID []byte, cardPubKey *ecdsa.PublicKey, cardInitialized bool, err error) {
+	instanceUID, cardPubKey, cardInitialized, err = c.PhononCard.Select()
+	res := selectResult{InstanceUID: instanceUID, CardInitialized: cardInitialized}
+	if cardPubKey != nil {
+		res.CardPubKey = ethcrypto.FromECDSAPub(cardPubKey)
+	}
+	c.record("Select", nil, res, err)
+	return instanceUID, cardPubKey, cardInitialized, err
+}
+
+func (c *card) Pair() (*cert.CardCertificate, error) {
+	crt, err := c.PhononCard.Pair()
+	res := certResult{}
+	if crt != nil && err == nil {
+		res = certResult{Redacted: true, Len: len(crt.Serialize())}
+	}
+	c.record("Pair", nil, res, err)
+	return crt, err
+}
+
+func (c *card) OpenSecureChannel() error {
+	err := c.PhononCard.OpenSecureChannel()
+	c.record("OpenSecureChannel", nil, nil, err)
+	return err
+}
+
+func (c *card) OpenSecureConnection() error {
+	err := c.PhononCard.OpenSecureConnection()
+	c.record("OpenSecureConnection", nil, nil, err)
+	return err
+}
+
+func (c *card) Init(pin string) error {
+	err := c.PhononCard.Init(pin)
+	c.record("Init", redacted([]byte(pin)), nil, err)
+	return err
+}
+
+func (c *card) VerifyPIN(pin string) error {
+	err := c.PhononCard.VerifyPIN(pin)
+	c.record("VerifyPIN", redacted([]byte(pin)), nil, err)
+	return err
+}
+
+func (c *card) ChangePIN(pin string) error {
+	err := c.PhononCard.ChangePIN(pin)
+	c.record("ChangePIN", redacted([]byte(pin)), nil, err)
+	return err
+}
+
+func (c *card) CreatePhonon(curveType model.CurveType) (keyIndex model.PhononKeyIndex, pubKey model.PhononPubKey, err error) {
+	keyIndex, pubKey, err = c.PhononCard.CreatePhonon(curveType)
+	c.record("CreatePhonon", keyIndexArgs{CurveType: curveType}, createPhononResult{KeyIndex: keyIndex, PubKey: newPubKey(pubKey, curveType)}, err)
+	return keyIndex, pubKey, err
+}
+
+func (c *card) SetDescriptor(p *model.Phonon) error {
+	err := c.PhononCard.SetDescriptor(p)
+	c.record("SetDescriptor", newPhonon(p), nil, err)
+	return err
+}
+
+func (c *card) ListPhonons(currencyType model.CurrencyType, lessThanValue uint64, greaterThanValue uint64, continuation bool) ([]*model.Phonon, error) {
+	phonons, err := c.PhononCard.ListPhonons(currencyType, lessThanValue, greaterThanValue, continuation)
+	res := make([]phonon, 0, len(phonons))
+	for _, p := range phonons {
+		res = append(res, newPhonon(p))
+	}
+	c.record("ListPhonons", listPhononsArgs{currencyType, lessThanValue, greaterThanValue, continuation}, res, err)
+	return phonons, err
+}
+
+func (c *card) GetPhononPubKey(keyIndex model.PhononKeyIndex, crv model.CurveType) (model.PhononPubKey, error) {
+	k, err := c.PhononCard.GetPhononPubKey(keyIndex, crv)
+	c.record("GetPhononPubKey", keyIndexArgs{keyIndex, crv}, newPubKey(k, crv), err)
+	return k, err
+}
+
+func (c *card) DestroyPhonon(keyIndex model.PhononKeyIndex) (*ecdsa.PrivateKey, error) {
+	privKey, err := c.PhononCard.DestroyPhonon(keyIndex)
+	c.record("DestroyPhonon", keyIndexArgs{KeyIndex: keyIndex}, dataMsg{Redacted: true}, err)
+	return privKey, err
+}
+
+func (c *card) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	packet, err := c.PhononCard.SendPhonons(keyIndices, extendedRequest)
+	c.record("SendPhonons", keyIndicesArgs{keyIndices, extendedRequest}, redacted(packet), err)
+	return packet, err
+}
+
+func (c *card) ReceivePhonons(phononTransfer []byte) error {
+	err := c.PhononCard.ReceivePhonons(phononTransfer)
+	c.record("ReceivePhonons", redacted(phononTransfer), nil, err)
+	return err
+}
+
+func (c *card) SetReceiveList(phononPubKeys []*ecdsa.PublicKey) error {
+	err := c.PhononCard.SetReceiveList(phononPubKeys)
+	var keys []HexBytes
+	for _, k := range phononPubKeys {
+		keys = append(keys, ethcrypto.FromECDSAPub(k))
+	}
+	c.record("SetReceiveList", keys, nil, err)
+	return err
+}
+
+func (c *card) TransactionAck(keyIndices []model.PhononKeyIndex) error {
+	err := c.PhononCard.TransactionAck(keyIndices)
+	c.record("TransactionAck", keyIndicesArgs{KeyIndices: keyIndices}, nil, err)
+	return err
+}
+
+func (c *card) InitCardPairing(receiverCertificate cert.CardCertificate) ([]byte, error) {
+	data, err := c.PhononCard.InitCardPairing(receiverCertificate)
+	c.record("InitCardPairing", certResult{Redacted: true, Len: len(receiverCertificate.Serialize())}, redacted(data), err)
+	return data, err
+}
+
+func (c *card) CardPair(initPairingData []byte) ([]byte, error) {
+	data, err := c.PhononCard.CardPair(initPairingData)
+	c.record("CardPair", redacted(initPairingData), redacted(data), err)
+	return data, err
+}
+
+func (c *card) CardPair2(cardPairData []byte) ([]byte, error) {
+	data, err := c.PhononCard.CardPair2(cardPairData)
+	c.record("CardPair2", redacted(cardPairData), redacted(data), err)
+	return data, err
+}
+
+func (c *card) FinalizeCardPair(cardPair2Data []byte) error {
+	err := c.PhononCard.FinalizeCardPair(cardPair2Data)
+	c.record("FinalizeCardPair", redacted(cardPair2Data), nil, err)
+	return err
+}
+
+func (c *card) LoadCertAuthority(CAPubKey []byte) error {
+	err := c.PhononCard.LoadCertAuthority(CAPubKey)
+	c.record("LoadCertAuthority", dataMsg{Data: CAPubKey}, nil, err)
+	return err
+}
+
+func (c *card) InstallCertificate(signKeyFunc func([]byte) ([]byte, error)) error {
+	err := c.PhononCard.InstallCertificate(signKeyFunc)
+	c.record("InstallCertificate", nil, nil, err)
+	return err
+}
+
+func (c *card) GenerateInvoice() ([]byte, error) {
+	data, err := c.PhononCard.GenerateInvoice()
+	c.record("GenerateInvoice", nil, redacted(data), err)
+	return data, err
+}
+
+func (c *card) ReceiveInvoice(invoiceData []byte) error {
+	err := c.PhononCard.ReceiveInvoice(invoiceData)
+	c.record("ReceiveInvoice", redacted(invoiceData), nil, err)
+	return err
+}
+
+func (c *card) SetFriendlyName(name string) error {
+	err := c.PhononCard.SetFriendlyName(name)
+	c.record("SetFriendlyName", nameMsg{name}, nil, err)
+	return err
+}
+
+func (c *card) GetFriendlyName() (string, error) {
+	name, err := c.PhononCard.GetFriendlyName()
+	c.record("GetFriendlyName", nil, nameMsg{name}, err)
+	return name, err
+}
+
+func (c *card) GetAvailableMemory() (persistentMem int, onResetMem int, onDeselectMem int, err error) {
+	persistentMem, onResetMem, onDeselectMem, err = c.PhononCard.GetAvailableMemory()
+	c.record("GetAvailableMemory", nil, memoryResult{persistentMem, onResetMem, onDeselectMem}, err)
+	return persistentMem, onResetMem, onDeselectMem, err
+}
+
+func (c *card) MineNativePhonon(difficulty uint8) (model.PhononKeyIndex, []byte, error) {
+	keyIndex, hash, err := c.PhononCard.MineNativePhonon(difficulty)
+	c.record("MineNativePhonon", struct {
+		Difficulty uint8 `json:"difficulty"`
+	}{difficulty}, mineResult{keyIndex, hash}, err)
+	return keyIndex, hash, err
+}
@@ -0,0 +1,120 @@
+package trace
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GridPlus/keycard-go/apdu"
+	"github.com/GridPlus/keycard-go/types"
+)
+
+// instructions whose payloads carry PINs, secure channel secrets, phonon private keys, certificates or card to card
+// pairing secrets
+const (
+	insOpenSecureChannel    = 0x10
+	insMutuallyAuthenticate = 0x11
+	insPair                 = 0x12
+	insLoadCert             = 0x15
+	insVerifyPIN            = 0x20
+	insChangePIN            = 0x21
+	insDestroyPhonon        = 0x34
+	insSendPhonons          = 0x35
+	insRecvPhonons          = 0x36
+	insInitCardPairing      = 0x50
+	insCardPair             = 0x51
+	insCardPair2            = 0x52
+	insFinalizeCardPair     = 0x53
+	insInit                 = 0xFE
+)
+
+// further instructions the command set sends without the secure channel
+const (
+	insIdentifyCard = 0x14
+	insLoadCA       = 0x58
+	insSelect       = 0xA4
+)
+
+// sentInTheClear reports whether the command set sends ins without the secure channel even once it is open
+func sentInTheClear(ins byte) bool {
+	switch ins {
+	case insSelect, insPair, insOpenSecureChannel, insInit, insIdentifyCard, insLoadCert, insLoadCA:
+		return true
+	}
+	return false
+}
+
+func redactCommand(ins byte) bool {
+	switch ins {
+	case insOpenSecureChannel, insMutuallyAuthenticate, insPair, insLoadCert, insVerifyPIN, insChangePIN, insRecvPhonons,
+		insInitCardPairing, insCardPair, insCardPair2, insFinalizeCardPair, insInit:
+		return true
+	}
+	return false
+}
+
+func redactResponse(ins byte) bool {
+	switch ins {
+	case insOpenSecureChannel, insMutuallyAuthenticate, insPair, insDestroyPhonon, insSendPhonons,
+		insInitCardPairing, insCardPair, insCardPair2:
+		return true
+	}
+	return false
+}
+
+/*
+channel follows whether the card's secure channel is open, so that the APDUs sent over it are marked encrypted: it
+opens when OPEN_SECURE_CHANNEL succeeds and closes when the applet is selected again.
+*/
+type channel struct {
+	c    types.Channel
+	r    *Recorder
+	mtex sync.Mutex
+	open bool
+}
+
+// Channel wraps a card transport so that every APDU sent through it is written to the trace
+func (r *Recorder) Channel(c types.Channel) types.Channel {
+	return &channel{c: c, r: r}
+}
+
+func (ch *channel) Send(cmd *apdu.Command) (*apdu.Response, error) {
+	ch.mtex.Lock()
+	defer ch.mtex.Unlock()
+	e := &Entry{
+		Time: time.Now().UTC(),
+		Kind: KindAPDU,
+		Command: &CommandAPDU{
+			Cla:       cmd.Cla,
+			Ins:       cmd.Ins,
+			P1:        cmd.P1,
+			P2:        cmd.P2,
+			Encrypted: ch.open && !sentInTheClear(cmd.Ins),
+		},
+	}
+	if redactCommand(cmd.Ins) {
+		e.Command.Redacted = true
+	} else {
+		e.Command.Data = append(HexBytes{}, cmd.Data...)
+	}
+
+	resp, err := ch.c.Send(cmd)
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if resp != nil {
+		e.Response = &ResponseAPDU{Sw: resp.Sw}
+		if redactResponse(cmd.Ins) {
+			e.Response.Redacted = true
+		} else {
+			e.Response.Data = append(HexBytes{}, resp.Data...)
+		}
+	}
+	switch {
+	case cmd.Ins == insSelect:
+		ch.open = false
+	case cmd.Ins == insOpenSecureChannel && resp != nil && resp.Sw == 0x9000:
+		ch.open = true
+	}
+	ch.r.write(e)
+	return resp, err
+}
@@ -0,0 +1,342 @@
+package trace
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend"
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/cert"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+var ErrTraceExhausted = errors.New("replayed trace has no more recorded calls")
+var ErrTraceMismatch = errors.New("call does not match the next recorded call")
+
+// errors that callers compare against directly, so replayed errors must be the same values
+var knownErrors = []error{
+	backend.ErrCardUninitialized,
+	backend.ErrPhononTableFull,
+	backend.ErrKeyIndexInvalid,
+	backend.ErrOutOfMemory,
+	backend.ErrPINNotEntered,
+	backend.ErrUnknown,
+	backend.ErrMiningFailed,
+	backend.ErrInvalidPhononIndex,
+	backend.ErrInvalidKeyLength,
+	backend.ErrCertLocked,
+	backend.ErrDefault,
+	backend.ErrInvalidResponseMAC,
+}
+
+/*
+ReplayCard is a PhononCard that answers each call with the next call recorded in a trace, so an
+orchestrator.Session can be driven through a recorded card session without hardware. Calls must arrive in the
+recorded order. Redacted results are replaced: DestroyPhonon returns a freshly generated key, SendPhonons and the
+card to card pairing calls return random bytes of the recorded length, and Pair returns a certificate for the
+recorded identity signed with the demo key. Flows that depend on them only replay up to the card boundary.
+
+IdentifyCard is served by an embedded mock reporting the recorded identity public key; its signatures will not
+verify against that key.
+*/
+type ReplayCard struct {
+	*mock.MockCard
+	calls []Entry
+	pos   int
+	mtex  sync.Mutex
+}
+
+// OpenReplay loads the trace file at path into a ReplayCard
+func OpenReplay(path string) (*ReplayCard, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplayCard(f)
+}
+
+func NewReplayCard(rd io.Reader) (*ReplayCard, error) {
+	entries, err := Read(rd)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mock.NewMockCard(false, false)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReplayCard{MockCard: m.(*mock.MockCard)}
+	for _, e := range entries {
+		switch e.Kind {
+		case KindCard:
+			var identity identityResult
+			err = json.Unmarshal(e.Results, &identity)
+			if err != nil {
+				return nil, err
+			}
+			if len(identity.PubKey) > 0 {
+				rc.IdentityPubKey, err = ethcrypto.UnmarshalPubkey(identity.PubKey)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case KindCall:
+			rc.calls = append(rc.calls, e)
+		}
+	}
+	return rc, nil
+}
+
+// Remaining returns the number of recorded calls not yet replayed
+func (rc *ReplayCard) Remaining() int {
+	rc.mtex.Lock()
+	defer rc.mtex.Unlock()
+	return len(rc.calls) - rc.pos
+}
+
+// replay consumes the next recorded call, which must be method, decodes its results into results and returns
+// the error it recorded
+func (rc *ReplayCard) replay(method string, results interface{}) error {
+	rc.mtex.Lock()
+	defer rc.mtex.Unlock()
+	if rc.pos >= len(rc.calls) {
+		return ErrTraceExhausted
+	}
+	e := rc.calls[rc.pos]
+	if e.Method != method {
+		return fmt.Errorf("%w: expected %s (seq %d), got %s", ErrTraceMismatch, e.Method, e.Seq, method)
+	}
+	rc.pos += 1
+	if results != nil && len(e.Results) > 0 {
+		err := json.Unmarshal(e.Results, results)
+		if err != nil {
+			return err
+		}
+	}
+	return recordedError(e.Err)
+}
+
+func recordedError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	for _, known := range knownErrors {
+		if known.Error() == msg {
+			return known
+		}
+	}
+	return errors.New(msg)
+}
+
+func (rc *ReplayCard) Select() (instanceUID []byte, cardPubKey *ecdsa.PublicKey, cardInitialized bool, err error) {
+	var res selectResult
+	err = rc.replay("Select", &res)
+	if len(res.CardPubKey) > 0 {
+		cardPubKey, _ = ethcrypto.UnmarshalPubkey(res.CardPubKey)
+	}
+	return res.InstanceUID, cardPubKey, res.CardInitialized, err
+}
+
+func (rc *ReplayCard) Pair() (*cert.CardCertificate, error) {
+	var res certResult
+	err := rc.replay("Pair", &res)
+	if err != nil {
+		return &cert.CardCertificate{}, err
+	}
+	raw := []byte(res.Cert)
+	if len(raw) == 0 {
+		if rc.IdentityPubKey == nil {
+			return &cert.CardCertificate{}, errors.New("trace records neither the certificate nor the identity of the card")
+		}
+		raw, err = cert.CreateCardCertificate(rc.IdentityPubKey, cert.SignWithDemoKey)
+		if err != nil {
+			return &cert.CardCertificate{}, err
+		}
+	}
+	crt, err := cert.ParseRawCardCertificate(raw)
+	if err != nil {
+		return &cert.CardCertificate{}, err
+	}
+	return &crt, nil
+}
+
+// redactedData returns the recorded data, or random bytes of the recorded length if it was redacted
+func redactedData(res dataMsg) ([]byte, error) {
+	if !res.Redacted {
+		return res.Data, nil
+	}
+	data := make([]byte, res.Len)
+	_, err := io.ReadFull(rand.Reader, data)
+	return data, err
+}
+
+func (rc *ReplayCard) OpenSecureChannel() error {
+	return rc.replay("OpenSecureChannel", nil)
+}
+
+func (rc *ReplayCard) OpenSecureConnection() error {
+	return rc.replay("OpenSecureConnection", nil)
+}
+
+func (rc *ReplayCard) Init(pin string) error {
+	return rc.replay("Init", nil)
+}
+
+func (rc *ReplayCard) VerifyPIN(pin string) error {
+	return rc.replay("VerifyPIN", nil)
+}
+
+func (rc *ReplayCard) ChangePIN(pin string) error {
+	return rc.replay("ChangePIN", nil)
+}
+
+func (rc *ReplayCard) CreatePhonon(curveType model.CurveType) (model.PhononKeyIndex, model.PhononPubKey, error) {
+	var res createPhononResult
+	err := rc.replay("CreatePhonon", &res)
+	k, keyErr := res.PubKey.phononPubKey()
+	if err == nil {
+		err = keyErr
+	}
+	return res.KeyIndex, k, err
+}
+
+func (rc *ReplayCard) SetDescriptor(p *model.Phonon) error {
+	return rc.replay("SetDescriptor", nil)
+}
+
+func (rc *ReplayCard) ListPhonons(currencyType model.CurrencyType, lessThanValue uint64, greaterThanValue uint64, continuation bool) ([]*model.Phonon, error) {
+	var res []phonon
+	err := rc.replay("ListPhonons", &res)
+	var phonons []*model.Phonon
+	for _, p := range res {
+		mp, convErr := p.phonon()
+		if convErr != nil {
+			return nil, convErr
+		}
+		phonons = append(phonons, mp)
+	}
+	return phonons, err
+}
+
+func (rc *ReplayCard) GetPhononPubKey(keyIndex model.PhononKeyIndex, crv model.CurveType) (model.PhononPubKey, error) {
+	var res *pubKey
+	err := rc.replay("GetPhononPubKey", &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.phononPubKey()
+}
+
+func (rc *ReplayCard) DestroyPhonon(keyIndex model.PhononKeyIndex) (*ecdsa.PrivateKey, error) {
+	err := rc.replay("DestroyPhonon", nil)
+	if err != nil {
+		return nil, err
+	}
+	return ethcrypto.GenerateKey()
+}
+
+func (rc *ReplayCard) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	var res dataMsg
+	err := rc.replay("SendPhonons", &res)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, res.Len)
+	_, err = io.ReadFull(rand.Reader, packet)
+	return packet, err
+}
+
+func (rc *ReplayCard) ReceivePhonons(phononTransfer []byte) error {
+	return rc.replay("ReceivePhonons", nil)
+}
+
+func (rc *ReplayCard) SetReceiveList(phononPubKeys []*ecdsa.PublicKey) error {
+	return rc.replay("SetReceiveList", nil)
+}
+
+func (rc *ReplayCard) TransactionAck(keyIndices []model.PhononKeyIndex) error {
+	return rc.replay("TransactionAck", nil)
+}
+
+func (rc *ReplayCard) InitCardPairing(receiverCertificate cert.CardCertificate) ([]byte, error) {
+	var res dataMsg
+	err := rc.replay("InitCardPairing", &res)
+	if err != nil {
+		return nil, err
+	}
+	return redactedData(res)
+}
+
+func (rc *ReplayCard) CardPair(initPairingData []byte) ([]byte, error) {
+	var res dataMsg
+	err := rc.replay("CardPair", &res)
+	if err != nil {
+		return nil, err
+	}
+	return redactedData(res)
+}
+
+func (rc *ReplayCard) CardPair2(cardPairData []byte) ([]byte, error) {
+	var res dataMsg
+	err := rc.replay("CardPair2", &res)
+	if err != nil {
+		return nil, err
+	}
+	return redactedData(res)
+}
+
+func (rc *ReplayCard) FinalizeCardPair(cardPair2Data []byte) error {
+	return rc.replay("FinalizeCardPair", nil)
+}
+
+func (rc *ReplayCard) LoadCertAuthority(CAPubKey []byte) error {
+	return rc.replay("LoadCertAuthority", nil)
+}
+
+func (rc *ReplayCard) InstallCertificate(signKeyFunc func([]byte) ([]byte, error)) error {
+	return rc.replay("InstallCertificate", nil)
+}
+
+func (rc *ReplayCard) GenerateInvoice() ([]byte, error) {
+	var res dataMsg
+	err := rc.replay("GenerateInvoice", &res)
+	if err != nil {
+		return nil, err
+	}
+	invoice := make([]byte, res.Len)
+	_, err = io.ReadFull(rand.Reader, invoice)
+	return invoice, err
+}
+
+func (rc *ReplayCard) ReceiveInvoice(invoiceData []byte) error {
+	return rc.replay("ReceiveInvoice", nil)
+}
+
+func (rc *ReplayCard) SetFriendlyName(name string) error {
+	return rc.replay("SetFriendlyName", nil)
+}
+
+func (rc *ReplayCard) GetFriendlyName() (string, error) {
+	var res nameMsg
+	err := rc.replay("GetFriendlyName", &res)
+	return res.Name, err
+}
+
+func (rc *ReplayCard) GetAvailableMemory() (int, int, int, error) {
+	var res memoryResult
+	err := rc.replay("GetAvailableMemory", &res)
+	return res.Persistent, res.OnReset, res.OnDeselect, err
+}
+
+func (rc *ReplayCard) MineNativePhonon(difficulty uint8) (model.PhononKeyIndex, []byte, error) {
+	var res mineResult
+	err := rc.replay("MineNativePhonon", &res)
+	return res.KeyIndex, res.Hash, err
+}
@@ -0,0 +1,164 @@
+/*
+Package trace records the traffic between the client and a phonon card so that misbehaving hardware can be
+diagnosed after the fact, and replays recorded card sessions without hardware.
+
+A trace is a file of JSON lines. "apdu" entries hold the wire level command and response APDUs. Those sent over the
+secure channel are marked encrypted: phonon-core encrypts inside its command set, so the transport only ever sees
+their ciphertext. "call" entries hold the PhononCard method calls that produced
+those APDUs and are what the replay backend serves back to an orchestrator.Session. PINs, key material,
+certificates and card to card pairing payloads are redacted before anything is written.
+*/
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	KindCard = "card"
+	KindAPDU = "apdu"
+	KindCall = "call"
+)
+
+// Entry is a single line of a trace file
+type Entry struct {
+	Seq  int       `json:"seq"`
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// apdu entries
+	Command  *CommandAPDU  `json:"command,omitempty"`
+	Response *ResponseAPDU `json:"response,omitempty"`
+	// card and call entries
+	Method  string          `json:"method,omitempty"`
+	Args    json.RawMessage `json:"args,omitempty"`
+	Results json.RawMessage `json:"results,omitempty"`
+	Err     string          `json:"err,omitempty"`
+}
+
+type CommandAPDU struct {
+	Cla      byte     `json:"cla"`
+	Ins      byte     `json:"ins"`
+	P1       byte     `json:"p1"`
+	P2       byte     `json:"p2"`
+	Data     HexBytes `json:"data,omitempty"`
+	Redacted bool     `json:"redacted,omitempty"`
+	// Encrypted is set when the command and its response went over the secure channel
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+type ResponseAPDU struct {
+	Sw       uint16   `json:"sw"`
+	Data     HexBytes `json:"data,omitempty"`
+	Redacted bool     `json:"redacted,omitempty"`
+}
+
+// HexBytes marshals as a hex string rather than base64 so traces can be read next to APDU logs
+type HexBytes []byte
+
+func (b HexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(b))
+}
+
+func (b *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	*b, err = hex.DecodeString(s)
+	return err
+}
+
+var ErrRecorderClosed = errors.New("trace recorder is closed")
+
+/*
+Recorder writes a trace for one card. Wrap the card's transport with Channel and the command set built on top
+of it with Card; both write into the same trace so wire traffic and the calls that caused it stay in order.
+*/
+type Recorder struct {
+	w      io.WriteCloser
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	seq    int
+	closed bool
+	mtex   sync.Mutex
+}
+
+func NewRecorder(w io.WriteCloser) *Recorder {
+	buf := bufio.NewWriter(w)
+	return &Recorder{
+		w:   w,
+		buf: buf,
+		enc: json.NewEncoder(buf),
+	}
+}
+
+// Create opens a new trace file in dir named after the current time and name
+func Create(dir string, name string) (*Recorder, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	fileName := time.Now().UTC().Format("20060102T150405Z") + "-" + name + ".jsonl"
+	f, err := os.OpenFile(filepath.Join(dir, fileName), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewRecorder(f), nil
+}
+
+func (r *Recorder) write(e *Entry) error {
+	r.mtex.Lock()
+	defer r.mtex.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	r.seq += 1
+	e.Seq = r.seq
+	err := r.enc.Encode(e)
+	if err != nil {
+		return err
+	}
+	// flush every entry so the trace survives a crash, which is usually when it is needed
+	return r.buf.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mtex.Lock()
+	defer r.mtex.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.buf.Flush()
+	closeErr := r.w.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Read parses every entry of a trace
+func Read(rd io.Reader) ([]Entry, error) {
+	var entries []Entry
+	dec := json.NewDecoder(rd)
+	for {
+		var e Entry
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
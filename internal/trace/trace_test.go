@@ -0,0 +1,279 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/GridPlus/keycard-go/apdu"
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+)
+
+var update = flag.Bool("update", false, "record the session fixture in testdata again")
+
+const (
+	sessionFixture  = "testdata/session.jsonl"
+	outcomeFixture  = "testdata/session.outcome.json"
+	mockPin         = "111111"
+	fixtureCurrency = model.Ethereum
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// sessionOutcome is what driveSession observed, compared between recording and replay
+type sessionOutcome struct {
+	CardID   string
+	KeyIndex model.PhononKeyIndex
+	PubKey   string
+	Listed   []string
+	Err      string `json:",omitempty"`
+}
+
+// driveSession runs a session through unlocking, creating, describing, listing and destroying a phonon on card
+func driveSession(card model.PhononCard) sessionOutcome {
+	var out sessionOutcome
+	fail := func(err error) sessionOutcome {
+		out.Err = err.Error()
+		return out
+	}
+	sess, err := orchestrator.NewSession(card)
+	if err != nil {
+		return fail(err)
+	}
+	out.CardID = sess.GetCardId()
+	err = sess.VerifyPIN(mockPin)
+	if err != nil {
+		return fail(err)
+	}
+	keyIndex, pubKey, err := sess.CreatePhonon()
+	if err != nil {
+		return fail(err)
+	}
+	out.KeyIndex, out.PubKey = keyIndex, pubKey.String()
+	denomination, err := model.NewDenomination(big.NewInt(1000))
+	if err != nil {
+		return fail(err)
+	}
+	err = sess.SetDescriptor(&model.Phonon{KeyIndex: keyIndex, PubKey: pubKey, CurrencyType: fixtureCurrency, ChainID: 1, Denomination: denomination})
+	if err != nil {
+		return fail(err)
+	}
+	phonons, err := sess.ListPhonons(0, 0, 0)
+	if err != nil {
+		return fail(err)
+	}
+	for _, p := range phonons {
+		out.Listed = append(out.Listed, strings.Join([]string{
+			big.NewInt(int64(p.KeyIndex)).String(), big.NewInt(int64(p.CurrencyType)).String(), p.Denomination.Value().String(),
+		}, ":"))
+	}
+	got, err := sess.GetPhononPubKey(keyIndex, model.Secp256k1)
+	if err != nil {
+		return fail(err)
+	}
+	if got.String() != out.PubKey {
+		return fail(errors.New("public key read back differs from the one created"))
+	}
+	_, err = sess.DestroyPhonon(keyIndex)
+	if err != nil {
+		return fail(err)
+	}
+	return out
+}
+
+func newMock(t *testing.T) *mock.MockCard {
+	t.Helper()
+	c, err := mock.NewMockCard(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.(*mock.MockCard)
+}
+
+func writeJSON(t *testing.T, path string, v interface{}) {
+	t.Helper()
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, append(data, '\n'), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRecordSession records a session on a mock card, rewriting the fixture when run with -update
+func TestRecordSession(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(nopCloser{&buf})
+	m := newMock(t)
+	out := driveSession(r.Card(m, m.IdentityPubKey))
+	if out.Err != "" {
+		t.Fatal(out.Err)
+	}
+	err := r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), hex.EncodeToString([]byte(mockPin))) || strings.Contains(buf.String(), mockPin) {
+		t.Error("trace holds the PIN")
+	}
+	entries, err := Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Method == "Pair" {
+			var res certResult
+			json.Unmarshal(e.Results, &res)
+			if len(res.Cert) > 0 || !res.Redacted {
+				t.Errorf("Pair recorded the certificate: %s", e.Results)
+			}
+		}
+	}
+	if !*update {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(sessionFixture), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(sessionFixture, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeJSON(t, outcomeFixture, out)
+}
+
+// TestReplaySession drives a session through the recorded fixture without a card and expects what was recorded
+func TestReplaySession(t *testing.T) {
+	rc, err := OpenReplay(sessionFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(outcomeFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want sessionOutcome
+	err = json.Unmarshal(data, &want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := driveSession(rc)
+	gotJSON, _ := json.Marshal(got)
+	wantJSON, _ := json.Marshal(want)
+	if !bytes.Equal(gotJSON, wantJSON) {
+		t.Errorf("replayed session differs from the recording\n got: %s\nwant: %s", gotJSON, wantJSON)
+	}
+	if n := rc.Remaining(); n != 0 {
+		t.Errorf("%d recorded calls were not replayed", n)
+	}
+}
+
+func TestReplayOutOfOrder(t *testing.T) {
+	rc, err := OpenReplay(sessionFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rc.ListPhonons(0, 0, 0, false)
+	if !errors.Is(err, ErrTraceMismatch) {
+		t.Fatalf("expected ErrTraceMismatch, got %v", err)
+	}
+}
+
+func TestCardPairingRedacted(t *testing.T) {
+	sender, receiver := newMock(t), newMock(t)
+	for _, m := range []*mock.MockCard{sender, receiver} {
+		err := m.VerifyPIN(mockPin)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	r := NewRecorder(nopCloser{&buf})
+	traced := r.Card(sender, sender.IdentityPubKey)
+	initData, err := traced.InitCardPairing(receiver.IdentityCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairData, err := receiver.CardPair(initData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair2Data, err := traced.CardPair2(pairData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	trace := buf.String()
+	for name, secret := range map[string][]byte{
+		"receiver certificate": receiver.IdentityCert.Serialize(),
+		"pairing data":         initData,
+		"card pair data":       pairData,
+		"card pair 2 data":     pair2Data,
+	} {
+		if strings.Contains(trace, hex.EncodeToString(secret)) {
+			t.Errorf("trace holds the %s", name)
+		}
+	}
+
+	// replay stands in random bytes of the recorded length
+	rc, err := NewReplayCard(strings.NewReader(trace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := rc.InitCardPairing(receiver.IdentityCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != len(initData) || bytes.Equal(replayed, initData) {
+		t.Errorf("replayed pairing data should be %d random bytes", len(initData))
+	}
+}
+
+// echoChannel answers every command with its own data and 9000
+type echoChannel struct{}
+
+func (echoChannel) Send(cmd *apdu.Command) (*apdu.Response, error) {
+	return apdu.ParseResponse(append(append([]byte{}, cmd.Data...), 0x90, 0x00))
+}
+
+func TestSecureChannelMarked(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewRecorder(nopCloser{&buf})
+	ch := r.Channel(echoChannel{})
+	for _, ins := range []byte{insSelect, 0x56, insOpenSecureChannel, 0x56, insIdentifyCard, insSelect, 0x56} {
+		_, err := ch.Send(apdu.NewCommand(0x80, ins, 0x00, 0x00, []byte{0xAA}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.Close()
+
+	entries, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{false, false, false, true, false, false, false}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d apdu entries, got %d", len(want), len(entries))
+	}
+	for i, e := range entries {
+		if e.Command.Encrypted != want[i] {
+			t.Errorf("apdu %d, ins %x: expected encrypted to be %t", i, e.Command.Ins, want[i])
+		}
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Package validator checks that a phonon is backed by what it claims: that the address derived from its public key
+holds at least its denomination on its chain, as of a block with the chain's required confirmations. The card only
+knows what the phonon was described as, so this is the one check a receiver can make of a phonon it was sent.
+*/
+package validator
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/address"
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status names match the ValidationStatus values the frontend's PhononValidator shows
+type Status string
+
+const (
+	// could not be checked, see Reason
+	StatusUnvalidated Status = "unvalidated"
+	StatusValidating  Status = "validating"
+	StatusValid       Status = "valid"
+	StatusNotValid    Status = "not_valid"
+)
+
+const (
+	// how many phonons are checked against their chains at once, by ValidateAll and for received phonons
+	concurrency = 4
+	// how long validating one received phonon may take
+	receivedTimeout = time.Minute
+	// received phonons waiting to be validated. Phonons received beyond this are left unvalidated
+	receivedBacklog = 256
+)
+
+// Result is the outcome of validating one phonon
+type Result struct {
+	CardID       string
+	KeyIndex     model.PhononKeyIndex
+	PubKey       string
+	CurrencyType model.CurrencyType
+	ChainID      int
+	// the address derived from PubKey
+	Address string `json:",omitempty"`
+	// claimed value in base units
+	Denomination string
+	// balance of Address in base units at Block
+	Balance string `json:",omitempty"`
+	Block   uint64 `json:",omitempty"`
+	Status  Status
+	Reason  string `json:",omitempty"`
+	Checked time.Time
+}
+
+// Validator validates phonons and remembers the last result for each
+type Validator struct {
+	chains *onchain.Chains
+	mtex   sync.Mutex
+	// by card ID, then public key
+	results map[string]map[string]Result
+	// received phonons waiting for a worker
+	received chan receivedPhonon
+}
+
+type receivedPhonon struct {
+	cardID string
+	p      *model.Phonon
+}
+
+// New returns a Validator, starting the workers that validate received phonons
+func New(chains *onchain.Chains) *Validator {
+	v := &Validator{
+		chains:   chains,
+		results:  make(map[string]map[string]Result),
+		received: make(chan receivedPhonon, receivedBacklog),
+	}
+	for i := 0; i < concurrency; i++ {
+		go v.validateReceived()
+	}
+	return v
+}
+
+// card IDs and public keys are compared as lower case hex, as labels are
+func normalize(cardID, pubKey string) (string, string) {
+	return strings.ToLower(cardID), strings.ToLower(strings.TrimPrefix(pubKey, "0x"))
+}
+
+// Get returns the last result for the phonon with pubKey on cardID
+func (v *Validator) Get(cardID, pubKey string) (Result, bool) {
+	cardID, pubKey = normalize(cardID, pubKey)
+	v.mtex.Lock()
+	defer v.mtex.Unlock()
+	r, ok := v.results[cardID][pubKey]
+	return r, ok
+}
+
+func (v *Validator) store(r Result) {
+	cardID, pubKey := normalize(r.CardID, r.PubKey)
+	if pubKey == "" {
+		return
+	}
+	v.mtex.Lock()
+	defer v.mtex.Unlock()
+	if v.results[cardID] == nil {
+		v.results[cardID] = make(map[string]Result)
+	}
+	v.results[cardID][pubKey] = r
+}
+
+// Validate checks phonon p on cardID against its chain
+func (v *Validator) Validate(ctx context.Context, cardID string, p *model.Phonon) Result {
+	r := Result{
+		CardID:       cardID,
+		KeyIndex:     p.KeyIndex,
+		CurrencyType: p.CurrencyType,
+		ChainID:      p.ChainID,
+		Denomination: p.Denomination.Value().String(),
+		Status:       StatusValidating,
+	}
+	if p.PubKey != nil {
+		r.PubKey = p.PubKey.String()
+	}
+	v.store(r)
+	r = v.check(ctx, p, r)
+	r.Checked = time.Now().UTC()
+	v.store(r)
+	return r
+}
+
+// ValidateAll checks the phonons of cardID against their chains, a few at a time, returning results in their order
+func (v *Validator) ValidateAll(ctx context.Context, cardID string, phonons []*model.Phonon) []Result {
+	results := make([]Result, len(phonons))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(phonons); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = v.Validate(ctx, cardID, phonons[i])
+			}
+		}()
+	}
+	for i := range phonons {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
+
+func (v *Validator) check(ctx context.Context, p *model.Phonon, r Result) Result {
+	unvalidated := func(reason string) Result {
+		r.Status = StatusUnvalidated
+		r.Reason = reason
+		return r
+	}
+	if !address.EVM(p.CurrencyType) {
+		return unvalidated(fmt.Sprintf("currency type %d is not held on a chain this client can query", p.CurrencyType))
+	}
+	if !v.chains.Has(p.ChainID) {
+		return unvalidated(fmt.Sprintf("no RPC endpoint configured for chain %d", p.ChainID))
+	}
+	if p.PubKey == nil {
+		return unvalidated("the phonon's public key is unknown")
+	}
+	pubKey, err := model.PhononPubKeyToECDSA(p.PubKey)
+	if err != nil {
+		return unvalidated(err.Error())
+	}
+	addr := ethcrypto.PubkeyToAddress(*pubKey)
+	r.Address = addr.Hex()
+	balance, block, err := v.chains.ConfirmedBalance(ctx, p.ChainID, addr)
+	if err != nil {
+		return unvalidated(err.Error())
+	}
+	r.Balance = balance.String()
+	r.Block = block
+	if balance.Cmp(p.Denomination.Value()) < 0 {
+		r.Status = StatusNotValid
+		r.Reason = fmt.Sprintf("the address holds %s base units, less than the %s claimed", balance, r.Denomination)
+		return r
+	}
+	r.Status = StatusValid
+	return r
+}
+
+/*
+Received queues the phonons of received events to be validated in the background, so that phonons sent to a card are
+checked as they arrive. Subscribe it to the history ledger. It does not block: a phonon received while the backlog
+is full is left unvalidated.
+*/
+func (v *Validator) Received(events []history.Event) {
+	for _, e := range events {
+		if e.Kind != history.KindReceived || e.PubKey == "" || !address.EVM(e.CurrencyType) {
+			continue
+		}
+		p, err := eventPhonon(e)
+		if err != nil {
+			log.Errorf("unable to validate phonon %d received by card %s: %s", e.KeyIndex, e.CardID, err)
+			continue
+		}
+		select {
+		case v.received <- receivedPhonon{cardID: e.CardID, p: p}:
+		default:
+			log.Warnf("too many received phonons are waiting to be validated, phonon %d received by card %s is left unvalidated", e.KeyIndex, e.CardID)
+			v.store(Result{
+				CardID:       e.CardID,
+				KeyIndex:     p.KeyIndex,
+				PubKey:       p.PubKey.String(),
+				CurrencyType: p.CurrencyType,
+				ChainID:      p.ChainID,
+				Denomination: p.Denomination.Value().String(),
+				Status:       StatusUnvalidated,
+				Reason:       "too many received phonons were waiting to be validated",
+				Checked:      time.Now().UTC(),
+			})
+		}
+	}
+}
+
+// validateReceived validates queued received phonons one at a time, for as long as the process runs
+func (v *Validator) validateReceived() {
+	for rp := range v.received {
+		ctx, cancel := context.WithTimeout(context.Background(), receivedTimeout)
+		r := v.Validate(ctx, rp.cardID, rp.p)
+		cancel()
+		switch r.Status {
+		case StatusNotValid:
+			log.Warnf("phonon %d received by card %s is not valid: %s", r.KeyIndex, rp.cardID, r.Reason)
+		case StatusUnvalidated:
+			log.Debugf("phonon %d received by card %s was not validated: %s", r.KeyIndex, rp.cardID, r.Reason)
+		}
+	}
+}
+
+// eventPhonon rebuilds the phonon an event describes
+func eventPhonon(e history.Event) (*model.Phonon, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(e.PubKey, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := model.NewPhononPubKey(raw, model.Secp256k1)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := new(big.Int).SetString(e.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("unreadable amount %q", e.Amount)
+	}
+	denomination, err := model.NewDenomination(value)
+	if err != nil {
+		return nil, err
+	}
+	return &model.Phonon{
+		KeyIndex:     e.KeyIndex,
+		PubKey:       pubKey,
+		CurrencyType: e.CurrencyType,
+		ChainID:      e.ChainID,
+		Denomination: denomination,
+	}, nil
+}
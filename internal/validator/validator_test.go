@@ -0,0 +1,117 @@
+package validator
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/core"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+var chainID = int(params.AllEthashProtocolChanges.ChainID.Int64())
+
+// phonon returns a phonon of value on the simulated chain, and the key of its address
+func phonon(t *testing.T, keyIndex model.PhononKeyIndex, ct model.CurrencyType, value int64) (*model.Phonon, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ethcrypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := model.NewPhononPubKey(ethcrypto.FromECDSAPub(&key.PublicKey), model.Secp256k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denomination, err := model.NewDenomination(big.NewInt(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &model.Phonon{KeyIndex: keyIndex, PubKey: pubKey, CurrencyType: ct, ChainID: chainID, Denomination: denomination}, key
+}
+
+// simulated returns chains with a simulated chain holding balances at the addresses of keys
+func simulated(t *testing.T, balances map[*ecdsa.PrivateKey]int64) *onchain.Chains {
+	t.Helper()
+	alloc := make(core.GenesisAlloc)
+	for key, balance := range balances {
+		alloc[ethcrypto.PubkeyToAddress(key.PublicKey)] = core.GenesisAccount{Balance: big.NewInt(balance)}
+	}
+	sim := backends.NewSimulatedBackend(alloc, 8000000)
+	t.Cleanup(func() { sim.Close() })
+	chains, _ := onchain.New(nil)
+	chains.Register(chainID, sim, 1)
+	return chains
+}
+
+func TestValidateAll(t *testing.T) {
+	funded, fundedKey := phonon(t, 1, model.Ethereum, 1000)
+	short, shortKey := phonon(t, 2, model.Ethereum, 1000)
+	bitcoin, _ := phonon(t, 3, model.Bitcoin, 1000)
+	otherChain, _ := phonon(t, 4, model.Ethereum, 1000)
+	otherChain.ChainID = 5
+	v := New(simulated(t, map[*ecdsa.PrivateKey]int64{fundedKey: 1000, shortKey: 999}))
+
+	phonons := []*model.Phonon{funded, short, bitcoin, otherChain}
+	results := v.ValidateAll(context.Background(), "Card", phonons)
+	want := []Status{StatusValid, StatusNotValid, StatusUnvalidated, StatusUnvalidated}
+	for i, r := range results {
+		if r.KeyIndex != phonons[i].KeyIndex || r.Status != want[i] {
+			t.Errorf("phonon %d: expected %s, got %+v", phonons[i].KeyIndex, want[i], r)
+		}
+	}
+	if results[1].Balance != "999" || results[1].Reason == "" {
+		t.Errorf("expected the short balance and a reason, got %+v", results[1])
+	}
+	if r, ok := v.Get("card", "0x"+funded.PubKey.String()); !ok || r.Status != StatusValid {
+		t.Errorf("expected the last result to be kept, got %+v", r)
+	}
+}
+
+func TestReceived(t *testing.T) {
+	var events []history.Event
+	balances := make(map[*ecdsa.PrivateKey]int64)
+	for i := 1; i <= 10; i++ {
+		p, key := phonon(t, model.PhononKeyIndex(i), model.Ethereum, 100)
+		balances[key] = 100
+		events = append(events, history.PhononEvent(history.KindReceived, "card", p))
+	}
+	sent, _ := phonon(t, 11, model.Ethereum, 100)
+	events = append(events, history.PhononEvent(history.KindSent, "card", sent))
+	v := New(simulated(t, balances))
+	v.Received(events)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, e := range events[:10] {
+		for {
+			r, _ := v.Get("card", e.PubKey)
+			if r.Status == StatusValid {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("received phonon %d not validated: %+v", e.KeyIndex, r)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if _, ok := v.Get("card", sent.PubKey.String()); ok {
+		t.Error("a sent phonon should not be validated")
+	}
+}
+
+func TestReceivedBacklogFull(t *testing.T) {
+	// no workers and no room for a waiting phonon
+	v := &Validator{results: make(map[string]map[string]Result), received: make(chan receivedPhonon)}
+	p, _ := phonon(t, 1, model.Ethereum, 100)
+	v.Received([]history.Event{history.PhononEvent(history.KindReceived, "card", p)})
+	r, ok := v.Get("card", p.PubKey.String())
+	if !ok || r.Status != StatusUnvalidated || r.Reason == "" {
+		t.Errorf("a phonon that could not be queued should be left unvalidated, got %+v", r)
+	}
+}
@@ -35,6 +35,6 @@ func main() {
 
 	// initialize backends
 
-	gui.Server("8080", "", "", false, log.StandardLogger(), cfg.Certificate)
+	gui.Server("8080", "", "", false, log.StandardLogger(), cfg)
 
 }
@@ -0,0 +1,132 @@
+package gui
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+var baseUnitsPattern = regexp.MustCompile(`^[0-9]+$`)
+var decimalAmountPattern = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))?$`)
+
+/*
+parseBaseUnits reads an integer number of base units given as a JSON string or a JSON number. Anything but plain
+digits is rejected, including signs, fractions and exponents, since a JSON number would otherwise pass through a
+float and lose precision.
+*/
+func parseBaseUnits(raw json.RawMessage) (*big.Int, error) {
+	raw = bytes.TrimSpace(raw)
+	s := string(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		err := json.Unmarshal(raw, &s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseBaseUnitsString(s)
+}
+
+// parseBaseUnitsString reads an integer number of base units written in plain digits
+func parseBaseUnitsString(s string) (*big.Int, error) {
+	if !baseUnitsPattern.MatchString(s) {
+		return nil, fmt.Errorf("%q is not a whole number of base units", s)
+	}
+	v, _ := new(big.Int).SetString(s, 10)
+	return v, nil
+}
+
+/*
+parseDecimalAmount converts an amount written in whole currency units, such as "1.5", to base units of a currency
+with decimals places. Amounts with more fractional digits than that are rejected instead of rounded.
+*/
+func parseDecimalAmount(amount string, decimals int) (*big.Int, error) {
+	if decimals < 0 || decimals > registry.MaxDecimals {
+		return nil, fmt.Errorf("decimals must be between 0 and %d", registry.MaxDecimals)
+	}
+	m := decimalAmountPattern.FindStringSubmatch(amount)
+	if m == nil {
+		return nil, fmt.Errorf("%q is not a decimal amount", amount)
+	}
+	whole, frac := m[1], m[2]
+	if len(frac) > decimals {
+		return nil, fmt.Errorf("%q has more than %d decimal places", amount, decimals)
+	}
+	v, _ := new(big.Int).SetString(whole+frac+strings.Repeat("0", decimals-len(frac)), 10)
+	return v, nil
+}
+
+/*
+descriptorRequest sets a phonon's value either as base units or as a decimal amount in whole units of the currency.
+Decimals defaults to the registry's; when given it must agree with the registry, as a guard against a client that
+has the currency wrong.
+*/
+type descriptorRequest struct {
+	CurrencyType *model.CurrencyType `json:"currencyType"`
+	Value        json.RawMessage     `json:"value"`
+	Amount       string              `json:"amount"`
+	Decimals     *int                `json:"decimals"`
+}
+
+/*
+parseDescriptorRequest decodes and checks a setDescriptor body. Giving both value and amount, a currency missing from
+the registry and a value that is not exactly representable as a denomination are all errors, so nothing is written
+to the card on a doubtful request. Other fields are ignored, as they always were.
+*/
+func parseDescriptorRequest(body []byte, reg *registry.Registry) (model.CurrencyType, model.Denomination, error) {
+	var req descriptorRequest
+	dec := json.NewDecoder(bytes.NewReader(body))
+	err := dec.Decode(&req)
+	if err != nil {
+		return 0, model.Denomination{}, fmt.Errorf("unable to decode descriptor: %w", err)
+	}
+	if dec.More() {
+		return 0, model.Denomination{}, errors.New("unable to decode descriptor: trailing data after the JSON object")
+	}
+	if req.CurrencyType == nil {
+		return 0, model.Denomination{}, errors.New("currencyType is required")
+	}
+	currency, ok := reg.Currency(*req.CurrencyType)
+	if !ok {
+		return 0, model.Denomination{}, fmt.Errorf("unknown currency type %d, see /currencies", *req.CurrencyType)
+	}
+
+	var value *big.Int
+	switch {
+	case req.Value != nil && req.Amount != "":
+		return 0, model.Denomination{}, errors.New("give either value or amount, not both")
+	case req.Value != nil:
+		if req.Decimals != nil {
+			return 0, model.Denomination{}, errors.New("decimals only applies to amount")
+		}
+		value, err = parseBaseUnits(req.Value)
+	case req.Amount != "":
+		if req.Decimals != nil && *req.Decimals != currency.Decimals {
+			return 0, model.Denomination{}, fmt.Errorf("%s has %d decimals, not %d", currency.Ticker, currency.Decimals, *req.Decimals)
+		}
+		value, err = parseDecimalAmount(req.Amount, currency.Decimals)
+	default:
+		return 0, model.Denomination{}, errors.New("value or amount is required")
+	}
+	if err != nil {
+		return 0, model.Denomination{}, err
+	}
+	if value.Sign() == 0 {
+		return 0, model.Denomination{}, errors.New("a phonon's value must be greater than zero")
+	}
+	// NewDenomination consumes its argument
+	den, err := model.NewDenomination(new(big.Int).Set(value))
+	if err != nil {
+		return 0, model.Denomination{}, fmt.Errorf("%s base units cannot be stored as a phonon denomination: %w", value, err)
+	}
+	if den.Value().Cmp(value) != 0 {
+		return 0, model.Denomination{}, fmt.Errorf("%s base units cannot be stored exactly as a phonon denomination", value)
+	}
+	return *req.CurrencyType, den, nil
+}
@@ -0,0 +1,60 @@
+package gui
+
+import (
+	"testing"
+
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+func TestParseDescriptorRequest(t *testing.T) {
+	reg, err := registry.New(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		body         string
+		currencyType model.CurrencyType
+		value        string
+		wantErr      bool
+	}{
+		// the body older clients send
+		{`{"currencyType": 2, "value": 1000}`, model.Ethereum, "1000", false},
+		{`{"currencyType": 2, "value": "25500000000000000000"}`, model.Ethereum, "25500000000000000000", false},
+		{`{"currencyType": 1, "amount": "0.5"}`, model.Bitcoin, "50000000", false},
+		{`{"currencyType": 1, "amount": "0.5", "decimals": 8}`, model.Bitcoin, "50000000", false},
+		// fields setDescriptor does not use are ignored
+		{`{"currencyType": 2, "value": 1000, "keyIndex": 3, "curveType": 0}`, model.Ethereum, "1000", false},
+		{`{"currencyType": 2, "value": 1000, "amount": "1"}`, 0, "", true},
+		{`{"currencyType": 2, "value": 1000, "decimals": 18}`, 0, "", true},
+		{`{"currencyType": 1, "amount": "0.5", "decimals": 18}`, 0, "", true},
+		{`{"currencyType": 1, "amount": "0.000000001"}`, 0, "", true},
+		{`{"value": 1000}`, 0, "", true},
+		{`{"currencyType": 2}`, 0, "", true},
+		{`{"currencyType": 99, "value": 1000}`, 0, "", true},
+		{`{"currencyType": 2, "value": 0}`, 0, "", true},
+		{`{"currencyType": 2, "value": -5}`, 0, "", true},
+		{`{"currencyType": 2, "value": 1e3}`, 0, "", true},
+		{`{"currencyType": 2, "value": 1.5}`, 0, "", true},
+		// 256 base units cannot be written as a base of up to 255 times a power of ten
+		{`{"currencyType": 2, "value": 256}`, 0, "", true},
+		{`{"currencyType": 2, "value": 1000} {}`, 0, "", true},
+		{`not json`, 0, "", true},
+	}
+	for _, tt := range tests {
+		currencyType, den, err := parseDescriptorRequest([]byte(tt.body), reg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseDescriptorRequest(%s): expected an error, got %d %s", tt.body, currencyType, den.Value())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDescriptorRequest(%s): %s", tt.body, err)
+			continue
+		}
+		if currencyType != tt.currencyType || den.Value().String() != tt.value {
+			t.Errorf("parseDescriptorRequest(%s) = %d %s, want %d %s", tt.body, currencyType, den.Value(), tt.currencyType, tt.value)
+		}
+	}
+}
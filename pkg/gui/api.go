@@ -2,8 +2,12 @@ package gui
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -13,15 +17,33 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	keycardIO "github.com/GridPlus/keycard-go/io"
+	"github.com/GridPlus/keycard-go/types"
+	"github.com/GridPlus/phonon-client/internal/config"
+	"github.com/GridPlus/phonon-client/internal/contacts"
+	"github.com/GridPlus/phonon-client/internal/deposits"
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/jobs"
+	"github.com/GridPlus/phonon-client/internal/journal"
+	"github.com/GridPlus/phonon-client/internal/keycache"
+	"github.com/GridPlus/phonon-client/internal/keyexport"
+	"github.com/GridPlus/phonon-client/internal/labels"
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/GridPlus/phonon-client/internal/recovered"
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/GridPlus/phonon-client/internal/trace"
+	"github.com/GridPlus/phonon-client/internal/validator"
+	"github.com/PhononDAO/phonon-core/pkg/backend"
 	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
 	"github.com/PhononDAO/phonon-core/pkg/backend/smartcard"
 	"github.com/PhononDAO/phonon-core/pkg/backend/smartcard/usb"
 	"github.com/PhononDAO/phonon-core/pkg/model"
 	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
 	"github.com/ebfe/scard"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
 	"github.com/gorilla/mux"
 	"github.com/pkg/browser"
 	"github.com/rs/cors"
@@ -50,15 +72,140 @@ var manifest []byte
 var swagger embed.FS
 
 type apiSession struct {
-	t *orchestrator.PhononTerminal
+	t      *orchestrator.PhononTerminal
+	queues *cardQueues
+	// whether each session's card released the phonons of its last send
+	releases *releaseCards
+	timeouts operationTimeouts
+	jobs     *jobs.Store
+	journal  *journal.Journal
+	// transfer proposals between cards on this terminal
+	proposals *proposalBook
+	// previews of operations that destroy phonons
+	confirmations *confirmationBook
+	// browser origins allowed to call the endpoints that preview, destroy or hand out keys of phonons
+	origins  browserOrigins
+	registry *registry.Registry
+	pubKeys  *keycache.Cache
+	history  *history.Ledger
+	contacts *contacts.Book
+	labels   *labels.Store
+	// RPC endpoints of chains this client submits redeem transactions to, and the transactions it submitted
+	chains     *onchain.Chains
+	broadcasts *onchain.Tracker
+	// on chain checks of what phonons hold
+	validator *validator.Validator
+	// deposits followed until they are funded and finalized
+	deposits *deposits.Store
+	// keys of phonons destroyed for requests that went away, sealed until claimed
+	recovered *recovered.Store
 }
 
-func Server(port string, certFile string, keyFile string, autoGenMock bool, logger *log.Logger, certificate []byte) {
+func Server(port string, certFile string, keyFile string, autoGenMock bool, logger *log.Logger, cfg config.Config) {
 	// initialize orchestrator
 	//initialize cache map
 	var err error
 
-	session := apiSession{orchestrator.NewPhononTerminal()}
+	session := apiSession{
+		t:             orchestrator.NewPhononTerminal(),
+		queues:        newCardQueues(),
+		releases:      newReleaseCards(),
+		timeouts:      newOperationTimeouts(cfg.OperationTimeouts),
+		proposals:     newProposalBook(cfg.ProposalExpiry),
+		confirmations: newConfirmationBook(cfg.ConfirmationExpiry, cfg.ConfirmWithPIN),
+		origins:       newBrowserOrigins(port, certFile != "" && keyFile != "", cfg.AllowedOrigins),
+	}
+	session.registry, err = registry.New(cfg.Currencies, cfg.Chains)
+	if err != nil {
+		log.Error("unable to load currencies and chains from config, using the built-in ones: ", err)
+		session.registry, _ = registry.New(nil, nil)
+	}
+	session.chains, err = onchain.New(cfg.RPCEndpoints)
+	if err != nil {
+		log.Error("unable to load RPC endpoints from config, redeem transactions will not be broadcast: ", err)
+		session.chains, _ = onchain.New(nil)
+	}
+	broadcastsPath, err := config.DataPath("transactions.json")
+	if err == nil {
+		session.broadcasts, err = onchain.OpenTracker(session.chains, broadcastsPath)
+	}
+	if err != nil {
+		log.Error("unable to open submitted transactions, they will not be followed after a restart: ", err)
+		session.broadcasts, _ = onchain.OpenTracker(session.chains, "")
+	}
+	go session.broadcasts.Run(context.Background(), broadcastPollInterval)
+	session.validator = validator.New(session.chains)
+	jobsDir, err := config.DataPath("jobs")
+	if err == nil {
+		session.jobs, err = jobs.NewStore(jobsDir)
+	}
+	if err != nil {
+		log.Error("unable to open job store, jobs will not outlive the process: ", err)
+		session.jobs, _ = jobs.NewStore("")
+	}
+	journalPath, err := config.DataPath("journal", "transfers.jsonl")
+	if err == nil {
+		session.journal, err = journal.Open(journalPath)
+	}
+	if err != nil {
+		log.Error("unable to open transfer journal, transfers will not be recoverable after a crash: ", err)
+		session.journal, _ = journal.Open("")
+	}
+	historyPath, err := config.DataPath("history", "events.jsonl")
+	if err == nil {
+		session.history, err = history.Open(historyPath)
+	}
+	if err != nil {
+		log.Error("unable to open history ledger, events will not be kept after a restart: ", err)
+		session.history, _ = history.Open("")
+	}
+	// phonons received from other cards are checked against their chains as they arrive
+	session.history.Subscribe(session.validator.Received)
+	pubKeyDir, err := config.DataPath("pubkeys")
+	if err == nil {
+		session.pubKeys, err = keycache.Open(pubKeyDir)
+	}
+	if err != nil {
+		log.Error("unable to open public key cache, keys will be read from the card after a restart: ", err)
+		session.pubKeys, _ = keycache.Open("")
+	}
+	contactsPath, err := config.DataPath("contacts.json")
+	if err == nil {
+		session.contacts, err = contacts.Open(contactsPath)
+	}
+	if err != nil {
+		log.Error("unable to open address book, contacts will not be kept after a restart: ", err)
+		session.contacts, _ = contacts.Open("")
+	}
+	labelsPath, err := config.DataPath("labels.json")
+	if err == nil {
+		session.labels, err = labels.Open(labelsPath)
+	}
+	if err != nil {
+		log.Error("unable to open phonon labels, labels will not be kept after a restart: ", err)
+		session.labels, _ = labels.Open("")
+	}
+	session.history.Subscribe(session.labelOrigins)
+	depositsPath, err := config.DataPath("deposits.json")
+	if err == nil {
+		session.deposits, err = deposits.Open(depositsPath)
+	}
+	if err != nil {
+		log.Error("unable to open deposits, deposits will not be followed after a restart: ", err)
+		session.deposits, _ = deposits.Open("")
+	}
+	go session.watchDeposits(context.Background(), depositPollInterval)
+	recoveredPath, err := config.DataPath("recovered.json")
+	if err == nil {
+		session.recovered, err = recovered.Open(recoveredPath)
+	}
+	if err != nil {
+		log.Error("unable to open recovered keys, keys of phonons destroyed for abandoned requests will not be kept after a restart: ", err)
+		session.recovered, _ = recovered.Open("")
+	}
+	if pending := session.journal.List(false); len(pending) > 0 {
+		log.Warnf("%d journaled transfers are pending. They are reconciled when their card is unlocked", len(pending))
+	}
 	if autoGenMock {
 		//Start server with a m and ignore actual cards
 		var m model.PhononCard
@@ -68,7 +215,7 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 			return
 		}
 		var sess *orchestrator.Session
-		sess, err = orchestrator.NewSession(m)
+		sess, err = session.newSession(m)
 		if err != nil {
 			log.Error("unable to generate mock session during REST server startup: ", err)
 		}
@@ -81,9 +228,39 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 
 			log.Error("Unable to connect to local card readers: %s", err.Error)
 		}
-		for _, reader := range readers {
+		for i, reader := range readers {
+			var channel types.Channel = keycardIO.NewNormalChannel(reader)
+			var rec *trace.Recorder
+			if cfg.APDUTraceDir != "" {
+				rec, err = trace.Create(cfg.APDUTraceDir, fmt.Sprintf("reader%d", i))
+				if err != nil {
+					log.Error("unable to create apdu trace: ", err)
+				} else {
+					channel = rec.Channel(channel)
+				}
+			}
+			var card model.PhononCard = smartcard.NewPhononCommandSet(channel, cfg.Certificate, *logger)
+			// a card that cannot be identified is not used, since its transfers could not be journaled
+			var identityPubKey *ecdsa.PublicKey
+			var cardID string
+			identityPubKey, cardID, err = identifyCard(card)
+			if err != nil {
+				log.Errorf("unable to identify the card in reader %d, it will not be available: %s", i, err)
+				if rec != nil {
+					rec.Close()
+				}
+				continue
+			}
+			if rec != nil {
+				card = rec.Card(card, identityPubKey)
+			}
+			// mock cards are neither journaled nor key cached since their phonons do not outlive the process. For the
+			// same reason the phonons they receive or mine are not recorded in the history
+			card = session.journal.Card(card, cardID)
+			card = session.history.Card(card, cardID)
+			card = session.pubKeys.Card(card, cardID)
 			var sess *orchestrator.Session
-			sess, err = orchestrator.NewSession(smartcard.NewPhononCommandSet(keycardIO.NewNormalChannel(reader), certificate, *logger))
+			sess, err = session.newSession(card)
 			if err != nil {
 				log.Error("unable to connect to reader")
 			}
@@ -92,13 +269,12 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 	}
 	r := mux.NewRouter()
 
-	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "HEAD", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type", "Origin"},
+	handler := session.origins.corsHandler(r, cors.Options{
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "HEAD", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Origin", confirmationTokenHeader, confirmationPINHeader, jobTokenHeader, recoveryTokenHeader},
+		ExposedHeaders:   []string{"X-Next-Cursor"},
 		AllowCredentials: true,
 	})
-	handler := c.Handler(r)
 	// sessions
 	r.HandleFunc("/genMock", session.generatemock)
 	r.HandleFunc("/listSessions", session.listSessions)
@@ -106,13 +282,24 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 	r.HandleFunc("/cards/{sessionID}/unlock", session.unlock)
 	r.HandleFunc("/cards/{sessionID}/pair", session.pair)
 	r.HandleFunc("/cards/{sessionID}/name", session.setName)
+	r.HandleFunc("/cards/{sessionID}/queue", session.cardQueueStatus)
 	// phonons
 	r.HandleFunc("/cards/{sessionID}/listPhonons", session.listPhonons)
 	r.HandleFunc("/cards/{sessionID}/phonon/{PhononIndex}/setDescriptor", session.setDescriptor)
 	r.HandleFunc("/cards/{sessionID}/phonon/send", session.send)
+	r.HandleFunc("/cards/{sessionID}/phonon/sendAmount", session.sendAmount)
+	r.HandleFunc("/cards/{sessionID}/proposals", session.proposeTransfer).Methods("POST")
+	r.HandleFunc("/cards/{sessionID}/proposals/incoming", session.incomingProposals)
+	r.HandleFunc("/cards/{sessionID}/proposals/outgoing", session.outgoingProposals)
+	r.HandleFunc("/cards/{sessionID}/proposals/{proposalID}/accept", session.acceptProposal)
+	r.HandleFunc("/cards/{sessionID}/proposals/{proposalID}/reject", session.rejectProposal)
+	r.HandleFunc("/cards/{sessionID}/proposals/{proposalID}/cancel", session.cancelProposal)
 	r.HandleFunc("/cards/{sessionID}/phonon/create", session.createPhonon)
 	r.HandleFunc("/cards/{sessionID}/phonon/redeem", session.redeemPhonons)
+	r.HandleFunc("/cards/{sessionID}/phonon/redeem/preview", session.previewRedeem)
+	r.HandleFunc("/cards/{sessionID}/phonon/validate", session.validatePhonons)
 	r.HandleFunc("/cards/{sessionID}/phonon/{PhononIndex}/export", session.exportPhonon)
+	r.HandleFunc("/cards/{sessionID}/phonon/{PhononIndex}/export/preview", session.previewExport)
 	r.HandleFunc("/cards/{sessionID}/phonon/mineNative", session.mineNativePhonons)
 	r.HandleFunc("/cards/{sessionID}/phonon/mineNative/cancel", session.cancelMineRequest)
 	r.HandleFunc("/cards/{sessionID}/phonon/mineNative/status", session.listMiningReportStatus)
@@ -123,6 +310,38 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 	r.HandleFunc("/cards/{sessionID}/connectionStatus", session.RemoteConnectionStatus)
 	r.HandleFunc("/cards/{sessionID}/connectLocal", session.ConnectLocal)
 	r.HandleFunc("/checkDenomination", verifyDenomination)
+	r.HandleFunc("/planDenominations", session.planDenominations)
+	r.HandleFunc("/currencies", session.listCurrencies)
+	r.HandleFunc("/chains", session.listChains)
+	// transfer journal
+	r.HandleFunc("/journal", session.listTransfers)
+	r.HandleFunc("/journal/{transferID}/resolve", session.resolveTransfer)
+	// jobs
+	r.HandleFunc("/jobs", session.listJobs)
+	r.HandleFunc("/jobs/{jobID}", session.jobStatus)
+	r.HandleFunc("/jobs/{jobID}/claim", session.claimJobSecrets).Methods("POST")
+	r.HandleFunc("/recovered/claim", session.claimRecoveredKeys).Methods("POST")
+	// history
+	r.HandleFunc("/history", session.listHistory)
+	r.HandleFunc("/report", session.accountingReport)
+	r.HandleFunc("/transactions", session.listTransactions)
+	r.HandleFunc("/transactions/{txHash}", session.getTransaction)
+	// deposits
+	r.HandleFunc("/deposits", session.listDeposits)
+	r.HandleFunc("/deposits/{depositID}", session.getDeposit).Methods("GET")
+	r.HandleFunc("/deposits/{depositID}", session.removeDeposit).Methods("DELETE")
+	// address book
+	r.HandleFunc("/contacts", session.listContacts).Methods("GET")
+	r.HandleFunc("/contacts", session.addContact).Methods("POST")
+	r.HandleFunc("/contacts/{name}", session.getContact).Methods("GET")
+	r.HandleFunc("/contacts/{name}", session.updateContact).Methods("PUT")
+	r.HandleFunc("/contacts/{name}", session.removeContact).Methods("DELETE")
+	r.HandleFunc("/contacts/{name}/forgetCertificate", session.forgetContactCertificate).Methods("POST")
+	// phonon labels
+	r.HandleFunc("/labels", session.listLabels)
+	r.HandleFunc("/labels/{cardID}/{pubKey}", session.getLabel).Methods("GET")
+	r.HandleFunc("/labels/{cardID}/{pubKey}", session.setLabel).Methods("PUT")
+	r.HandleFunc("/labels/{cardID}/{pubKey}", session.deleteLabel).Methods("DELETE")
 	// api docs
 	r.PathPrefix("/swagger/").Handler(http.StripPrefix("/", http.FileServer(http.FS(swagger))))
 	r.HandleFunc("/swagger.json", serveAPIFunc(port))
@@ -178,6 +397,27 @@ func Server(port string, certFile string, keyFile string, autoGenMock bool, logg
 	SystrayIcon(port)
 }
 
+/*
+identifyCard selects the phonon applet and asks the card for its identity public key, returning it with the card ID
+the orchestrator derives from it. The card wrappers are given the ID from here rather than each asking the card.
+*/
+func identifyCard(card model.PhononCard) (*ecdsa.PublicKey, string, error) {
+	_, _, _, err := card.Select()
+	if err != nil {
+		return nil, "", err
+	}
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	pubKey, _, err := card.IdentifyCard(nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return pubKey, fmt.Sprintf("%x", ethcrypto.FromECDSAPub(pubKey))[:16], nil
+}
+
 func verifyDenomination(w http.ResponseWriter, r *http.Request) {
 	tocheckBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -271,11 +511,25 @@ func (apiSession apiSession) createPhonon(w http.ResponseWriter, r *http.Request
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	index, pubKey, err := sess.CreatePhonon()
+	op, ok := apiSession.lockCard(w, r, sess, "createPhonon")
+	if !ok {
+		return
+	}
+	defer op.done()
+	var index model.PhononKeyIndex
+	var pubKey model.PhononPubKey
+	err = op.run(func() (err error) {
+		index, pubKey, err = sess.CreatePhonon()
+		return err
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	apiSession.record(history.PhononEvent(history.KindCreated, sess.GetCardId(), &model.Phonon{KeyIndex: index, PubKey: pubKey}))
 
 	enc := json.NewEncoder(w)
 	enc.Encode(struct {
@@ -360,6 +614,11 @@ func (apiSession apiSession) mineNativePhonons(w http.ResponseWriter, r *http.Re
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "mineNativePhonon")
+	if !ok {
+		return
+	}
+	defer op.done()
 
 	type minePhononsRequest struct {
 		Difficulty uint8 `json:"difficulty"`
@@ -372,11 +631,20 @@ func (apiSession apiSession) mineNativePhonons(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	attemptId, err := sess.MineNativePhonon(req.Difficulty)
+	var attemptId string
+	err = op.run(func() (err error) {
+		attemptId, err = sess.MineNativePhonon(req.Difficulty)
+		return err
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// recorded while the card is still held, so that the next operation granted it sees mining has started
+	op.queue.setMining(attemptId)
 
 	type minePhononsResp struct {
 		AttemptId string
@@ -393,23 +661,54 @@ func (apiSession *apiSession) initDepositPhonons(w http.ResponseWriter, r *http.
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "initDeposit")
+	if !ok {
+		return
+	}
+	defer op.done()
 	var depositPhononReq struct {
 		Denominations []*model.Denomination
 		CurrencyType  model.CurrencyType
+		// chain the deposit is made on. Deposits on a chain with an RPC endpoint are followed and finalized once funded
+		ChainID int
 	}
 	err = json.NewDecoder(r.Body).Decode(&depositPhononReq)
 	if err != nil {
 		log.Error("unable to decode initDeposit request")
 		return
 	}
+	if _, ok := apiSession.registry.Currency(depositPhononReq.CurrencyType); !ok {
+		http.Error(w, fmt.Sprintf("unknown currency type %d, see /currencies", depositPhononReq.CurrencyType), http.StatusBadRequest)
+		return
+	}
+	if _, ok := apiSession.registry.Chain(depositPhononReq.ChainID); depositPhononReq.ChainID != 0 && !ok {
+		http.Error(w, fmt.Sprintf("unknown chain %d, see /chains", depositPhononReq.ChainID), http.StatusBadRequest)
+		return
+	}
 	log.Debug("depositPhononReq: ", depositPhononReq)
 	log.Debug("denoms: ", depositPhononReq.Denominations)
-	phonons, err := sess.InitDepositPhonons(depositPhononReq.CurrencyType, depositPhononReq.Denominations)
+	var phonons []*model.Phonon
+	err = op.run(func() (err error) {
+		phonons, err = sess.InitDepositPhonons(depositPhononReq.CurrencyType, depositPhononReq.Denominations)
+		return err
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		log.Error("unable to create phonons for deposit. err: ", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	var events []history.Event
+	for _, p := range phonons {
+		p.ChainID = depositPhononReq.ChainID
+		e := history.PhononEvent(history.KindCreated, sess.GetCardId(), p)
+		e.Note = "deposit initiated"
+		events = append(events, e)
+	}
+	apiSession.record(events...)
+	apiSession.watchDepositPhonons(sess.GetCardId(), phonons)
 
 	enc := json.NewEncoder(w)
 	err = enc.Encode(phonons)
@@ -434,10 +733,57 @@ func (apiSession apiSession) finalizeDepositPhonons(w http.ResponseWriter, r *ht
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	for i, dc := range depositConfirmations {
+		if dc.Phonon == nil {
+			http.Error(w, fmt.Sprintf("deposit confirmation %d has no phonon", i), http.StatusBadRequest)
+			return
+		}
+	}
+	if asyncRequested(r) {
+		apiSession.runJob(w, sess, "finalizeDeposit", len(depositConfirmations), func(op *operation, job *jobs.Job) (interface{}, error) {
+			if !sess.IsUnlocked() {
+				return nil, backend.ErrPINNotEntered
+			}
+			// finalized one at a time so the job reports progress and the outcome of each deposit
+			var lastErr error
+			for i, dc := range depositConfirmations {
+				dc, err := finalizeDeposit(op, sess, dc)
+				if _, _, abandoned := operationErrorStatus(err); abandoned {
+					return nil, err
+				}
+				if err != nil {
+					lastErr = err
+				}
+				apiSession.recordDeposits(sess.GetCardId(), dc)
+				job.SetItem(i, dc, err)
+			}
+			return nil, lastErr
+		})
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "finalizeDeposit")
+	if !ok {
+		return
+	}
+	defer op.done()
 
-	ret, err := sess.FinalizeDepositPhonons(depositConfirmations)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// finalized one at a time, as the orchestrator's FinalizeDepositPhonons only logs a phonon it could not destroy
+	ret := make([]orchestrator.DepositConfirmation, 0, len(depositConfirmations))
+	var failed []string
+	for _, dc := range depositConfirmations {
+		dc, err := finalizeDeposit(op, sess, dc)
+		if writeOperationError(w, op, err) {
+			apiSession.recordDeposits(sess.GetCardId(), ret...)
+			return
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%d: %s", dc.Phonon.KeyIndex, err))
+		}
+		ret = append(ret, dc)
+	}
+	apiSession.recordDeposits(sess.GetCardId(), ret...)
+	if len(failed) > 0 {
+		http.Error(w, "unable to finalize the deposits at key indices "+strings.Join(failed, ", "), http.StatusInternalServerError)
 		return
 	}
 	enc := json.NewEncoder(w)
@@ -449,16 +795,31 @@ func (apiSession apiSession) finalizeDepositPhonons(w http.ResponseWriter, r *ht
 	}
 }
 
+type redeemPhononRequest struct {
+	P             *model.Phonon
+	RedeemAddress string
+}
+
+type redeemPhononResp struct {
+	TransactionData string
+	PrivKey         string
+	Err             string
+	// set when the chain has an RPC endpoint and this client submitted the redeem transaction itself
+	TxHash string `json:",omitempty"`
+	// the signed transaction, to submit by hand if it was not accepted
+	SignedTransaction string               `json:",omitempty"`
+	Broadcast         *onchain.Transaction `json:",omitempty"`
+}
+
 func (apiSession apiSession) redeemPhonons(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
 	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	type redeemPhononRequest struct {
-		P             *model.Phonon
-		RedeemAddress string
-	}
 	var reqs []*redeemPhononRequest
 	err = json.NewDecoder(r.Body).Decode(&reqs)
 	if err != nil {
@@ -466,37 +827,82 @@ func (apiSession apiSession) redeemPhonons(w http.ResponseWriter, r *http.Reques
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if len(reqs) == 0 {
-		log.Error("request data empty")
-		http.Error(w, "empty request", http.StatusBadRequest)
+	keyIndices, addresses, err := redeemTargets(reqs)
+	if err != nil {
+		log.Error("invalid redeem request: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	for _, req := range reqs {
 		log.Debugf("received redeem phonon %+v", req.P)
 		log.Debug("received redeem address: ", req.RedeemAddress)
 	}
-	//TODO: Validate data contains what it needs to
-	type redeemPhononResp struct {
-		TransactionData string
-		PrivKey         string
-		Err             string
+	err = checkRedeemAddresses(reqs)
+	if writeRedeemError(w, nil, err) {
+		return
 	}
-	var resps []*redeemPhononResp
-	for _, req := range reqs {
-		var respErr string
-		var transactionData string
-		var privKeyString string
-		transactionData, privKeyString, err = sess.RedeemPhonon(req.P, req.RedeemAddress)
-		//If err capture the error message as a string, else return string value ""
-		if err != nil {
-			respErr = err.Error()
-		}
-		resps = append(resps, &redeemPhononResp{
-			TransactionData: transactionData,
-			PrivKey:         privKeyString,
-			Err:             respErr,
+	if dryRunRequested(r) {
+		apiSession.dryRunRedeem(w, r, sess, reqs, keyIndices)
+		return
+	}
+	confirmed, err := apiSession.confirmations.use(r.Header.Get(confirmationTokenHeader), confirmRedeem, sess.GetCardId(), keyIndices, addresses)
+	if writeConfirmationError(w, nil, err) {
+		return
+	}
+	pin := r.Header.Get(confirmationPINHeader)
+	if asyncRequested(r) {
+		apiSession.runJob(w, sess, "redeemPhonons", len(reqs), func(op *operation, job *jobs.Job) (interface{}, error) {
+			err := apiSession.verifyConfirmed(op, sess, confirmed, pin)
+			if err == nil {
+				err = matchRedeem(reqs, confirmed.Phonons)
+			}
+			if err != nil {
+				return nil, err
+			}
+			var failed int
+			abandonedErr := apiSession.redeemAll(op, sess, job.Token(), reqs, func(i int, resp *redeemPhononResp) {
+				var err error
+				if resp.Err != "" {
+					failed += 1
+					err = errors.New(resp.Err)
+				}
+				// the key is sealed for whoever started the job rather than kept with its results
+				if privKey := resp.PrivKey; privKey != "" {
+					resp.PrivKey = ""
+					sealErr := job.Seal(i, []byte(privKey))
+					if sealErr != nil {
+						log.Error("unable to seal redeemed key: ", sealErr)
+						apiSession.keepKey(job.Token(), sess.GetCardId(), reqs[i].P.KeyIndex, keyexport.FormatHex, privKey)
+					}
+				}
+				job.SetItem(i, resp, err)
+			})
+			if abandonedErr != nil {
+				return nil, abandonedErr
+			}
+			if failed > 0 {
+				return nil, fmt.Errorf("%d of %d redemptions failed", failed, len(reqs))
+			}
+			return nil, nil
 		})
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "redeemPhonons")
+	if !ok {
+		return
+	}
+	defer op.done()
+	err = apiSession.verifyConfirmed(op, sess, confirmed, pin)
+	if err == nil {
+		err = matchRedeem(reqs, confirmed.Phonons)
 	}
+	if writeRedeemError(w, op, err) {
+		return
+	}
+	var resps []*redeemPhononResp
+	abandonedErr := apiSession.redeemAll(op, sess, confirmed.Token, reqs, func(_ int, resp *redeemPhononResp) {
+		resps = append(resps, resp)
+	})
 
 	success := true
 	for _, res := range resps {
@@ -504,7 +910,9 @@ func (apiSession apiSession) redeemPhonons(w http.ResponseWriter, r *http.Reques
 			success = false
 		}
 	}
-	if !success {
+	if status, _, abandoned := operationErrorStatus(abandonedErr); abandoned {
+		w.WriteHeader(status)
+	} else if !success {
 		w.WriteHeader(http.StatusInternalServerError)
 	}
 
@@ -516,6 +924,58 @@ func (apiSession apiSession) redeemPhonons(w http.ResponseWriter, r *http.Reques
 	}
 }
 
+/*
+redeemAll redeems each request in turn and passes every outcome to report. Once a redemption is abandoned the rest
+are reported as not attempted and the error returned by op.run is returned. Keys that cannot be returned because the
+request went away are kept under token.
+*/
+func (apiSession apiSession) redeemAll(op *operation, sess *orchestrator.Session, token string, reqs []*redeemPhononRequest, report func(i int, resp *redeemPhononResp)) (abandonedErr error) {
+	for i, req := range reqs {
+		if abandonedErr != nil {
+			report(i, &redeemPhononResp{Err: "not attempted: " + operationError(op, abandonedErr).Error()})
+			continue
+		}
+		var resp *redeemPhononResp
+		var err error
+		if apiSession.sweeps(req.P) {
+			resp, err = apiSession.sweepRedeem(op, sess, token, req)
+		} else {
+			var transactionData string
+			var privKeyString string
+			err = op.runDestructive(func() (err error) {
+				transactionData, privKeyString, err = sess.RedeemPhonon(req.P, req.RedeemAddress)
+				return err
+			})
+			if privKeyString != "" && op.requestEnded() {
+				apiSession.keepKey(token, sess.GetCardId(), req.P.KeyIndex, keyexport.FormatHex, privKeyString)
+			}
+			resp = &redeemPhononResp{
+				TransactionData: transactionData,
+				PrivKey:         privKeyString,
+			}
+		}
+		if _, _, abandoned := operationErrorStatus(err); abandoned {
+			abandonedErr = err
+			err = operationError(op, err)
+		}
+		//If err capture the error message as a string, else return string value ""
+		if err != nil {
+			resp.Err = err.Error()
+		}
+		// once the key is out the phonon is gone, even if its transaction was not sent
+		if err == nil || resp.PrivKey != "" {
+			e := history.PhononEvent(history.KindRedeemed, sess.GetCardId(), req.P)
+			e.Counterparty = req.RedeemAddress
+			if resp.TxHash != "" {
+				e.Note = "swept in transaction " + resp.TxHash
+			}
+			apiSession.record(e)
+		}
+		report(i, resp)
+	}
+	return abandonedErr
+}
+
 func serveAPIFunc(port string) func(w http.ResponseWriter, r *http.Request) {
 	swaggerTemplateFile := string(swaggeryaml)
 	templ, err := template.New("swaggeryaml").Parse(swaggerTemplateFile)
@@ -577,6 +1037,11 @@ func (apiSession apiSession) init(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "init")
+	if !ok {
+		return
+	}
+	defer op.done()
 	if sess.IsInitialized() {
 		http.Error(w, "card is already initialized", http.StatusBadRequest)
 		return
@@ -594,7 +1059,12 @@ func (apiSession apiSession) init(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = sess.Init(initReq.Pin)
+	err = op.run(func() error {
+		return sess.Init(initReq.Pin)
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil && err.Error() != "bad response 6983: unexpected sw in secure channel" {
 		http.Error(w, fmt.Errorf("unable to initialize card with given PIN. err: %v", err).Error(), http.StatusInternalServerError)
 		return
@@ -608,6 +1078,11 @@ func (apiSession apiSession) unlock(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "unlock")
+	if !ok {
+		return
+	}
+	defer op.done()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Unable to read body", http.StatusBadRequest)
@@ -620,11 +1095,17 @@ func (apiSession apiSession) unlock(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
-	err = sess.VerifyPIN(unlockReq.Pin)
+	err = op.run(func() error {
+		return sess.VerifyPIN(unlockReq.Pin)
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to validate pin", http.StatusBadRequest)
 		return
 	}
+	apiSession.reconcileTransfers(op, sess)
 }
 func (apiSession apiSession) ConnectRemote(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -646,7 +1127,15 @@ func (apiSession apiSession) ConnectRemote(w http.ResponseWriter, r *http.Reques
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = sess.ConnectToRemoteProvider(ConnectionReq.URL)
+	op := apiSession.startOperation(r.Context(), "connectRemote")
+	defer op.done()
+	op.abandoned = remoteAbandoned(sess, op.name)
+	err = op.run(func() error {
+		return sess.ConnectToRemoteProvider(ConnectionReq.URL)
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -706,6 +1195,8 @@ func (apiSession apiSession) pair(w http.ResponseWriter, r *http.Request) {
 	}
 	pairReq := struct {
 		CardID string `json:"cardID"`
+		// name of a contact to pair with instead of a card ID
+		Contact string `json:"contact,omitempty"`
 	}{
 		CardID: "",
 	}
@@ -714,12 +1205,48 @@ func (apiSession apiSession) pair(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err = sess.ConnectToCounterparty(pairReq.CardID)
+	var jumpboxURL string
+	if pairReq.Contact != "" {
+		c, err := apiSession.contacts.Get(pairReq.Contact)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		pairReq.CardID = c.CardID
+		jumpboxURL = c.URL
+	}
+	if asyncRequested(r) {
+		apiSession.runJob(w, sess, "pair", 1, func(op *operation, job *jobs.Job) (interface{}, error) {
+			resp, err := apiSession.pairCounterparty(op, sess, pairReq.CardID, jumpboxURL, true)
+			if _, _, abandoned := operationErrorStatus(err); !abandoned {
+				job.SetItem(0, pairReq, err)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		})
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "pair")
+	if !ok {
+		return
+	}
+	defer op.done()
+	resp, err := apiSession.pairCounterparty(op, sess, pairReq.CardID, jumpboxURL, true)
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
+	enc := json.NewEncoder(w)
+	err = enc.Encode(resp)
+	if err != nil {
+		log.Error("unable to encode outgoing pair response")
+		return
+	}
 }
 
 func (apiSession apiSession) setName(w http.ResponseWriter, r *http.Request) {
@@ -729,6 +1256,11 @@ func (apiSession apiSession) setName(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "setName")
+	if !ok {
+		return
+	}
+	defer op.done()
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
@@ -742,7 +1274,12 @@ func (apiSession apiSession) setName(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
-	err = sess.SetName(nameReq.Name)
+	err = op.run(func() error {
+		return sess.SetName(nameReq.Name)
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -756,25 +1293,95 @@ func (apiSession apiSession) listPhonons(w http.ResponseWriter, r *http.Request)
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	q, err := parsePhononQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "listPhonons")
+	if !ok {
+		return
+	}
+	defer op.done()
 
 	var phonons []*model.Phonon
-	phonons, err = sess.ListPhonons(0, 0, 0)
+	err = op.run(func() (err error) {
+		phonons, err = sess.ListPhonons(q.cardFilter())
+		return err
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	for _, p := range phonons {
-		if p.PubKey == nil {
-			p.PubKey, err = sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+	// fills in public keys, reporting whether it succeeded
+	readPubKeys := func(phonons []*model.Phonon) bool {
+		for _, p := range phonons {
+			if p.PubKey != nil {
+				continue
+			}
+			var pubKey model.PhononPubKey
+			err = op.run(func() (err error) {
+				pubKey, err = sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+				return err
+			})
+			if writeOperationError(w, op, err) {
+				return false
+			}
+			p.PubKey = pubKey
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return false
+			}
+		}
+		return true
+	}
+	cardID := sess.GetCardId()
+	if q.Tag != "" {
+		// labels are keyed by public key, so every phonon's key is needed before filtering
+		if !readPubKeys(phonons) {
+			return
+		}
+		tagged := []*model.Phonon{}
+		for _, p := range phonons {
+			if l, ok := apiSession.labels.Get(cardID, p.PubKey.String()); ok && l.HasTag(q.Tag) {
+				tagged = append(tagged, p)
+			}
+		}
+		phonons = tagged
+	}
+	page, matching, next := q.apply(phonons)
+
+	if !q.SkipPubKeys && !readPubKeys(page) {
+		return
+	}
+	listed := make([]*listedPhonon, 0, len(page))
+	for _, p := range page {
+		lp := newListedPhonon(p)
+		if lp.PubKey != "" {
+			if l, ok := apiSession.labels.Get(cardID, lp.PubKey); ok {
+				lp.Label = &l
+			}
+			if v, ok := apiSession.validator.Get(cardID, lp.PubKey); ok {
+				lp.Validation = &v
 			}
 		}
+		listed = append(listed, lp)
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
 	}
 	enc := json.NewEncoder(w)
-	err = enc.Encode(phonons)
+	// details turn the response into an object with whole unit amounts and totals, so they are opt in
+	if r.URL.Query().Get("details") == "true" {
+		listing := describePhonons(apiSession.registry, listed, matching)
+		listing.NextCursor = next
+		err = enc.Encode(listing)
+	} else {
+		err = enc.Encode(listed)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -803,29 +1410,34 @@ func (apiSession apiSession) setDescriptor(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "unable to read body", http.StatusBadRequest)
 		return
 	}
-
-	inputs := struct {
-		CurrencyType int `json:"currencyType"`
-		Value        int `json:"value"`
-	}{}
-	json.Unmarshal(b, &inputs)
-
-	den, err := model.NewDenomination(big.NewInt(int64(inputs.Value)))
+	currencyType, den, err := parseDescriptorRequest(b, apiSession.registry)
 	if err != nil {
-		http.Error(w, "Unable to convert value to base and exponent form for phonon storage: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	op, ok := apiSession.lockCard(w, r, sess, "setDescriptor")
+	if !ok {
+		return
+	}
+	defer op.done()
 
 	p := &model.Phonon{
 		KeyIndex:     model.PhononKeyIndex(index),
 		Denomination: den,
-		CurrencyType: model.CurrencyType(inputs.CurrencyType),
+		CurrencyType: currencyType,
 	}
 	p.KeyIndex = model.PhononKeyIndex(index)
-	err = sess.SetDescriptor(p)
+	err = op.run(func() error {
+		return sess.SetDescriptor(p)
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to set descriptor", http.StatusBadRequest)
 		return
 	}
+	apiSession.record(history.PhononEvent(history.KindDescribed, sess.GetCardId(), p))
 }
 
 func (apiSession apiSession) send(w http.ResponseWriter, r *http.Request) {
@@ -835,32 +1447,122 @@ func (apiSession apiSession) send(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	inputs := []model.Phonon{}
 	bodyBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	json.Unmarshal(bodyBytes, &inputs)
-	toSend := []model.PhononKeyIndex{}
-	for _, phonon2send := range inputs {
-		toSend = append(toSend, phonon2send.KeyIndex)
-	}
-	err = sess.SendPhonons(toSend)
-
+	reqs, err := parseSendRequest(bodyBytes)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var contact *contacts.Contact
+	if name := r.URL.Query().Get("contact"); name != "" {
+		c, err := apiSession.contacts.Get(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		contact = &c
+	}
+	allowChange := certificateChangeAllowed(r)
+	if asyncRequested(r) {
+		apiSession.runJob(w, sess, "send", len(reqs), func(op *operation, job *jobs.Job) (interface{}, error) {
+			if contact != nil {
+				_, err := apiSession.pairContact(op, sess, *contact, allowChange)
+				if err != nil {
+					return nil, err
+				}
+			}
+			resp, err := apiSession.sendWithResults(op, sess, reqs)
+			if _, _, abandoned := operationErrorStatus(err); abandoned {
+				return nil, err
+			}
+			for i, res := range resp.Results {
+				var itemErr error
+				if res.Status != sendStatusSent {
+					itemErr = errors.New(string(res.Status))
+				}
+				job.SetItem(i, res, itemErr)
+			}
+			return resp.Acknowledgement, err
+		})
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "send")
+	if !ok {
+		return
+	}
+	defer op.done()
+	var warning string
+	if contact != nil {
+		warning, err = apiSession.pairContact(op, sess, *contact, allowChange)
+		if writeOperationError(w, op, err) {
+			return
+		}
+		if errors.Is(err, ErrCertificateChanged) {
+			http.Error(w, err.Error()+". Nothing was sent; pass allowCertificateChange=true to send anyway", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to pair with contact %q: %s", contact.Name, err), http.StatusBadGateway)
+			return
+		}
+	}
+	resp, err := apiSession.sendWithResults(op, sess, reqs)
+	resp.CounterpartyWarning = warning
+	if writeOperationError(w, op, err) {
+		return
+	}
+	switch {
+	case err == nil:
+	case err == ErrSendInvalid:
+		w.WriteHeader(http.StatusBadRequest)
+	case len(resp.Results) == 0:
+		// the card could not be checked, so there are no per-phonon results
 		http.Error(w, "unable to send phonons: "+err.Error(), http.StatusInternalServerError)
 		return
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(resp)
+	if err != nil {
+		log.Error("unable to encode outgoing send response")
+		return
 	}
 }
 
 func (apiSession apiSession) exportPhonon(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
 	vars := mux.Vars(r)
 	sess, err := apiSession.sessionFromMuxVars(vars)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+	// the key is encoded after the phonon is destroyed, so the options are checked first
+	var opts keyexport.Options
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &opts)
+		if err != nil {
+			http.Error(w, "unable to decode export options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	err = opts.Check()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	phononIndex, ok := vars["PhononIndex"]
 	if !ok {
 		http.Error(w, "Phonon not found", http.StatusNotFound)
@@ -871,14 +1573,71 @@ func (apiSession apiSession) exportPhonon(w http.ResponseWriter, r *http.Request
 		http.Error(w, "Unable to convert index to int:"+err.Error(), http.StatusBadRequest)
 		return
 	}
-	privkey, err := sess.DestroyPhonon(model.PhononKeyIndex(index))
+	confirmed, err := apiSession.confirmations.use(r.Header.Get(confirmationTokenHeader), confirmExport, sess.GetCardId(), []model.PhononKeyIndex{model.PhononKeyIndex(index)}, nil)
+	if writeConfirmationError(w, nil, err) {
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "exportPhonon")
+	if !ok {
+		return
+	}
+	defer op.done()
+	err = apiSession.verifyConfirmed(op, sess, confirmed, r.Header.Get(confirmationPINHeader))
+	if writeConfirmationError(w, op, err) {
+		return
+	}
+	// looked up before the phonon is gone, for the history
+	exported := apiSession.phononDetails(op, sess, model.PhononKeyIndex(index))
+	var privkey *ecdsa.PrivateKey
+	err = op.runDestructive(func() (err error) {
+		privkey, err = sess.DestroyPhonon(model.PhononKeyIndex(index))
+		return err
+	})
+	if err == nil && op.requestEnded() {
+		format, key, err := exportKey(privkey, opts)
+		if key == nil {
+			log.Errorf("the key of key index %d of card %s could not be exported as %s and is lost: %s", index, sess.GetCardId(), opts.Format, err)
+			return
+		}
+		if err != nil {
+			log.Error("unable to encode exported key: ", err)
+		}
+		apiSession.keepKey(confirmed.Token, sess.GetCardId(), model.PhononKeyIndex(index), format, keyString(key))
+		return
+	}
+	if writeOperationError(w, op, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "Unable to redeem phonon: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	format, key, err := exportKey(privkey, opts)
+	e := history.PhononEvent(history.KindExported, sess.GetCardId(), exported)
+	if format != keyexport.FormatHex {
+		e.Note = "exported as " + string(format)
+	}
+	apiSession.record(e)
+	if key == nil {
+		log.Error("unable to encode exported key: ", err)
+		http.Error(w, fmt.Sprintf("the phonon was destroyed but its key could not be exported as %s: %s", opts.Format, err), http.StatusInternalServerError)
+		return
+	}
 	ret := struct {
-		PrivateKey string `json:"privateKey"`
-	}{PrivateKey: fmt.Sprintf("%x", privkey.D)}
+		PrivateKey string      `json:"privateKey,omitempty"`
+		Format     string      `json:"format"`
+		Key        interface{} `json:"key,omitempty"`
+		Error      string      `json:"error,omitempty"`
+	}{Format: string(format)}
+	if format == keyexport.FormatHex {
+		ret.PrivateKey = key.(string)
+	} else {
+		ret.Key = key
+	}
+	if err != nil {
+		log.Error("unable to encode exported key: ", err)
+		ret.Error = fmt.Sprintf("unable to export the key as %s, returning it as %s: %s", opts.Format, format, err)
+	}
 	enc := json.NewEncoder(w)
 	err = enc.Encode(ret)
 	if err != nil {
@@ -887,18 +1646,73 @@ func (apiSession apiSession) exportPhonon(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// keyString returns a key encoded by keyexport as a string, the JSON of a keystore file or encrypted blob
+func keyString(key interface{}) string {
+	if s, ok := key.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(key)
+	return string(data)
+}
+
+/*
+exportKey encodes the key of an exported phonon as opts ask. The phonon is already gone, so when that fails the key
+is encoded another way rather than lost, though never with less protection than was asked for: a key asked for under
+a passphrase falls back to the encrypted format under the same passphrase, and only a key asked for without one falls
+back to hex. The error is returned with the fallback, and the key is nil when even the fallback could not be made.
+*/
+func exportKey(privkey *ecdsa.PrivateKey, opts keyexport.Options) (keyexport.Format, interface{}, error) {
+	format := opts.Format
+	if format == "" {
+		format = keyexport.FormatHex
+	}
+	key, err := keyexport.Export(privkey, opts)
+	if err == nil {
+		return format, key, nil
+	}
+	switch format {
+	case keyexport.FormatEncrypted:
+		return format, nil, err
+	case keyexport.FormatKeystore:
+		blob, blobErr := keyexport.Encrypt(ethcrypto.FromECDSA(privkey), opts.Passphrase)
+		if blobErr != nil {
+			return format, nil, err
+		}
+		return keyexport.FormatEncrypted, blob, err
+	}
+	return keyexport.FormatHex, fmt.Sprintf("%x", ethcrypto.FromECDSA(privkey)), err
+}
+
 func (apiSession apiSession) generatemock(w http.ResponseWriter, r *http.Request) {
-	m, err := mock.NewMockCard(true, false)
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "unable to generate mock", http.StatusInternalServerError)
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
 		return
 	}
-	sess, err := orchestrator.NewSession(m)
+	var opts mockCardOptions
+	if len(bytes.TrimSpace(body)) > 0 {
+		err = json.Unmarshal(body, &opts)
+		if err != nil {
+			http.Error(w, "unable to decode mock options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	m, err := newMockCard(opts)
+	if err != nil {
+		http.Error(w, "unable to generate mock: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	sess, err := apiSession.newSession(m)
 	if err != nil {
 		http.Error(w, "unable to generate mock session", http.StatusInternalServerError)
 		return
 	}
 	apiSession.t.AddSession(sess)
+
+	enc := json.NewEncoder(w)
+	enc.Encode(struct {
+		CardID string `json:"cardID"`
+	}{CardID: sess.GetCardId()})
 }
 
 func (apiSession apiSession) sessionFromMuxVars(p map[string]string) (*orchestrator.Session, error) {
@@ -0,0 +1,131 @@
+package gui
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/address"
+	"github.com/GridPlus/phonon-client/internal/keyexport"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often submitted transactions are checked for confirmations
+const broadcastPollInterval = 15 * time.Second
+
+/*
+sweepSendTimeout bounds submitting a signed sweep. It does not follow the operation's deadline: once the phonon is
+destroyed the sweep should still be sent if the request has gone away.
+*/
+const sweepSendTimeout = 30 * time.Second
+
+// sweeps reports whether redeeming p is signed and submitted by this client rather than the card's chain service
+func (apiSession apiSession) sweeps(p *model.Phonon) bool {
+	return address.EVM(p.CurrencyType) && apiSession.chains.Has(p.ChainID)
+}
+
+/*
+sweepRedeem redeems the phonon of req by destroying it and sending the whole balance of its address to the redeem
+address through the chain's RPC endpoint. The balance is checked before the phonon is destroyed. Once it is, the
+response carries the private key whatever else fails, and the signed transaction if it could not be submitted. The
+key is kept under token when the request has gone away.
+*/
+func (apiSession apiSession) sweepRedeem(op *operation, sess *orchestrator.Session, token string, req *redeemPhononRequest) (*redeemPhononResp, error) {
+	resp := &redeemPhononResp{}
+	pubKey, err := model.PhononPubKeyToECDSA(req.P.PubKey)
+	if err != nil {
+		return resp, err
+	}
+	sweep, err := apiSession.chains.PlanSweep(op.ctx, req.P.ChainID, ethcrypto.PubkeyToAddress(*pubKey), common.HexToAddress(req.RedeemAddress))
+	if err != nil {
+		return resp, err
+	}
+	var privKey *ecdsa.PrivateKey
+	err = op.runDestructive(func() (err error) {
+		privKey, err = sess.DestroyPhonon(req.P.KeyIndex)
+		return err
+	})
+	if err != nil {
+		return resp, err
+	}
+	resp.PrivKey = fmt.Sprintf("%x", ethcrypto.FromECDSA(privKey))
+	if op.requestEnded() {
+		apiSession.keepKey(token, sess.GetCardId(), req.P.KeyIndex, keyexport.FormatHex, resp.PrivKey)
+	}
+	tx, err := sweep.Sign(privKey)
+	if err != nil {
+		return resp, fmt.Errorf("phonon destroyed but its sweep could not be signed, claim it with the private key: %w", err)
+	}
+	raw, err := tx.MarshalBinary()
+	if err != nil {
+		return resp, fmt.Errorf("phonon destroyed but its sweep could not be encoded, claim it with the private key: %w", err)
+	}
+	resp.SignedTransaction = hexutil.Encode(raw)
+	ctx, cancel := context.WithTimeout(context.Background(), sweepSendTimeout)
+	defer cancel()
+	err = apiSession.chains.Send(ctx, req.P.ChainID, tx)
+	if err != nil {
+		return resp, fmt.Errorf("phonon destroyed but its sweep was not accepted, submit SignedTransaction or claim it with the private key: %w", err)
+	}
+	resp.TransactionData = tx.Hash().Hex()
+	resp.TxHash = tx.Hash().Hex()
+	tracked := apiSession.broadcasts.Track(req.P.ChainID, tx.Hash(), fmt.Sprintf("redeemed key index %d of card %s", req.P.KeyIndex, sess.GetCardId()))
+	resp.Broadcast = &tracked
+	return resp, nil
+}
+
+// planSweep fills in what the chain reports about a sweep for a dry run, or why it would be refused
+func (apiSession apiSession) planSweep(ctx context.Context, p *model.Phonon, plan *redeemPlan) {
+	tx := plan.Transaction
+	sweep, err := apiSession.chains.PlanSweep(ctx, p.ChainID, common.HexToAddress(tx.From), common.HexToAddress(tx.To))
+	if err != nil {
+		plan.Err = err.Error()
+	}
+	if sweep == nil {
+		return
+	}
+	tx.Broadcast = true
+	tx.Nonce = &sweep.Nonce
+	tx.Balance = sweep.Balance.String()
+	tx.GasPrice = sweep.GasPrice.String()
+	tx.Fee = sweep.Fee.String()
+	if sweep.Value.Sign() > 0 {
+		tx.Value = sweep.Value.String()
+	}
+}
+
+func (apiSession apiSession) listTransactions(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.broadcasts.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) getTransaction(w http.ResponseWriter, r *http.Request) {
+	hash, err := hexutil.Decode(mux.Vars(r)["txHash"])
+	if err != nil || len(hash) != common.HashLength {
+		http.Error(w, "transaction hash must be 32 bytes of 0x prefixed hex", http.StatusBadRequest)
+		return
+	}
+	tx, ok := apiSession.broadcasts.Get(common.BytesToHash(hash))
+	if !ok {
+		http.Error(w, "transaction not submitted by this client", http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(tx)
+	if err != nil {
+		log.Error("unable to encode transaction: ", err)
+	}
+}
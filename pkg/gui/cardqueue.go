@@ -0,0 +1,261 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// the most requests allowed to wait on a single card before new ones are turned away
+const maxQueuedCardOperations = 16
+
+// nginx's convention for a client that went away before the response was written
+const statusClientClosedRequest = 499
+
+var ErrCardBusy = errors.New("card is busy with another operation")
+var ErrCardMining = errors.New("card is busy mining a native phonon")
+
+/*
+cardQueue serialises access to one card. HTTP handlers run on their own goroutines and the orchestrator only
+guards individual card commands, so without the queue a listing could interleave with the APDUs of a send.
+Operations are granted the card in the order they arrive.
+*/
+type cardQueue struct {
+	mtex    sync.Mutex
+	current *cardOperation
+	waiting []*cardOperation
+	// id of the mining attempt last started on the card. Mining holds the card until it finishes or is cancelled
+	miningAttemptID string
+	// the last operation whose call outlived its request
+	abandoned *abandonedOperation
+}
+
+type cardOperation struct {
+	Operation string
+	Since     time.Time
+	ready     chan struct{}
+}
+
+type cardQueues struct {
+	mtex   sync.Mutex
+	queues map[string]*cardQueue
+}
+
+func newCardQueues() *cardQueues {
+	return &cardQueues{queues: make(map[string]*cardQueue)}
+}
+
+func (cq *cardQueues) get(cardID string) *cardQueue {
+	cq.mtex.Lock()
+	defer cq.mtex.Unlock()
+	q, ok := cq.queues[cardID]
+	if !ok {
+		q = &cardQueue{}
+		cq.queues[cardID] = q
+	}
+	return q
+}
+
+/*
+acquire waits until the card is free for op and returns a function releasing it again. When wait is false, or
+too many operations are already queued, a busy card is reported with ErrCardBusy instead of waiting. A card found
+mining once granted is given up again with ErrCardMining. Cancelling ctx abandons the wait.
+*/
+func (q *cardQueue) acquire(ctx context.Context, sess *orchestrator.Session, op string, wait bool) (release func(), err error) {
+	o := &cardOperation{
+		Operation: op,
+		Since:     time.Now(),
+		ready:     make(chan struct{}),
+	}
+	q.mtex.Lock()
+	if q.current == nil && len(q.waiting) == 0 {
+		q.current = o
+		q.mtex.Unlock()
+		return q.granted(sess, o)
+	}
+	if !wait || len(q.waiting) >= maxQueuedCardOperations {
+		q.mtex.Unlock()
+		return nil, ErrCardBusy
+	}
+	q.waiting = append(q.waiting, o)
+	q.mtex.Unlock()
+
+	select {
+	case <-o.ready:
+		return q.granted(sess, o)
+	case <-ctx.Done():
+		q.mtex.Lock()
+		granted := q.current == o
+		if !granted {
+			for i, waiting := range q.waiting {
+				if waiting == o {
+					q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+					break
+				}
+			}
+		}
+		q.mtex.Unlock()
+		// the card may have been handed over while the request was being cancelled
+		if granted {
+			q.releaseFunc(o)()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+/*
+granted checks that the card q has just handed to o is not mining before o uses it. The check is only made once the
+card is held: mining may have been started by the operation that held it while o was waiting.
+*/
+func (q *cardQueue) granted(sess *orchestrator.Session, o *cardOperation) (release func(), err error) {
+	release = q.releaseFunc(o)
+	q.mtex.Lock()
+	mining := q.miningActive(sess)
+	q.mtex.Unlock()
+	if mining {
+		release()
+		return nil, ErrCardMining
+	}
+	return release, nil
+}
+
+func (q *cardQueue) releaseFunc(o *cardOperation) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.mtex.Lock()
+			defer q.mtex.Unlock()
+			if q.current != o {
+				return
+			}
+			q.current = nil
+			if len(q.waiting) > 0 {
+				q.current = q.waiting[0]
+				q.waiting = q.waiting[1:]
+				close(q.current.ready)
+			}
+		})
+	}
+}
+
+// miningActive reports whether the last mining attempt on the card is still running. Must be called with q.mtex held
+func (q *cardQueue) miningActive(sess *orchestrator.Session) bool {
+	if q.miningAttemptID == "" {
+		return false
+	}
+	report, err := sess.GetMiningReport(q.miningAttemptID)
+	// a report is only written once the first attempt finishes, so a missing report means mining has just started
+	if err == orchestrator.ErrMiningReportNotAvailable {
+		return true
+	}
+	if err == nil && report.Status == orchestrator.StatusMiningActive {
+		return true
+	}
+	q.miningAttemptID = ""
+	return false
+}
+
+func (q *cardQueue) setMining(attemptID string) {
+	q.mtex.Lock()
+	q.miningAttemptID = attemptID
+	q.mtex.Unlock()
+}
+
+type queuedOperationStatus struct {
+	Position  int
+	Operation string
+	Since     time.Time
+}
+
+type cardQueueStatus struct {
+	Busy      bool
+	Mining    bool
+	Operation string    `json:",omitempty"`
+	Since     time.Time `json:",omitempty"`
+	Waiting   []queuedOperationStatus
+	Abandoned *abandonedOperation `json:",omitempty"`
+}
+
+func (q *cardQueue) status(sess *orchestrator.Session) cardQueueStatus {
+	q.mtex.Lock()
+	defer q.mtex.Unlock()
+	s := cardQueueStatus{
+		Mining:  q.miningActive(sess),
+		Waiting: make([]queuedOperationStatus, 0, len(q.waiting)),
+	}
+	if q.current != nil {
+		s.Operation = q.current.Operation
+		s.Since = q.current.Since
+	}
+	if q.abandoned != nil {
+		a := *q.abandoned
+		s.Abandoned = &a
+	}
+	s.Busy = s.Mining || q.current != nil
+	for i, o := range q.waiting {
+		s.Waiting = append(s.Waiting, queuedOperationStatus{
+			Position:  i + 1,
+			Operation: o.Operation,
+			Since:     o.Since,
+		})
+	}
+	return s
+}
+
+/*
+lockCard starts the operation op and queues it for exclusive use of the session's card, waiting unless the request
+carries wait=false. Time spent waiting counts towards the operation's deadline. If the card cannot be locked the
+error response has already been written and ok is false; otherwise the caller must call o.done.
+*/
+func (apiSession apiSession) lockCard(w http.ResponseWriter, r *http.Request, sess *orchestrator.Session, op string) (o *operation, ok bool) {
+	o = apiSession.startOperation(r.Context(), op)
+	wait := r.URL.Query().Get("wait") != "false"
+	err := apiSession.acquireCard(o, sess, wait)
+	switch err {
+	case nil:
+		return o, true
+	case ErrCardBusy, ErrCardMining:
+		writeAPIError(w, http.StatusConflict, errKeyCardBusy, err.Error())
+	case context.DeadlineExceeded:
+		writeAPIError(w, http.StatusGatewayTimeout, errKeyOperationTimeout, "timed out waiting for card")
+	case context.Canceled:
+		log.Debugf("%s request abandoned while waiting for card: %s", op, err)
+		writeAPIError(w, statusClientClosedRequest, errKeyRequestCancelled, "request cancelled while waiting for card")
+	default:
+		writeAPIError(w, http.StatusInternalServerError, errKeyUnknown, err.Error())
+	}
+	return nil, false
+}
+
+// acquireCard queues o for exclusive use of the session's card. On error the operation has been ended
+func (apiSession apiSession) acquireCard(o *operation, sess *orchestrator.Session, wait bool) error {
+	q := apiSession.queues.get(sess.GetCardId())
+	release, err := q.acquire(o.ctx, sess, o.name, wait)
+	if err != nil {
+		o.cancel()
+		return err
+	}
+	o.queue, o.release = q, release
+	o.abandoned = func() func(error) {
+		return q.abandon(sess, o.name)
+	}
+	return nil
+}
+
+func (apiSession apiSession) cardQueueStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sess, err := apiSession.sessionFromMuxVars(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(apiSession.queues.get(sess.GetCardId()).status(sess))
+}
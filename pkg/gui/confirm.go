@@ -0,0 +1,381 @@
+package gui
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long a confirmation token stays valid when the config does not say
+const defaultConfirmationExpiry = 2 * time.Minute
+
+// headers carrying the confirmation of a destructive operation
+const (
+	confirmationTokenHeader = "X-Confirmation-Token"
+	confirmationPINHeader   = "X-Confirmation-PIN"
+)
+
+// operations that need confirmation
+const (
+	confirmExport = "export"
+	confirmRedeem = "redeem"
+	// sending the phonons a send by amount selected, which destroys nothing and so needs no PIN
+	confirmSendAmount = "sendAmount"
+)
+
+var (
+	ErrConfirmationRequired = fmt.Errorf("this operation needs the token returned by its preview in the %s header", confirmationTokenHeader)
+	ErrConfirmationInvalid  = errors.New("confirmation token is unknown, expired, already used or was issued for a different request")
+	ErrPINRequired          = fmt.Errorf("the card PIN must be re-entered in the %s header", confirmationPINHeader)
+	ErrPINIncorrect         = errors.New("PIN verification failed")
+	ErrPhononChanged        = errors.New("a phonon is no longer on the card as it was previewed, nothing was destroyed or sent")
+	ErrPhononNotFound       = errors.New("no phonon with this key index on the card")
+)
+
+// confirmedPhonon is a phonon as the card described it when previewed, and what is to happen to it
+type confirmedPhonon struct {
+	KeyIndex     model.PhononKeyIndex
+	PubKey       string
+	CurrencyType model.CurrencyType
+	ChainID      int `json:",omitempty"`
+	// value in base units
+	Value string
+	// value in whole units, when the currency is registered
+	Amount        string `json:",omitempty"`
+	Ticker        string `json:",omitempty"`
+	RedeemAddress string `json:",omitempty"`
+}
+
+/*
+confirmation is a preview of a destructive operation. Its token authorizes that operation once, on the same phonons
+in the same order, until it expires.
+*/
+type confirmation struct {
+	Token     string
+	Operation string
+	CardID    string
+	Phonons   []confirmedPhonon
+	Expires   time.Time
+	// the card PIN must be re-entered along with the token
+	PINRequired bool
+	// the selection previewed by a send by amount
+	selection *phononSelection
+}
+
+type confirmationBook struct {
+	mtex       sync.Mutex
+	expiry     time.Duration
+	requirePIN bool
+	pending    map[string]confirmation
+}
+
+func newConfirmationBook(expiry time.Duration, requirePIN bool) *confirmationBook {
+	if expiry <= 0 {
+		expiry = defaultConfirmationExpiry
+	}
+	return &confirmationBook{
+		expiry:     expiry,
+		requirePIN: requirePIN,
+		pending:    make(map[string]confirmation),
+	}
+}
+
+// issue gives c a token and an expiry and keeps it until it is used or expires
+func (cb *confirmationBook) issue(c confirmation) (confirmation, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return c, err
+	}
+	c.Token = hex.EncodeToString(token)
+	c.Expires = time.Now().Add(cb.expiry)
+	c.PINRequired = cb.requirePIN && c.Operation != confirmSendAmount
+	cb.mtex.Lock()
+	defer cb.mtex.Unlock()
+	now := time.Now()
+	for token, p := range cb.pending {
+		if now.After(p.Expires) {
+			delete(cb.pending, token)
+		}
+	}
+	cb.pending[c.Token] = c
+	return c, nil
+}
+
+/*
+use spends token, which must have been issued for operation on the phonons at keyIndices of cardID, to be redeemed
+to addresses when given. A token is spent by any attempt to use it, so it cannot be guessed at or replayed.
+*/
+func (cb *confirmationBook) use(token, operation, cardID string, keyIndices []model.PhononKeyIndex, addresses []string) (confirmation, error) {
+	c, err := cb.take(token, operation, cardID)
+	if err != nil {
+		return c, err
+	}
+	if len(c.Phonons) != len(keyIndices) {
+		return c, ErrConfirmationInvalid
+	}
+	for i, p := range c.Phonons {
+		if p.KeyIndex != keyIndices[i] || (addresses != nil && p.RedeemAddress != addresses[i]) {
+			return c, ErrConfirmationInvalid
+		}
+	}
+	return c, nil
+}
+
+// take spends token, which must have been issued for operation on cardID, and returns the preview it was issued for
+func (cb *confirmationBook) take(token, operation, cardID string) (confirmation, error) {
+	if token == "" {
+		return confirmation{}, ErrConfirmationRequired
+	}
+	cb.mtex.Lock()
+	c, ok := cb.pending[token]
+	delete(cb.pending, token)
+	cb.mtex.Unlock()
+	if !ok || time.Now().After(c.Expires) || c.Operation != operation || c.CardID != cardID {
+		return c, ErrConfirmationInvalid
+	}
+	return c, nil
+}
+
+/*
+describeOnCard reads the phonons at keyIndices from the card for a preview, returning ErrPhononNotFound with the key
+index of a missing one. It must be called with the card held by op.
+*/
+func (apiSession apiSession) describeOnCard(op *operation, sess *orchestrator.Session, keyIndices []model.PhononKeyIndex) ([]confirmedPhonon, error) {
+	var described []confirmedPhonon
+	err := op.run(func() error {
+		phonons, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			return err
+		}
+		onCard := make(map[model.PhononKeyIndex]*model.Phonon, len(phonons))
+		for _, p := range phonons {
+			onCard[p.KeyIndex] = p
+		}
+		var ret []confirmedPhonon
+		for _, keyIndex := range keyIndices {
+			p, ok := onCard[keyIndex]
+			if !ok {
+				return fmt.Errorf("%w: %d", ErrPhononNotFound, keyIndex)
+			}
+			pubKey, err := sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+			if err != nil {
+				return err
+			}
+			ret = append(ret, newConfirmedPhonon(apiSession.registry, p, pubKey))
+		}
+		described = ret
+		return nil
+	})
+	if err != nil {
+		// an abandoned call may still be filling in the phonons
+		return nil, err
+	}
+	return described, nil
+}
+
+func newConfirmedPhonon(reg *registry.Registry, p *model.Phonon, pubKey model.PhononPubKey) confirmedPhonon {
+	cp := confirmedPhonon{
+		KeyIndex:     p.KeyIndex,
+		PubKey:       pubKey.String(),
+		CurrencyType: p.CurrencyType,
+		ChainID:      p.ChainID,
+		Value:        p.Denomination.Value().String(),
+	}
+	if c, ok := reg.Currency(p.CurrencyType); ok {
+		cp.Amount = registry.FormatDecimal(p.Denomination.Value(), c.Decimals)
+		cp.Ticker = c.Ticker
+	}
+	return cp
+}
+
+/*
+verifyConfirmed checks, with the card held by op, the PIN when the confirmation needs one and that the card still
+holds the phonons as they were previewed. The operation must not go ahead unless it returns nil.
+*/
+func (apiSession apiSession) verifyConfirmed(op *operation, sess *orchestrator.Session, c confirmation, pin string) error {
+	if c.PINRequired {
+		if pin == "" {
+			return ErrPINRequired
+		}
+		err := op.run(func() error {
+			return sess.VerifyPIN(pin)
+		})
+		if _, _, abandoned := operationErrorStatus(err); abandoned {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrPINIncorrect, err)
+		}
+	}
+	return apiSession.checkPreviewed(op, sess, c)
+}
+
+/*
+writeConfirmationError writes the error response for a destructive operation that was not confirmed, returning
+false without writing anything when err is nil. op may be nil before the card is locked.
+*/
+func writeConfirmationError(w http.ResponseWriter, op *operation, err error) bool {
+	if err == nil {
+		return false
+	}
+	if op != nil && writeOperationError(w, op, err) {
+		return true
+	}
+	switch {
+	case errors.Is(err, ErrConfirmationRequired):
+		writeAPIError(w, http.StatusPreconditionRequired, errKeyConfirmationRequired, err.Error())
+	case errors.Is(err, ErrConfirmationInvalid):
+		writeAPIError(w, http.StatusForbidden, errKeyConfirmationInvalid, err.Error())
+	case errors.Is(err, ErrPINRequired), errors.Is(err, ErrPINIncorrect):
+		writeAPIError(w, http.StatusForbidden, errKeyPINRequired, err.Error())
+	case errors.Is(err, ErrPhononChanged):
+		writeAPIError(w, http.StatusConflict, errKeyPhononChanged, err.Error())
+	default:
+		writeAPIError(w, http.StatusInternalServerError, errKeyUnknown, err.Error())
+	}
+	return true
+}
+
+// checkPreviewed returns ErrPhononChanged unless the card still holds the confirmed phonons as they were previewed
+func (apiSession apiSession) checkPreviewed(op *operation, sess *orchestrator.Session, c confirmation) error {
+	keyIndices := make([]model.PhononKeyIndex, 0, len(c.Phonons))
+	for _, p := range c.Phonons {
+		keyIndices = append(keyIndices, p.KeyIndex)
+	}
+	now, err := apiSession.describeOnCard(op, sess, keyIndices)
+	if errors.Is(err, ErrPhononNotFound) {
+		return ErrPhononChanged
+	}
+	if err != nil {
+		return err
+	}
+	for i, p := range now {
+		was := c.Phonons[i]
+		if p.PubKey != was.PubKey || p.CurrencyType != was.CurrencyType || p.ChainID != was.ChainID || p.Value != was.Value {
+			return ErrPhononChanged
+		}
+	}
+	return nil
+}
+
+// writePreview answers a preview request with a new confirmation, or the error that prevented it
+func (apiSession apiSession) writePreview(w http.ResponseWriter, op *operation, c confirmation, err error) {
+	if writeOperationError(w, op, err) {
+		return
+	}
+	if errors.Is(err, ErrPhononNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrPhononMismatch) {
+		writeAPIError(w, http.StatusConflict, errKeyPhononMismatch, err.Error())
+		return
+	}
+	if err == nil {
+		c, err = apiSession.confirmations.issue(c)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(c)
+	if err != nil {
+		log.Error("unable to encode confirmation: ", err)
+	}
+}
+
+func (apiSession apiSession) previewExport(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
+	vars := mux.Vars(r)
+	sess, err := apiSession.sessionFromMuxVars(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	index, err := strconv.ParseUint(vars["PhononIndex"], 10, 16)
+	if err != nil {
+		http.Error(w, "Unable to convert index to int:"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "previewExport")
+	if !ok {
+		return
+	}
+	defer op.done()
+	c := confirmation{Operation: confirmExport, CardID: sess.GetCardId()}
+	c.Phonons, err = apiSession.describeOnCard(op, sess, []model.PhononKeyIndex{model.PhononKeyIndex(index)})
+	apiSession.writePreview(w, op, c, err)
+}
+
+func (apiSession apiSession) previewRedeem(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var reqs []*redeemPhononRequest
+	err = json.NewDecoder(r.Body).Decode(&reqs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyIndices, addresses, err := redeemTargets(reqs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = checkRedeemAddresses(reqs)
+	if writeRedeemError(w, nil, err) {
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "previewRedeem")
+	if !ok {
+		return
+	}
+	defer op.done()
+	c := confirmation{Operation: confirmRedeem, CardID: sess.GetCardId()}
+	c.Phonons, err = apiSession.describeOnCard(op, sess, keyIndices)
+	if err == nil {
+		err = matchRedeem(reqs, c.Phonons)
+	}
+	for i := range c.Phonons {
+		c.Phonons[i].RedeemAddress = addresses[i]
+	}
+	apiSession.writePreview(w, op, c, err)
+}
+
+// redeemTargets lists the key indices and addresses of a redeem request, which must name at least one phonon
+func redeemTargets(reqs []*redeemPhononRequest) ([]model.PhononKeyIndex, []string, error) {
+	if len(reqs) == 0 {
+		return nil, nil, errors.New("empty request")
+	}
+	keyIndices := make([]model.PhononKeyIndex, 0, len(reqs))
+	addresses := make([]string, 0, len(reqs))
+	for i, req := range reqs {
+		if req == nil || req.P == nil {
+			return nil, nil, fmt.Errorf("redeem request %d has no phonon", i)
+		}
+		keyIndices = append(keyIndices, req.P.KeyIndex)
+		addresses = append(addresses, req.RedeemAddress)
+	}
+	return keyIndices, addresses, nil
+}
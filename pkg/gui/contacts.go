@@ -0,0 +1,203 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/GridPlus/phonon-client/internal/contacts"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// pairResponse reports which card a session was paired with
+type pairResponse struct {
+	CardID  string
+	Contact string `json:",omitempty"`
+	// set when a contact's card presented a different identity certificate than before
+	Warning string `json:",omitempty"`
+}
+
+/*
+checkCounterparty notes the card sess is paired with in the address book, returning a warning if it is a contact's
+card presenting an unexpected certificate
+*/
+func (apiSession apiSession) checkCounterparty(sess *orchestrator.Session) string {
+	if sess.RemoteCard == nil {
+		return ""
+	}
+	crt, err := sess.RemoteCard.GetCertificate()
+	if err != nil {
+		log.Errorf("unable to read the certificate of the counterparty of card %s: %s", sess.GetCardId(), err)
+		return ""
+	}
+	warning, err := apiSession.contacts.Seen(cardIDFromPubKey(crt.PubKey), crt)
+	if err != nil {
+		log.Error("unable to update address book: ", err)
+	}
+	if warning != "" {
+		log.Warn(warning)
+	}
+	return warning
+}
+
+// pairedWith reports whether sess is paired with cardID
+func pairedWith(sess *orchestrator.Session, cardID string) bool {
+	if sess.RemoteCard == nil || sess.RemoteCard.VerifyPaired() != nil {
+		return false
+	}
+	crt, err := sess.RemoteCard.GetCertificate()
+	return err == nil && strings.EqualFold(cardIDFromPubKey(crt.PubKey), cardID)
+}
+
+/*
+pairCounterparty pairs sess with cardID, first connecting to jumpboxURL if one is given and the session is not
+connected to a jumpbox. Unless repair is set, a session already paired with cardID is left as it is. It must be called
+with the card held by op.
+*/
+func (apiSession apiSession) pairCounterparty(op *operation, sess *orchestrator.Session, cardID string, jumpboxURL string, repair bool) (pairResponse, error) {
+	resp := pairResponse{CardID: cardID}
+	if c, ok := apiSession.contacts.ByCardID(cardID); ok {
+		resp.Contact = c.Name
+	}
+	var warning string
+	err := op.run(func() error {
+		if !repair && pairedWith(sess, cardID) {
+			warning = apiSession.checkCounterparty(sess)
+			return nil
+		}
+		if jumpboxURL != "" && sess.RemoteConnectionStatus() == model.StatusUnconnected {
+			err := sess.ConnectToRemoteProvider(jumpboxURL)
+			if err != nil {
+				return fmt.Errorf("unable to connect to %s: %w", jumpboxURL, err)
+			}
+		}
+		err := sess.ConnectToCounterparty(cardID)
+		if err != nil {
+			return err
+		}
+		warning = apiSession.checkCounterparty(sess)
+		return nil
+	})
+	if err != nil {
+		// an abandoned call may still be setting the warning
+		return resp, err
+	}
+	resp.Warning = warning
+	return resp, nil
+}
+
+// ErrCertificateChanged is returned when a contact's card presents a different certificate than it did before
+var ErrCertificateChanged = errors.New("contact's card presented a different certificate")
+
+// certificateChangeAllowed reports whether the request sends to a contact even if its card presents a different certificate
+func certificateChangeAllowed(r *http.Request) bool {
+	return r.URL.Query().Get("allowCertificateChange") == "true"
+}
+
+/*
+pairContact pairs sess with the card of contact before phonons are sent to it. Unless allowChange is set, a card
+presenting a different certificate than before is refused with ErrCertificateChanged, before anything is sent to
+it. Otherwise the warning is returned to pass on. It must be called with the card held by op.
+*/
+func (apiSession apiSession) pairContact(op *operation, sess *orchestrator.Session, contact contacts.Contact, allowChange bool) (string, error) {
+	paired, err := apiSession.pairCounterparty(op, sess, contact.CardID, contact.URL, false)
+	if err != nil {
+		return "", err
+	}
+	if paired.Warning != "" && !allowChange {
+		return "", fmt.Errorf("%w: %s", ErrCertificateChanged, paired.Warning)
+	}
+	return paired.Warning, nil
+}
+
+// writeContactError answers a failed address book change
+func writeContactError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, contacts.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, contacts.ErrExists), errors.Is(err, contacts.ErrCardIDTaken):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, contacts.ErrInvalidName), errors.Is(err, contacts.ErrInvalidCardID):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeContact(w http.ResponseWriter, c contacts.Contact) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(c)
+	if err != nil {
+		log.Error("unable to encode contact: ", err)
+	}
+}
+
+func (apiSession apiSession) listContacts(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.contacts.List())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) addContact(w http.ResponseWriter, r *http.Request) {
+	var req contacts.Contact
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := apiSession.contacts.Add(req)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	writeContact(w, c)
+}
+
+func (apiSession apiSession) getContact(w http.ResponseWriter, r *http.Request) {
+	c, err := apiSession.contacts.Get(mux.Vars(r)["name"])
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	writeContact(w, c)
+}
+
+func (apiSession apiSession) updateContact(w http.ResponseWriter, r *http.Request) {
+	var req contacts.Contact
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := apiSession.contacts.Update(mux.Vars(r)["name"], req)
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	writeContact(w, c)
+}
+
+func (apiSession apiSession) removeContact(w http.ResponseWriter, r *http.Request) {
+	err := apiSession.contacts.Remove(mux.Vars(r)["name"])
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+}
+
+func (apiSession apiSession) forgetContactCertificate(w http.ResponseWriter, r *http.Request) {
+	c, err := apiSession.contacts.ForgetCertificate(mux.Vars(r)["name"])
+	if err != nil {
+		writeContactError(w, err)
+		return
+	}
+	writeContact(w, c)
+}
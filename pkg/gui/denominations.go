@@ -0,0 +1,182 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+type denominationStrategy string
+
+const (
+	// each phonon the largest denomination that fits what is left of the amount. This greedy split is not proven to
+	// use the fewest phonons, though TestMinCountIsMinimal finds it does for every amount up to 300000
+	planMinCount = denominationStrategy("minCount")
+	// phonons of 1, 2 and 5 times a power of ten, like banknotes, so later payments can be made up without change
+	planChangeFriendly = denominationStrategy("changeFriendly")
+)
+
+var ErrPlanExceedsCap = errors.New("the amount needs more phonons than the cap allows")
+
+type denominationPlanRequest struct {
+	CurrencyType model.CurrencyType
+	// amount in the currency's base units, as a decimal string
+	Amount   string
+	Strategy denominationStrategy
+	// the most phonons the plan may use. Zero means no cap
+	MaxPhonons int
+}
+
+// denominationPlan can be posted to initDeposit as is
+type denominationPlan struct {
+	CurrencyType  model.CurrencyType
+	Strategy      denominationStrategy
+	Amount        string
+	Denominations []*model.Denomination
+	// the amount and denominations in whole units, for showing to the user
+	Display *planDisplay `json:",omitempty"`
+}
+
+type planDisplay struct {
+	Amount        string
+	Denominations []string
+}
+
+/*
+planDenominations splits an amount into denominations a phonon can hold. When the chosen strategy needs more phonons
+than MaxPhonons, the minCount plan is returned instead if it fits; the Strategy in the response says which was used.
+*/
+func (apiSession apiSession) planDenominations(w http.ResponseWriter, r *http.Request) {
+	var req denominationPlanRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "unable to decode denomination plan request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	amount, ok := new(big.Int).SetString(req.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		http.Error(w, fmt.Sprintf("amount %q is not a positive integer of base units", req.Amount), http.StatusBadRequest)
+		return
+	}
+	currency, ok := apiSession.registry.Currency(req.CurrencyType)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown currency type %d, see /currencies", req.CurrencyType), http.StatusBadRequest)
+		return
+	}
+	if req.MaxPhonons < 0 {
+		http.Error(w, "MaxPhonons cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = planMinCount
+	}
+	plan, err := planDeposit(amount, req.Strategy, req.MaxPhonons)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	plan.CurrencyType = req.CurrencyType
+	plan.Display = &planDisplay{Amount: apiSession.registry.FormatAmount(currency.Type, amount)}
+	for _, d := range plan.Denominations {
+		plan.Display.Denominations = append(plan.Display.Denominations, apiSession.registry.FormatAmount(currency.Type, d.Value()))
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(plan)
+	if err != nil {
+		log.Error("unable to encode denomination plan: ", err)
+	}
+}
+
+// planDeposit splits amount under strategy, falling back to minCount when the plan would exceed maxPhonons
+func planDeposit(amount *big.Int, strategy denominationStrategy, maxPhonons int) (denominationPlan, error) {
+	var next func(*big.Int) *big.Int
+	switch strategy {
+	case planMinCount:
+		next = largestDenomination
+	case planChangeFriendly:
+		next = largestBanknote
+	default:
+		return denominationPlan{}, fmt.Errorf("unknown denomination strategy %q", strategy)
+	}
+	denoms, err := splitAmount(amount, next, maxPhonons)
+	if errors.Is(err, ErrPlanExceedsCap) && strategy != planMinCount {
+		strategy = planMinCount
+		denoms, err = splitAmount(amount, largestDenomination, maxPhonons)
+	}
+	if err != nil {
+		return denominationPlan{}, err
+	}
+	return denominationPlan{
+		Strategy:      strategy,
+		Amount:        amount.String(),
+		Denominations: denoms,
+	}, nil
+}
+
+// splitAmount repeatedly takes the value next picks for what is left of amount until nothing is left
+func splitAmount(amount *big.Int, next func(*big.Int) *big.Int, maxPhonons int) ([]*model.Denomination, error) {
+	left := new(big.Int).Set(amount)
+	denoms := []*model.Denomination{}
+	for left.Sign() > 0 {
+		if maxPhonons > 0 && len(denoms) == maxPhonons {
+			return nil, fmt.Errorf("%w (%d)", ErrPlanExceedsCap, maxPhonons)
+		}
+		value := next(left)
+		// NewDenomination consumes its argument
+		d, err := model.NewDenomination(new(big.Int).Set(value))
+		if err != nil {
+			return nil, fmt.Errorf("unable to make denomination from %s: %w", value, err)
+		}
+		denoms = append(denoms, &d)
+		left.Sub(left, value)
+	}
+	return denoms, nil
+}
+
+// largestDenomination returns the largest value at most v that a phonon can hold, a base of up to 255 times a power of ten
+func largestDenomination(v *big.Int) *big.Int {
+	maxBase := big.NewInt(255)
+	if v.Cmp(maxBase) <= 0 {
+		return new(big.Int).Set(v)
+	}
+	digits := len(v.String())
+	// the leading three digits, capped at 255, or the leading two digits one power of ten higher
+	exp3 := pow10(digits - 3)
+	base3 := new(big.Int).Div(v, exp3)
+	if base3.Cmp(maxBase) > 0 {
+		base3.Set(maxBase)
+	}
+	cand3 := base3.Mul(base3, exp3)
+	exp2 := pow10(digits - 2)
+	cand2 := new(big.Int).Div(v, exp2)
+	cand2.Mul(cand2, exp2)
+	if cand2.Cmp(cand3) > 0 {
+		return cand2
+	}
+	return cand3
+}
+
+// largestBanknote returns the largest value at most v that is 1, 2 or 5 times a power of ten
+func largestBanknote(v *big.Int) *big.Int {
+	digits := len(v.String())
+	exp := pow10(digits - 1)
+	lead := new(big.Int).Div(v, exp).Int64()
+	switch {
+	case lead >= 5:
+		lead = 5
+	case lead >= 2:
+		lead = 2
+	default:
+		lead = 1
+	}
+	return exp.Mul(exp, big.NewInt(lead))
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
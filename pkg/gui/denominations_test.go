@@ -0,0 +1,103 @@
+package gui
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func planValues(plan denominationPlan) string {
+	values := []string{}
+	for _, d := range plan.Denominations {
+		values = append(values, d.Value().String())
+	}
+	return strings.Join(values, " ")
+}
+
+func TestPlanDeposit(t *testing.T) {
+	tests := []struct {
+		amount       int64
+		strategy     denominationStrategy
+		maxPhonons   int
+		wantStrategy denominationStrategy
+		want         string
+		wantErr      error
+	}{
+		{255, planMinCount, 0, planMinCount, "255", nil},
+		{256, planMinCount, 0, planMinCount, "255 1", nil},
+		{1000, planMinCount, 0, planMinCount, "1000", nil},
+		{2999, planMinCount, 0, planMinCount, "2900 99", nil},
+		{123456789, planMinCount, 0, planMinCount, "123000000 450000 6700 89", nil},
+		{1, planChangeFriendly, 0, planChangeFriendly, "1", nil},
+		{380, planChangeFriendly, 0, planChangeFriendly, "200 100 50 20 10", nil},
+		{9, planChangeFriendly, 0, planChangeFriendly, "5 2 2", nil},
+		// five banknotes are more than the cap, so the minCount plan is used
+		{380, planChangeFriendly, 2, planMinCount, "380", nil},
+		{380, planChangeFriendly, 5, planChangeFriendly, "200 100 50 20 10", nil},
+		{2999, planMinCount, 1, "", "", ErrPlanExceedsCap},
+		{2999, planChangeFriendly, 1, "", "", ErrPlanExceedsCap},
+	}
+	for _, tt := range tests {
+		plan, err := planDeposit(big.NewInt(tt.amount), tt.strategy, tt.maxPhonons)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("planDeposit(%d, %s, %d): expected %v, got %v", tt.amount, tt.strategy, tt.maxPhonons, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("planDeposit(%d, %s, %d): %s", tt.amount, tt.strategy, tt.maxPhonons, err)
+			continue
+		}
+		if plan.Strategy != tt.wantStrategy || planValues(plan) != tt.want || plan.Amount != big.NewInt(tt.amount).String() {
+			t.Errorf("planDeposit(%d, %s, %d) = %s [%s], want %s [%s]", tt.amount, tt.strategy, tt.maxPhonons, plan.Strategy, planValues(plan), tt.wantStrategy, tt.want)
+		}
+	}
+	if _, err := planDeposit(big.NewInt(1), "largest", 0); err == nil {
+		t.Error("expected an unknown strategy to be refused")
+	}
+}
+
+// TestMinCountIsMinimal checks the greedy minCount split against an exhaustive search for the fewest phonons
+func TestMinCountIsMinimal(t *testing.T) {
+	limit := 300000
+	if testing.Short() {
+		limit = 3000
+	}
+	// every value a phonon can hold up to limit
+	holdable := make([]bool, limit+1)
+	for exp := 1; exp <= limit; exp *= 10 {
+		for base := 1; base <= 255 && base*exp <= limit; base++ {
+			holdable[base*exp] = true
+		}
+	}
+	denominations := []int{}
+	for v := 1; v <= limit; v++ {
+		if holdable[v] {
+			denominations = append(denominations, v)
+		}
+	}
+	// fewest[v] is the least number of phonons adding up to v
+	fewest := make([]int, limit+1)
+	for v := 1; v <= limit; v++ {
+		fewest[v] = v
+		for _, d := range denominations {
+			if d > v {
+				break
+			}
+			if fewest[v-d]+1 < fewest[v] {
+				fewest[v] = fewest[v-d] + 1
+			}
+		}
+	}
+	for v := 1; v <= limit; v++ {
+		plan, err := planDeposit(big.NewInt(int64(v)), planMinCount, 0)
+		if err != nil {
+			t.Fatalf("planDeposit(%d): %s", v, err)
+		}
+		if len(plan.Denominations) != fewest[v] {
+			t.Fatalf("minCount split %d into %s, but %d phonons are enough", v, planValues(plan), fewest[v])
+		}
+	}
+}
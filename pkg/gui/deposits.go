@@ -0,0 +1,168 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/address"
+	"github.com/GridPlus/phonon-client/internal/deposits"
+	"github.com/PhononDAO/phonon-core/pkg/backend"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often followed deposits are checked for funding
+const depositPollInterval = 30 * time.Second
+
+// watchesDeposit reports whether the funding of a deposit of p is followed on its chain
+func (apiSession apiSession) watchesDeposit(p *model.Phonon) bool {
+	return address.EVM(p.CurrencyType) && apiSession.chains.Has(p.ChainID)
+}
+
+// watchDeposits follows deposits until ctx is done, finalizing each once its funding is confirmed
+func (apiSession apiSession) watchDeposits(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, d := range apiSession.deposits.Poll(ctx, apiSession.chains) {
+				apiSession.finalizeWatchedDeposit(d)
+			}
+		}
+	}
+}
+
+/*
+finalizeWatchedDeposit sets the descriptor of a deposit phonon whose funding is confirmed. A card that is not
+connected, not unlocked or busy is tried again on the next poll. The phonon is only ever finalized as confirmed on
+chain: a deposit that is never funded is left for the user to give up on, since that destroys its key.
+*/
+func (apiSession apiSession) finalizeWatchedDeposit(d deposits.Deposit) {
+	var sess *orchestrator.Session
+	for _, s := range apiSession.t.ListSessions() {
+		if strings.EqualFold(s.GetCardId(), d.CardID) {
+			sess = s
+			break
+		}
+	}
+	if sess == nil {
+		apiSession.deposits.SetErr(d.ID, errors.New("card is not connected"))
+		return
+	}
+	if !sess.IsUnlocked() {
+		apiSession.deposits.SetErr(d.ID, backend.ErrPINNotEntered)
+		return
+	}
+	op := apiSession.startOperation(context.Background(), "finalizeDeposit")
+	err := apiSession.acquireCard(op, sess, false)
+	if err != nil {
+		apiSession.deposits.SetErr(d.ID, operationError(op, err))
+		return
+	}
+	defer op.done()
+	// the key index is only the deposit's while the phonon there has the deposit's public key
+	var pubKey model.PhononPubKey
+	err = op.run(func() (err error) {
+		pubKey, err = sess.GetPhononPubKey(d.Phonon.KeyIndex, d.Phonon.CurveType)
+		return err
+	})
+	if err != nil {
+		apiSession.deposits.SetErr(d.ID, operationError(op, err))
+		return
+	}
+	if !strings.EqualFold(strings.TrimPrefix(pubKey.String(), "0x"), strings.TrimPrefix(d.Phonon.PubKey.String(), "0x")) {
+		apiSession.deposits.Failed(d.ID, fmt.Sprintf("the phonon at key index %d is no longer the deposit's", d.Phonon.KeyIndex))
+		return
+	}
+	dc, err := finalizeDeposit(op, sess, orchestrator.DepositConfirmation{Phonon: d.Phonon, ConfirmedOnChain: true})
+	if err != nil {
+		log.Errorf("unable to finalize deposit %s of card %s: %s", d.ID, d.CardID, err)
+		apiSession.deposits.SetErr(d.ID, operationError(op, err))
+		return
+	}
+	apiSession.deposits.Finalized(d.ID)
+	apiSession.recordDeposits(sess.GetCardId(), dc)
+	log.Infof("finalized deposit %s of card %s at key index %d", d.ID, d.CardID, d.Phonon.KeyIndex)
+}
+
+/*
+finalizeDeposit sets the descriptor of a deposit confirmed on chain, or destroys the phonon of one that was not, with
+the card held by op. It does what the orchestrator's FinalizeDepositPhonon does, except that a phonon that could not be
+destroyed is an error rather than only logged, so ConfirmedOnCard is set only when the card did what was asked.
+*/
+func finalizeDeposit(op *operation, sess *orchestrator.Session, dc orchestrator.DepositConfirmation) (orchestrator.DepositConfirmation, error) {
+	if dc.Phonon == nil {
+		return dc, errors.New("deposit confirmation has no phonon")
+	}
+	var err error
+	if dc.ConfirmedOnChain {
+		err = op.run(func() error {
+			return sess.SetDescriptor(dc.Phonon)
+		})
+	} else {
+		err = op.runDestructive(func() error {
+			_, err := sess.DestroyPhonon(dc.Phonon.KeyIndex)
+			return err
+		})
+	}
+	dc.ConfirmedOnCard = err == nil
+	return dc, err
+}
+
+// watchDepositPhonons starts following the deposits of phonons on cardID whose chain has an RPC endpoint
+func (apiSession apiSession) watchDepositPhonons(cardID string, phonons []*model.Phonon) {
+	for _, p := range phonons {
+		if !apiSession.watchesDeposit(p) {
+			continue
+		}
+		_, err := apiSession.deposits.Add(cardID, p, apiSession.chains.Confirmations(p.ChainID))
+		if err != nil {
+			log.Errorf("unable to follow deposit of phonon %d on card %s: %s", p.KeyIndex, cardID, err)
+		}
+	}
+}
+
+func (apiSession apiSession) listDeposits(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.deposits.List(r.URL.Query().Get("cardID")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) getDeposit(w http.ResponseWriter, r *http.Request) {
+	d, err := apiSession.deposits.Get(mux.Vars(r)["depositID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(d)
+	if err != nil {
+		log.Error("unable to encode deposit: ", err)
+	}
+}
+
+// removeDeposit stops following a deposit without touching its phonon, which can still be finalized by hand
+func (apiSession apiSession) removeDeposit(w http.ResponseWriter, r *http.Request) {
+	err := apiSession.deposits.Remove(mux.Vars(r)["depositID"])
+	if errors.Is(err, deposits.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
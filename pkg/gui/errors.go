@@ -0,0 +1,36 @@
+package gui
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// error keys returned in API error objects. See API_ERROR_CODES.md
+const (
+	errKeyUnknown          = "UNKNOWN_ERROR"
+	errKeyCardBusy         = "CARD_BUSY"
+	errKeyRequestCancelled = "REQUEST_CANCELLED"
+	errKeyOperationTimeout = "OPERATION_TIMEOUT"
+	// destructive operations, see confirm.go
+	errKeyConfirmationRequired = "CONFIRMATION_REQUIRED"
+	errKeyConfirmationInvalid  = "CONFIRMATION_INVALID"
+	errKeyPINRequired          = "PIN_REQUIRED"
+	errKeyPhononChanged        = "PHONON_CHANGED"
+	errKeyOriginNotAllowed     = "ORIGIN_NOT_ALLOWED"
+	// redeem validation, see redeem.go
+	errKeyRedeemAddressInvalid = "REDEEM_ADDRESS_INVALID"
+	errKeyPhononMismatch       = "PHONON_MISMATCH"
+)
+
+type apiError struct {
+	Key     string `json:"key"`
+	Message string `json:"message"`
+}
+
+// writeAPIError responds with an error object in the format described in API_ERROR_CODES.md
+func writeAPIError(w http.ResponseWriter, status int, key string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Key: key, Message: message})
+}
@@ -0,0 +1,144 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	log "github.com/sirupsen/logrus"
+)
+
+// record appends events to the history ledger. A failure is logged rather than failing the operation it describes,
+// which has already happened on the card
+func (apiSession apiSession) record(events ...history.Event) {
+	if len(events) == 0 {
+		return
+	}
+	err := apiSession.history.Record(events...)
+	if err != nil {
+		log.Errorf("unable to record %d %s events in history: %s", len(events), events[0].Kind, err)
+	}
+}
+
+// recordDeposits records the deposits that were confirmed on chain and finalized on the card, labelling their origin,
+// and settles the deposits the watcher follows
+func (apiSession apiSession) recordDeposits(cardID string, confirmations ...orchestrator.DepositConfirmation) {
+	var events []history.Event
+	for _, dc := range confirmations {
+		// a deposit finalized or given up on by hand is no longer followed
+		if dc.Phonon != nil && dc.Phonon.PubKey != nil && dc.ConfirmedOnCard {
+			apiSession.deposits.Settle(cardID, dc.Phonon.PubKey.String(), dc.ConfirmedOnChain)
+		}
+		if dc.Phonon != nil && dc.ConfirmedOnChain && dc.ConfirmedOnCard {
+			events = append(events, history.PhononEvent(history.KindDeposited, cardID, dc.Phonon))
+			if dc.Phonon.PubKey != nil {
+				err := apiSession.labels.SetOrigin(cardID, dc.Phonon.PubKey.String(), "deposited")
+				if err != nil {
+					log.Errorf("unable to label deposited phonon %d: %s", dc.Phonon.KeyIndex, err)
+				}
+			}
+		}
+	}
+	apiSession.record(events...)
+}
+
+/*
+phononDetails returns what the card says about the phonon at keyIndex. Details that cannot be read are left out,
+leaving at least the key index
+*/
+func (apiSession apiSession) phononDetails(op *operation, sess *orchestrator.Session, keyIndex model.PhononKeyIndex) *model.Phonon {
+	found := &model.Phonon{KeyIndex: keyIndex}
+	err := op.run(func() error {
+		phonons, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			return err
+		}
+		for _, p := range phonons {
+			if p.KeyIndex == keyIndex {
+				found.CurrencyType = p.CurrencyType
+				found.Denomination = p.Denomination
+				found.ChainID = p.ChainID
+				found.CurveType = p.CurveType
+				found.PubKey, err = sess.GetPhononPubKey(keyIndex, p.CurveType)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// an abandoned call may still be filling in found
+		return &model.Phonon{KeyIndex: keyIndex}
+	}
+	return found
+}
+
+// parseHistoryFilter reads /history query parameters
+func parseHistoryFilter(v url.Values) (history.Filter, error) {
+	f := history.Filter{
+		CardID:       v.Get("cardID"),
+		PubKey:       v.Get("pubKey"),
+		Counterparty: v.Get("counterparty"),
+	}
+	var err error
+	if s := v.Get("kind"); s != "" {
+		f.Kinds, err = history.ParseKinds(s)
+		if err != nil {
+			return f, err
+		}
+	}
+	if s := v.Get("currencyType"); s != "" {
+		ct, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid currencyType %q", s)
+		}
+		currencyType := model.CurrencyType(ct)
+		f.CurrencyType = &currencyType
+	}
+	if s := v.Get("keyIndex"); s != "" {
+		i, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return f, fmt.Errorf("invalid keyIndex %q", s)
+		}
+		keyIndex := model.PhononKeyIndex(i)
+		f.KeyIndex = &keyIndex
+	}
+	for name, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if s := v.Get(name); s != "" {
+			*t, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s %q, expected an RFC 3339 time", name, s)
+			}
+		}
+	}
+	return f, nil
+}
+
+func (apiSession apiSession) listHistory(w http.ResponseWriter, r *http.Request) {
+	f, err := parseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	events := apiSession.history.Query(f)
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		err = enc.Encode(events)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="phonon-history.csv"`)
+		err = history.WriteCSV(w, events)
+	default:
+		http.Error(w, "unknown format, use json or csv", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error("unable to write history: ", err)
+	}
+}
@@ -0,0 +1,113 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/GridPlus/phonon-client/internal/jobs"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// asyncRequested reports whether the request asked to run as a job rather than waiting for the result
+func asyncRequested(r *http.Request) bool {
+	return r.URL.Query().Get("async") == "true"
+}
+
+// jobTokenHeader carries the token of a job, returned when it was started, to claim the job's secrets
+const jobTokenHeader = "X-Job-Token"
+
+/*
+runJob responds with the ID and token of a new job and runs work in the background once the card is free. work
+reports per-item results on the job as it goes; its result and error become the job's outcome. The operation is
+bounded by the same deadline as when it runs within a request.
+*/
+func (apiSession apiSession) runJob(w http.ResponseWriter, sess *orchestrator.Session, op string, items int, work func(o *operation, job *jobs.Job) (interface{}, error)) {
+	job, err := apiSession.jobs.Create(op, sess.GetCardId(), items)
+	if err != nil {
+		log.Error("unable to create job: ", err)
+		http.Error(w, "unable to create job: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go func() {
+		o := apiSession.startOperation(context.Background(), op)
+		err := apiSession.acquireCard(o, sess, true)
+		if err != nil {
+			job.Finish(nil, operationError(o, err))
+			return
+		}
+		defer o.done()
+		job.Start()
+		result, err := work(o, job)
+		job.Finish(result, operationError(o, err))
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	enc := json.NewEncoder(w)
+	enc.Encode(struct {
+		JobID string `json:"jobID"`
+		Token string `json:"token"`
+	}{JobID: job.ID, Token: job.Token()})
+}
+
+func (apiSession apiSession) listJobs(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.jobs.List(r.URL.Query().Get("cardID")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) jobStatus(w http.ResponseWriter, r *http.Request) {
+	job, err := apiSession.jobs.Get(mux.Vars(r)["jobID"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(job)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// claimJobSecrets hands the secrets of a job, such as the private keys of redeemed phonons, to its creator once
+func (apiSession apiSession) claimJobSecrets(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
+	secrets, err := apiSession.jobs.Claim(mux.Vars(r)["jobID"], r.Header.Get(jobTokenHeader))
+	switch err {
+	case nil:
+	case jobs.ErrJobNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case jobs.ErrWrongToken:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case jobs.ErrNoSecrets:
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type jobSecret struct {
+		Index  int
+		Secret string
+	}
+	ret := make([]jobSecret, 0, len(secrets))
+	for index, secret := range secrets {
+		ret = append(ret, jobSecret{Index: index, Secret: string(secret)})
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Index < ret[b].Index
+	})
+	enc := json.NewEncoder(w)
+	enc.Encode(ret)
+}
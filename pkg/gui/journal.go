@@ -0,0 +1,109 @@
+package gui
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/GridPlus/phonon-client/internal/journal"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+sendPhonons sends phonons to the session's counterparty, recording the transfer in the journal. The journaled
+transfer is returned unless the send failed before the card was asked to release the phonons.
+*/
+func (apiSession apiSession) sendPhonons(sess *orchestrator.Session, phonons []model.Phonon) (transfer journal.Transfer, journaled bool, err error) {
+	keyIndices := []model.PhononKeyIndex{}
+	for _, p := range phonons {
+		keyIndices = append(keyIndices, p.KeyIndex)
+	}
+	cardID := sess.GetCardId()
+	apiSession.journal.PrepareSend(cardID, journal.PhononRefs(phonons))
+	err = sess.SendPhonons(keyIndices)
+	transfer, journaled = apiSession.journal.FinishSend(cardID, err)
+	return transfer, journaled, err
+}
+
+/*
+reconcileTransfers settles the journaled transfers of an unlocked card that an earlier run left pending, logging
+those that need attention. It must be called with the card held by op.
+*/
+func (apiSession apiSession) reconcileTransfers(op *operation, sess *orchestrator.Session) {
+	var attention []journal.Transfer
+	err := op.run(func() error {
+		phonons, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			return err
+		}
+		onCard := make(map[model.PhononKeyIndex]*model.Phonon)
+		for _, p := range phonons {
+			onCard[p.KeyIndex] = p
+		}
+		lookup := func(keyIndex model.PhononKeyIndex, wantPubKey bool) (bool, string, error) {
+			p, ok := onCard[keyIndex]
+			if !ok || !wantPubKey {
+				return ok, "", nil
+			}
+			pubKey, err := sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+			if err != nil {
+				return false, "", err
+			}
+			return true, pubKey.String(), nil
+		}
+		attention, err = apiSession.journal.Reconcile(sess.GetCardId(), lookup)
+		return err
+	})
+	if err != nil {
+		log.Errorf("unable to reconcile journaled transfers of card %s: %s", sess.GetCardId(), err)
+		return
+	}
+	for _, t := range attention {
+		log.Warnf("%s transfer %s of card %s needs attention: %s", t.Direction, t.ID, t.CardID, t.Note)
+	}
+}
+
+func (apiSession apiSession) listTransfers(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.journal.List(r.URL.Query().Get("all") == "true"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) resolveTransfer(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	resolveReq := struct {
+		Note string `json:"note"`
+	}{}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &resolveReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if resolveReq.Note == "" {
+		resolveReq.Note = "resolved by hand"
+	}
+	t, err := apiSession.journal.Resolve(mux.Vars(r)["transferID"], resolveReq.Note)
+	switch err {
+	case nil:
+	case journal.ErrTransferNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(t)
+}
@@ -0,0 +1,94 @@
+package gui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/labels"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+labelOrigins records the origin of phonons mined or received by a card, which only the card wrappers see. Subscribe it
+to the history ledger. A phonon received from a card this client also holds gets that card as its origin when its
+label is moved after the send.
+*/
+func (apiSession apiSession) labelOrigins(events []history.Event) {
+	for _, e := range events {
+		if e.PubKey == "" || (e.Kind != history.KindMined && e.Kind != history.KindReceived) {
+			continue
+		}
+		err := apiSession.labels.SetOrigin(e.CardID, e.PubKey, string(e.Kind))
+		if err != nil {
+			log.Errorf("unable to label %s phonon %d: %s", e.Kind, e.KeyIndex, err)
+		}
+	}
+}
+
+// moveLabels carries the labels of phonons sent from one card to another
+func (apiSession apiSession) moveLabels(fromCardID, toCardID string, pubKeys []string) {
+	for _, pubKey := range pubKeys {
+		err := apiSession.labels.Move(fromCardID, toCardID, pubKey)
+		if err != nil {
+			log.Errorf("unable to move label of phonon %s to card %s: %s", pubKey, toCardID, err)
+		}
+	}
+}
+
+func (apiSession apiSession) listLabels(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(apiSession.labels.List(r.URL.Query().Get("cardID"), r.URL.Query().Get("tag")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (apiSession apiSession) getLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	l, ok := apiSession.labels.Get(vars["cardID"], vars["pubKey"])
+	if !ok {
+		http.Error(w, labels.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err := enc.Encode(l)
+	if err != nil {
+		log.Error("unable to encode label: ", err)
+	}
+}
+
+func (apiSession apiSession) setLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req labels.Label
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := apiSession.labels.Set(vars["cardID"], vars["pubKey"], req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(l)
+	if err != nil {
+		log.Error("unable to encode label: ", err)
+	}
+}
+
+func (apiSession apiSession) deleteLabel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := apiSession.labels.Delete(vars["cardID"], vars["pubKey"])
+	if err == labels.ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,154 @@
+package gui
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/PhononDAO/phonon-core/pkg/backend/mock"
+	"github.com/PhononDAO/phonon-core/pkg/cert"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+)
+
+// the pin NewMockCard uses when asked for an initialized card
+const defaultMockPin = "111111"
+
+// mockCardOptions describes a mock card fixture requested through /genMock.
+// The zero value produces the same card as mock.NewMockCard(true, false).
+type mockCardOptions struct {
+	// Initialized defaults to true when omitted
+	Initialized *bool  `json:"initialized"`
+	Pin         string `json:"pin"`
+	Name        string `json:"name"`
+	// CA selects the authority used to sign the card certificate: "demo" (default) or "mock"
+	CA string `json:"ca"`
+	// Seed makes the keys of pre-loaded phonons deterministic. The identity, and so the card ID, stays random: the mock
+	// backend keeps its identity key to itself
+	Seed    string              `json:"seed"`
+	Phonons []mockPhononOptions `json:"phonons"`
+}
+
+type mockPhononOptions struct {
+	CurrencyType model.CurrencyType `json:"currencyType"`
+	Denomination model.Denomination `json:"denomination"`
+	ChainID      int                `json:"chainID"`
+}
+
+var (
+	ErrUnknownMockCA = errors.New("unknown certificate authority for mock card")
+	ErrMockPinUnused = errors.New("a pin was given for a mock that is not initialized")
+)
+
+// newMockCard builds a mock card according to opts
+func newMockCard(opts mockCardOptions) (model.PhononCard, error) {
+	initialized := opts.Initialized == nil || *opts.Initialized
+	if !initialized && opts.Pin != "" {
+		return nil, ErrMockPinUnused
+	}
+	pin := opts.Pin
+	if pin == "" {
+		pin = defaultMockPin
+	}
+	caPubKey, signer, err := mockCASigner(opts.CA)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := mock.NewMockCard(false, false)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := c.(*mock.MockCard)
+	if !ok {
+		return nil, errors.New("mock backend returned an unexpected card type")
+	}
+	err = m.LoadCertAuthority(caPubKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate authority into mock: %s", err.Error())
+	}
+	err = m.InstallCertificate(signer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to install mock certificate: %s", err.Error())
+	}
+	if initialized {
+		err = m.Init(pin)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize mock with pin: %s", err.Error())
+		}
+	}
+	if opts.Name != "" {
+		err = m.SetFriendlyName(opts.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, p := range opts.Phonons {
+		err = addMockPhonon(m, opts.Seed, i, p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to pre-load phonon %d: %s", i, err.Error())
+		}
+	}
+	return m, nil
+}
+
+func mockCASigner(name string) (caPubKey []byte, signer func([]byte) ([]byte, error), err error) {
+	switch strings.ToLower(name) {
+	case "", "demo":
+		return cert.PhononDemoCAPubKey, cert.SignWithDemoKey, nil
+	case "mock":
+		caPrivKey, err := ethcrypto.ToECDSA(cert.PhononMockCAPrivKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert.PhononMockCAPubKey, cert.GetSignerWithPrivateKey(*caPrivKey), nil
+	default:
+		return nil, nil, ErrUnknownMockCA
+	}
+}
+
+// addMockPhonon appends a phonon directly to the mock's storage. A freshly built mock has no
+// deleted slots, so the next key index is always the length of the phonon list.
+func addMockPhonon(m *mock.MockCard, seed string, i int, opts mockPhononOptions) error {
+	privKey, err := mockPhononKey(seed, i)
+	if err != nil {
+		return err
+	}
+	pubKey, err := model.NewPhononPubKey(ethcrypto.FromECDSAPub(&privKey.PublicKey), model.Secp256k1)
+	if err != nil {
+		return err
+	}
+	m.Phonons = append(m.Phonons, &mock.MockPhonon{
+		Phonon: model.Phonon{
+			KeyIndex:     model.PhononKeyIndex(len(m.Phonons)),
+			PubKey:       pubKey,
+			CurveType:    model.Secp256k1,
+			Denomination: opts.Denomination,
+			CurrencyType: opts.CurrencyType,
+			ChainID:      opts.ChainID,
+		},
+		PrivateKey: ethcrypto.FromECDSA(privKey),
+	})
+	return nil
+}
+
+// mockPhononKey derives the i'th phonon key from seed, or generates a random key if no seed was given
+func mockPhononKey(seed string, i int) (*ecdsa.PrivateKey, error) {
+	if seed == "" {
+		return ethcrypto.GenerateKey()
+	}
+	// retry with a counter on the off chance a digest is not a valid secp256k1 scalar
+	for counter := uint32(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(seed))
+		binary.Write(h, binary.BigEndian, uint32(i))
+		binary.Write(h, binary.BigEndian, counter)
+		privKey, err := ethcrypto.ToECDSA(h.Sum(nil))
+		if err == nil {
+			return privKey, nil
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package gui
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/cors"
+)
+
+// ErrOriginNotAllowed is returned to a browser page on another origin that calls an endpoint previewing, destroying or
+// handing out keys of phonons
+var ErrOriginNotAllowed = errors.New("requests from this origin may not preview, export or redeem phonons or claim their keys. Add it to AllowedOrigins in phonon.yml to allow it")
+
+// browserOrigins are the origins a browser may call the API from: the client's own, which serves the frontend, and
+// those added in the config
+type browserOrigins map[string]bool
+
+func newBrowserOrigins(port string, tls bool, extra []string) browserOrigins {
+	scheme := "http://"
+	if tls {
+		scheme = "https://"
+	}
+	o := make(browserOrigins)
+	for _, host := range []string{"localhost", "127.0.0.1", "[::1]"} {
+		o[scheme+host+":"+port] = true
+	}
+	for _, origin := range extra {
+		o[strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")] = true
+	}
+	return o
+}
+
+// guardedRoutes are the endpoints that preview, destroy or hand out keys of phonons
+var guardedRoutes = []string{
+	"/cards/{sessionID}/phonon/redeem",
+	"/cards/{sessionID}/phonon/redeem/preview",
+	"/cards/{sessionID}/phonon/{PhononIndex}/export",
+	"/cards/{sessionID}/phonon/{PhononIndex}/export/preview",
+	"/jobs/{jobID}/claim",
+	"/recovered/claim",
+}
+
+func (o browserOrigins) list() []string {
+	l := make([]string, 0, len(o))
+	for origin := range o {
+		l = append(l, origin)
+	}
+	return l
+}
+
+/*
+allows reports whether r may be served. Requests without an Origin header are not made by a page in a browser and are
+allowed; the CORS headers only stop a page on another origin from reading a response, not from sending the request.
+*/
+func (o browserOrigins) allows(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || o[strings.ToLower(origin)]
+}
+
+/*
+corsHandler serves h with the CORS headers of options. Pages on any origin may read the responses of most endpoints,
+as they always could, but only the allowed origins those of guardedRoutes, whose handlers also refuse other origins.
+*/
+func (o browserOrigins) corsHandler(h http.Handler, options cors.Options) http.Handler {
+	// matched on path alone, so preflight requests are guarded too
+	guarded := mux.NewRouter()
+	for _, path := range guardedRoutes {
+		guarded.Path(path)
+	}
+	options.AllowedOrigins = []string{"*"}
+	open := cors.New(options).Handler(h)
+	options.AllowedOrigins = o.list()
+	restricted := cors.New(options).Handler(h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var match mux.RouteMatch
+		if guarded.Match(r, &match) {
+			restricted.ServeHTTP(w, r)
+			return
+		}
+		open.ServeHTTP(w, r)
+	})
+}
+
+// refuseOtherOrigin answers r with ORIGIN_NOT_ALLOWED and returns true when it comes from a page on another origin
+func (apiSession apiSession) refuseOtherOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if apiSession.origins.allows(r) {
+		return false
+	}
+	writeAPIError(w, http.StatusForbidden, errKeyOriginNotAllowed, ErrOriginNotAllowed.Error())
+	return true
+}
@@ -0,0 +1,52 @@
+package gui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/cors"
+)
+
+func TestCORSGuardedRoutes(t *testing.T) {
+	origins := newBrowserOrigins("8080", false, []string{"http://localhost:3000/"})
+	h := origins.corsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cors.Options{
+		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+	})
+	tests := []struct {
+		method string
+		path   string
+		origin string
+		want   string
+	}{
+		{"GET", "/listSessions", "https://example.com", "*"},
+		{"GET", "/cards/abc/listPhonons", "http://localhost:3000", "*"},
+		{"POST", "/cards/abc/phonon/redeem", "https://example.com", ""},
+		{"POST", "/cards/abc/phonon/redeem/preview", "https://example.com", ""},
+		{"POST", "/cards/abc/phonon/3/export", "https://example.com", ""},
+		{"POST", "/cards/abc/phonon/3/export/preview", "https://example.com", ""},
+		{"POST", "/jobs/1/claim", "https://example.com", ""},
+		{"POST", "/recovered/claim", "https://example.com", ""},
+		{"POST", "/cards/abc/phonon/3/export", "http://localhost:8080", "http://localhost:8080"},
+		{"POST", "/recovered/claim", "http://localhost:3000", "http://localhost:3000"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+			t.Errorf("%s %s from %s: Access-Control-Allow-Origin %q, want %q", tt.method, tt.path, tt.origin, got, tt.want)
+		}
+	}
+
+	// preflight requests of guarded routes are only answered for allowed origins
+	r := httptest.NewRequest("OPTIONS", "/recovered/claim", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("preflight of a guarded route allowed another origin: %q", got)
+	}
+}
@@ -0,0 +1,314 @@
+package gui
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GridPlus/phonon-client/internal/labels"
+	"github.com/GridPlus/phonon-client/internal/registry"
+	"github.com/GridPlus/phonon-client/internal/validator"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+/*
+listedPhonon is a phonon as listPhonons returns it. It has the fields of model.PhononJSON so existing clients see
+the same objects, plus the value in whole units of the currency when details are requested.
+*/
+type listedPhonon struct {
+	model.PhononJSON
+	// the value in whole units, e.g. "1.5"
+	Amount string `json:",omitempty"`
+	Ticker string `json:",omitempty"`
+	// kept by this client, see /labels
+	Label *labels.Label `json:",omitempty"`
+	// the last on chain check of the phonon, see phonon/validate
+	Validation *validator.Result `json:",omitempty"`
+}
+
+// phononTotal sums the phonons of one currency on one chain
+type phononTotal struct {
+	CurrencyType model.CurrencyType
+	ChainID      int
+	Ticker       string `json:",omitempty"`
+	Chain        string `json:",omitempty"`
+	Count        int
+	// sum in base units
+	Value  string
+	Amount string `json:",omitempty"`
+}
+
+// phononListing is the listPhonons response when details are requested
+type phononListing struct {
+	Phonons []*listedPhonon
+	Totals  []phononTotal
+	// pass as cursor to get the next page. Empty on the last page
+	NextCursor string `json:",omitempty"`
+}
+
+func newListedPhonon(p *model.Phonon) *listedPhonon {
+	lp := &listedPhonon{
+		PhononJSON: model.PhononJSON{
+			KeyIndex:              p.KeyIndex,
+			Address:               p.Address,
+			SchemaVersion:         p.SchemaVersion,
+			ExtendedSchemaVersion: p.ExtendedSchemaVersion,
+			Denomination:          p.Denomination,
+			CurrencyType:          int(p.CurrencyType),
+			ChainID:               p.ChainID,
+		},
+	}
+	if p.PubKey != nil {
+		lp.PubKey = p.PubKey.String()
+	}
+	return lp
+}
+
+/*
+describePhonons fills in the whole unit amounts of the listed phonons and totals matching, which includes phonons on
+other pages, by currency and chain
+*/
+func describePhonons(reg *registry.Registry, listed []*listedPhonon, matching []*model.Phonon) phononListing {
+	for _, p := range listed {
+		if c, ok := reg.Currency(model.CurrencyType(p.CurrencyType)); ok {
+			p.Amount = registry.FormatDecimal(p.Denomination.Value(), c.Decimals)
+			p.Ticker = c.Ticker
+		}
+	}
+	type totalKey struct {
+		currencyType model.CurrencyType
+		chainID      int
+	}
+	sums := make(map[totalKey]*big.Int)
+	counts := make(map[totalKey]int)
+	for _, p := range matching {
+		k := totalKey{p.CurrencyType, p.ChainID}
+		if sums[k] == nil {
+			sums[k] = new(big.Int)
+		}
+		sums[k].Add(sums[k], p.Denomination.Value())
+		counts[k]++
+	}
+
+	totals := []phononTotal{}
+	for k, sum := range sums {
+		t := phononTotal{
+			CurrencyType: k.currencyType,
+			ChainID:      k.chainID,
+			Count:        counts[k],
+			Value:        sum.String(),
+		}
+		if c, ok := reg.Currency(k.currencyType); ok {
+			t.Ticker = c.Ticker
+			t.Amount = registry.FormatDecimal(sum, c.Decimals)
+		}
+		if c, ok := reg.Chain(k.chainID); ok {
+			t.Chain = c.Name
+		}
+		totals = append(totals, t)
+	}
+	sort.Slice(totals, func(a, b int) bool {
+		if totals[a].CurrencyType != totals[b].CurrencyType {
+			return totals[a].CurrencyType < totals[b].CurrencyType
+		}
+		return totals[a].ChainID < totals[b].ChainID
+	})
+	return phononListing{Phonons: listed, Totals: totals}
+}
+
+type phononSort string
+
+const (
+	sortKeyIndex     = phononSort("keyIndex")
+	sortKeyIndexDesc = phononSort("-keyIndex")
+	sortValue        = phononSort("value")
+	sortValueDesc    = phononSort("-value")
+)
+
+var ErrInvalidCursor = errors.New("cursor is invalid or was made for a different sort order")
+
+// phononQuery is the filtering, ordering and paging asked of listPhonons. Bounds are inclusive
+type phononQuery struct {
+	CurrencyType model.CurrencyType
+	MinValue     *big.Int
+	MaxValue     *big.Int
+	MinKeyIndex  *model.PhononKeyIndex
+	MaxKeyIndex  *model.PhononKeyIndex
+	Sort         phononSort
+	// zero returns every matching phonon
+	Limit  int
+	Cursor *phononCursor
+	// leave PubKey empty rather than read it from the card for each phonon
+	SkipPubKeys bool
+	// only phonons whose label has this tag
+	Tag string
+}
+
+// phononCursor is the position of the last phonon of a page in the sort order
+type phononCursor struct {
+	Sort     phononSort
+	Value    string
+	KeyIndex model.PhononKeyIndex
+}
+
+// parsePhononQuery reads listPhonons query parameters
+func parsePhononQuery(v url.Values) (phononQuery, error) {
+	q := phononQuery{Sort: sortKeyIndex}
+	var err error
+	if s := v.Get("currencyType"); s != "" {
+		ct, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return q, fmt.Errorf("invalid currencyType %q", s)
+		}
+		q.CurrencyType = model.CurrencyType(ct)
+	}
+	for name, bound := range map[string]**big.Int{"minValue": &q.MinValue, "maxValue": &q.MaxValue} {
+		if s := v.Get(name); s != "" {
+			*bound, err = parseBaseUnitsString(s)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+	for name, bound := range map[string]**model.PhononKeyIndex{"minKeyIndex": &q.MinKeyIndex, "maxKeyIndex": &q.MaxKeyIndex} {
+		if s := v.Get(name); s != "" {
+			i, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return q, fmt.Errorf("invalid %s %q", name, s)
+			}
+			keyIndex := model.PhononKeyIndex(i)
+			*bound = &keyIndex
+		}
+	}
+	if s := v.Get("sort"); s != "" {
+		q.Sort = phononSort(s)
+		switch q.Sort {
+		case sortKeyIndex, sortKeyIndexDesc, sortValue, sortValueDesc:
+		default:
+			return q, fmt.Errorf("unknown sort %q, use keyIndex or value, prefixed with - for descending order", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		q.Cursor, err = decodePhononCursor(s, q.Sort)
+		if err != nil {
+			return q, err
+		}
+	}
+	q.SkipPubKeys = v.Get("skipPubKeys") == "true"
+	q.Tag = strings.TrimSpace(v.Get("tag"))
+	if q.Tag != "" && q.SkipPubKeys {
+		return q, errors.New("tag needs the phonons' public keys, so it cannot be combined with skipPubKeys")
+	}
+	return q, nil
+}
+
+func decodePhononCursor(s string, order phononSort) (*phononCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &phononCursor{}
+	err = json.Unmarshal(data, c)
+	if err != nil || c.Sort != order {
+		return nil, ErrInvalidCursor
+	}
+	if _, ok := new(big.Int).SetString(c.Value, 10); !ok {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func encodePhononCursor(order phononSort, p *model.Phonon) string {
+	data, _ := json.Marshal(phononCursor{Sort: order, Value: p.Denomination.Value().String(), KeyIndex: p.KeyIndex})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+/*
+cardFilter maps the query onto the filter the card applies when listing. Only the currency is passed on: the mock
+card compares value bounds the wrong way round, so they are left to apply, which checks every bound on the result.
+The session may also answer from its cache without filtering at all.
+*/
+func (q phononQuery) cardFilter() (currencyType model.CurrencyType, lessThan uint64, greaterThan uint64) {
+	return q.CurrencyType, 0, 0
+}
+
+func (q phononQuery) matches(p *model.Phonon) bool {
+	if q.CurrencyType != model.Unspecified && p.CurrencyType != q.CurrencyType {
+		return false
+	}
+	if q.MinKeyIndex != nil && p.KeyIndex < *q.MinKeyIndex {
+		return false
+	}
+	if q.MaxKeyIndex != nil && p.KeyIndex > *q.MaxKeyIndex {
+		return false
+	}
+	value := p.Denomination.Value()
+	if q.MinValue != nil && value.Cmp(q.MinValue) < 0 {
+		return false
+	}
+	if q.MaxValue != nil && value.Cmp(q.MaxValue) > 0 {
+		return false
+	}
+	return true
+}
+
+// compare orders phonons by the query's sort, breaking ties by key index
+func (q phononQuery) compare(aValue *big.Int, aKeyIndex model.PhononKeyIndex, bValue *big.Int, bKeyIndex model.PhononKeyIndex) int {
+	cmp := 0
+	if q.Sort == sortValue || q.Sort == sortValueDesc {
+		cmp = aValue.Cmp(bValue)
+	}
+	if cmp == 0 {
+		switch {
+		case aKeyIndex < bKeyIndex:
+			cmp = -1
+		case aKeyIndex > bKeyIndex:
+			cmp = 1
+		}
+	}
+	if strings.HasPrefix(string(q.Sort), "-") {
+		cmp = -cmp
+	}
+	return cmp
+}
+
+/*
+apply filters and sorts phonons, returning the requested page, every matching phonon, and the cursor of the next
+page if there is one
+*/
+func (q phononQuery) apply(phonons []*model.Phonon) (page []*model.Phonon, matching []*model.Phonon, next string) {
+	matching = []*model.Phonon{}
+	for _, p := range phonons {
+		if q.matches(p) {
+			matching = append(matching, p)
+		}
+	}
+	sort.Slice(matching, func(a, b int) bool {
+		return q.compare(matching[a].Denomination.Value(), matching[a].KeyIndex, matching[b].Denomination.Value(), matching[b].KeyIndex) < 0
+	})
+	page = matching
+	if q.Cursor != nil {
+		cursorValue, _ := new(big.Int).SetString(q.Cursor.Value, 10)
+		start := sort.Search(len(page), func(i int) bool {
+			return q.compare(page[i].Denomination.Value(), page[i].KeyIndex, cursorValue, q.Cursor.KeyIndex) > 0
+		})
+		page = page[start:]
+	}
+	if q.Limit > 0 && len(page) > q.Limit {
+		page = page[:q.Limit]
+		next = encodePhononCursor(q.Sort, page[len(page)-1])
+	}
+	return page, matching, next
+}
@@ -0,0 +1,424 @@
+package gui
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/journal"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long a proposal waits for the receiver when the config does not say
+const defaultProposalExpiry = 10 * time.Minute
+
+type proposalState string
+
+const (
+	proposalPending   = proposalState("pending")
+	proposalExecuting = proposalState("executing")
+	proposalCompleted = proposalState("completed")
+	proposalFailed    = proposalState("failed")
+	proposalRejected  = proposalState("rejected")
+	proposalCancelled = proposalState("cancelled")
+	proposalExpired   = proposalState("expired")
+)
+
+var ErrProposalNotFound = errors.New("proposal not found")
+var ErrProposalNotPending = errors.New("proposal is no longer pending")
+var ErrCounterpartyNotLocal = errors.New("transfer proposals need a counterparty connected to this terminal")
+
+/*
+transferProposal is an offer of phonons from one card to the card it is paired with. The phonons only move once the
+receiving side accepts. Proposals travel within this terminal only: the remote pairing protocol has no message to
+carry them, so both cards must be connected here, as with connectLocal.
+*/
+type transferProposal struct {
+	ID             string
+	SenderCardID   string
+	ReceiverCardID string
+	Phonons        []journal.PhononRef
+	State          proposalState
+	Created        time.Time
+	Expires        time.Time
+	Reason         string        `json:",omitempty"`
+	Result         *sendResponse `json:",omitempty"`
+}
+
+type proposalBook struct {
+	mtex      sync.Mutex
+	expiry    time.Duration
+	proposals map[string]*transferProposal
+}
+
+func newProposalBook(expiry time.Duration) *proposalBook {
+	if expiry <= 0 {
+		expiry = defaultProposalExpiry
+	}
+	return &proposalBook{
+		expiry:    expiry,
+		proposals: make(map[string]*transferProposal),
+	}
+}
+
+// expire moves pending proposals past their expiry to the expired state. Must be called with pb.mtex held
+func (pb *proposalBook) expire() {
+	now := time.Now()
+	for _, p := range pb.proposals {
+		if p.State == proposalPending && now.After(p.Expires) {
+			p.State = proposalExpired
+		}
+	}
+}
+
+// add records p as a new pending proposal and returns a copy of it
+func (pb *proposalBook) add(p *transferProposal) (transferProposal, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return transferProposal{}, err
+	}
+	p.ID = hex.EncodeToString(id)
+	p.State = proposalPending
+	p.Created = time.Now()
+	p.Expires = p.Created.Add(pb.expiry)
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	pb.proposals[p.ID] = p
+	return *p, nil
+}
+
+// list returns the proposals for which match is true, newest first
+func (pb *proposalBook) list(match func(p *transferProposal) bool) []transferProposal {
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	pb.expire()
+	ret := []transferProposal{}
+	for _, p := range pb.proposals {
+		if match(p) {
+			ret = append(ret, *p)
+		}
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		return ret[a].Created.After(ret[b].Created)
+	})
+	return ret
+}
+
+// pending returns the pending proposal id of which cardID is the receiver, or the sender when sender is true
+func (pb *proposalBook) pending(id string, cardID string, sender bool) (transferProposal, error) {
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	p, err := pb.find(id, cardID, sender)
+	if p == nil {
+		return transferProposal{}, err
+	}
+	return *p, err
+}
+
+// find looks up the pending proposal id for pending and settle. Must be called with pb.mtex held
+func (pb *proposalBook) find(id string, cardID string, sender bool) (*transferProposal, error) {
+	pb.expire()
+	p, ok := pb.proposals[id]
+	if !ok || (!sender && p.ReceiverCardID != cardID) || (sender && p.SenderCardID != cardID) {
+		return nil, ErrProposalNotFound
+	}
+	if p.State != proposalPending {
+		return p, ErrProposalNotPending
+	}
+	return p, nil
+}
+
+/*
+settle moves the pending proposal id to state if cardID is the receiver (or, when sender is true, the sender), and
+returns a copy of it.
+*/
+func (pb *proposalBook) settle(id string, cardID string, sender bool, state proposalState, reason string) (transferProposal, error) {
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	p, err := pb.find(id, cardID, sender)
+	if err != nil {
+		if p == nil {
+			return transferProposal{}, err
+		}
+		return *p, err
+	}
+	p.State = state
+	p.Reason = reason
+	return *p, nil
+}
+
+func (pb *proposalBook) finish(id string, resp sendResponse, err error) {
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	p := pb.proposals[id]
+	p.Result = &resp
+	if err != nil {
+		p.State = proposalFailed
+		p.Reason = err.Error()
+	} else {
+		p.State = proposalCompleted
+	}
+}
+
+// holds returns the ID of a pending proposal from cardID that includes the phonon at keyIndex
+func (pb *proposalBook) holds(cardID string, keyIndex model.PhononKeyIndex, pubKey string) (string, bool) {
+	pb.mtex.Lock()
+	defer pb.mtex.Unlock()
+	pb.expire()
+	for _, p := range pb.proposals {
+		if p.SenderCardID != cardID || p.State != proposalPending {
+			continue
+		}
+		for _, ph := range p.Phonons {
+			if ph.KeyIndex == keyIndex && (pubKey == "" || strings.EqualFold(ph.PubKey, pubKey)) {
+				return p.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// localCounterparty returns the session of the card sess is paired with, which must be connected to this terminal
+func (apiSession apiSession) localCounterparty(sess *orchestrator.Session) (*orchestrator.Session, error) {
+	if sess.RemoteCard == nil {
+		return nil, orchestrator.ErrCardNotPairedToCard
+	}
+	err := sess.RemoteCard.VerifyPaired()
+	if err != nil {
+		return nil, err
+	}
+	crt, err := sess.RemoteCard.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+	counterparty := apiSession.t.SessionFromID(cardIDFromPubKey(crt.PubKey))
+	if counterparty == nil {
+		return nil, ErrCounterpartyNotLocal
+	}
+	return counterparty, nil
+}
+
+func (apiSession apiSession) proposeTransfer(w http.ResponseWriter, r *http.Request) {
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	reqs, err := parseSendRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	counterparty, err := apiSession.localCounterparty(sess)
+	if err != nil {
+		http.Error(w, "unable to propose transfer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "proposeTransfer")
+	if !ok {
+		return
+	}
+	defer op.done()
+	resp, toSend, err := apiSession.checkSend(op, sess, reqs)
+	if writeOperationError(w, op, err) {
+		return
+	}
+	enc := json.NewEncoder(w)
+	switch {
+	case err == ErrSendInvalid:
+		w.WriteHeader(http.StatusBadRequest)
+		enc.Encode(resp)
+		return
+	case err != nil:
+		http.Error(w, "unable to check phonons: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p, err := apiSession.proposals.add(&transferProposal{
+		SenderCardID:   sess.GetCardId(),
+		ReceiverCardID: counterparty.GetCardId(),
+		Phonons:        journal.PhononRefs(toSend),
+	})
+	if err != nil {
+		http.Error(w, "unable to create proposal: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf("card %s proposed transfer %s to card %s", p.SenderCardID, p.ID, p.ReceiverCardID)
+	enc.Encode(p)
+}
+
+func (apiSession apiSession) incomingProposals(w http.ResponseWriter, r *http.Request) {
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cardID := sess.GetCardId()
+	all := r.URL.Query().Get("all") == "true"
+	enc := json.NewEncoder(w)
+	enc.Encode(apiSession.proposals.list(func(p *transferProposal) bool {
+		return p.ReceiverCardID == cardID && (all || p.State == proposalPending)
+	}))
+}
+
+func (apiSession apiSession) outgoingProposals(w http.ResponseWriter, r *http.Request) {
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	cardID := sess.GetCardId()
+	all := r.URL.Query().Get("all") == "true"
+	enc := json.NewEncoder(w)
+	enc.Encode(apiSession.proposals.list(func(p *transferProposal) bool {
+		return p.SenderCardID == cardID && (all || p.State == proposalPending)
+	}))
+}
+
+// acceptProposal is called by the receiving card's session and executes the transfer from the sending card
+func (apiSession apiSession) acceptProposal(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sess, err := apiSession.sessionFromMuxVars(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	p, err := apiSession.proposals.pending(vars["proposalID"], sess.GetCardId(), false)
+	if writeProposalError(w, err) {
+		return
+	}
+	// until the sending card is held the proposal stays pending, so it can be accepted again if the card is busy
+	sender := apiSession.t.SessionFromID(p.SenderCardID)
+	if sender == nil {
+		http.Error(w, "sending card is no longer connected", http.StatusConflict)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sender, "acceptProposal")
+	if !ok {
+		return
+	}
+	defer op.done()
+	// the proposal may have been cancelled or have expired while waiting for the card
+	p, err = apiSession.proposals.settle(p.ID, sess.GetCardId(), false, proposalExecuting, "")
+	if writeProposalError(w, err) {
+		return
+	}
+	// the proposing card may have been paired to another card since the proposal was made
+	var counterparty string
+	err = op.run(func() error {
+		if sender.RemoteCard == nil {
+			return nil
+		}
+		crt, err := sender.RemoteCard.GetCertificate()
+		if err != nil {
+			return err
+		}
+		counterparty = cardIDFromPubKey(crt.PubKey)
+		return nil
+	})
+	if err == nil && !strings.EqualFold(counterparty, p.ReceiverCardID) {
+		err = errors.New("proposing card is not paired with the receiving card, nothing was sent")
+		if counterparty != "" {
+			err = fmt.Errorf("proposing card is paired with %s rather than the receiving card, nothing was sent", counterparty)
+		}
+		apiSession.proposals.finish(p.ID, sendResponse{}, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		apiSession.proposals.finish(p.ID, sendResponse{}, operationError(op, err))
+		if writeOperationError(w, op, err) {
+			return
+		}
+		http.Error(w, "unable to read the proposing card's counterparty: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reqs := make([]sendPhononRequest, 0, len(p.Phonons))
+	for i := range p.Phonons {
+		reqs = append(reqs, sendPhononRequest{KeyIndex: &p.Phonons[i].KeyIndex, PubKey: p.Phonons[i].PubKey})
+	}
+	resp, err := apiSession.sendWithResults(op, sender, reqs)
+	apiSession.proposals.finish(p.ID, resp, operationError(op, err))
+	if writeOperationError(w, op, err) {
+		return
+	}
+	switch {
+	case err == nil:
+	case err == ErrSendInvalid:
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+func (apiSession apiSession) rejectProposal(w http.ResponseWriter, r *http.Request) {
+	apiSession.closeProposal(w, r, false, proposalRejected)
+}
+
+func (apiSession apiSession) cancelProposal(w http.ResponseWriter, r *http.Request) {
+	apiSession.closeProposal(w, r, true, proposalCancelled)
+}
+
+// closeProposal ends a pending proposal without a transfer, on behalf of the receiver or the sender
+func (apiSession apiSession) closeProposal(w http.ResponseWriter, r *http.Request, sender bool, state proposalState) {
+	vars := mux.Vars(r)
+	sess, err := apiSession.sessionFromMuxVars(vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	closeReq := struct {
+		Reason string `json:"reason"`
+	}{}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &closeReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	p, err := apiSession.proposals.settle(vars["proposalID"], sess.GetCardId(), sender, state, closeReq.Reason)
+	if writeProposalError(w, err) {
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(p)
+}
+
+// writeProposalError writes the response for an error settling a proposal, returning true if there was one
+func writeProposalError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case ErrProposalNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrProposalNotPending:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package gui
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/GridPlus/phonon-client/internal/keyexport"
+	"github.com/GridPlus/phonon-client/internal/recovered"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// recoveryTokenHeader carries the token that recovered keys were kept under, to claim them
+const recoveryTokenHeader = "X-Recovery-Token"
+
+/*
+keepKey keeps the private key of a destroyed phonon that could not be returned, such as when its request went away
+before it was answered, so that the key is not lost with the response. The key is sealed under token, which the
+caller already holds: the confirmation token of the request, or the token of its job. It is handed back once, to
+whoever claims it with that token, encoded as format, which is how the request would have returned it.
+*/
+func (apiSession apiSession) keepKey(token string, cardID string, keyIndex model.PhononKeyIndex, format keyexport.Format, privKey string) {
+	err := apiSession.recovered.Keep(token, cardID, keyIndex, string(format), privKey)
+	if err != nil {
+		log.Errorf("unable to keep the key of key index %d of card %s, which could not be returned: %s", keyIndex, cardID, err)
+		return
+	}
+	log.Warnf("the private key of key index %d of card %s could not be returned and was kept until it is claimed with its request's token", keyIndex, cardID)
+}
+
+// claimRecoveredKeys hands the keys kept under the token of an export or redemption that went away to its caller once
+func (apiSession apiSession) claimRecoveredKeys(w http.ResponseWriter, r *http.Request) {
+	if apiSession.refuseOtherOrigin(w, r) {
+		return
+	}
+	keys, err := apiSession.recovered.Claim(r.Header.Get(recoveryTokenHeader))
+	switch err {
+	case nil:
+	case recovered.ErrWrongToken:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case recovered.ErrNoKeys:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.Encode(keys)
+}
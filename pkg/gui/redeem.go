@@ -0,0 +1,180 @@
+package gui
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/GridPlus/phonon-client/internal/address"
+	"github.com/GridPlus/phonon-client/internal/onchain"
+	"github.com/PhononDAO/phonon-core/pkg/chain"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrRedeemAddressInvalid = errors.New("invalid redeem address")
+	ErrPhononMismatch       = errors.New("redeem request does not match the phonon on the card")
+)
+
+func dryRunRequested(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == "true"
+}
+
+// checkRedeemAddresses validates every redeem address for the currency of its phonon, listing all that are invalid
+func checkRedeemAddresses(reqs []*redeemPhononRequest) error {
+	var problems []string
+	for i, req := range reqs {
+		_, err := address.Validate(req.P.CurrencyType, req.RedeemAddress)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("request %d: %s", i, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrRedeemAddressInvalid, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+/*
+matchRedeem checks that each requested phonon is the one on the card, as described by onCard in the same order, so
+that nothing the client sent about a phonon but its key index is trusted. The address each phonon is redeemed from is
+cleared to be derived again from its public key.
+*/
+func matchRedeem(reqs []*redeemPhononRequest, onCard []confirmedPhonon) error {
+	var problems []string
+	for i, req := range reqs {
+		p, want := req.P, onCard[i]
+		var mismatched []string
+		if p.PubKey == nil || !strings.EqualFold(strings.TrimPrefix(p.PubKey.String(), "0x"), strings.TrimPrefix(want.PubKey, "0x")) {
+			mismatched = append(mismatched, "public key")
+		}
+		if p.CurrencyType != want.CurrencyType {
+			mismatched = append(mismatched, "currency type")
+		}
+		if p.ChainID != want.ChainID {
+			mismatched = append(mismatched, "chain ID")
+		}
+		if p.Denomination.Value().String() != want.Value {
+			mismatched = append(mismatched, "denomination")
+		}
+		if len(mismatched) > 0 {
+			problems = append(problems, fmt.Sprintf("request %d, key index %d: %s", i, p.KeyIndex, strings.Join(mismatched, ", ")))
+		}
+		p.Address = ""
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrPhononMismatch, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+/*
+writeRedeemError writes the error response for a redeem request that failed validation or confirmation, returning
+false without writing anything when err is nil. op may be nil before the card is locked.
+*/
+func writeRedeemError(w http.ResponseWriter, op *operation, err error) bool {
+	switch {
+	case errors.Is(err, ErrRedeemAddressInvalid):
+		writeAPIError(w, http.StatusBadRequest, errKeyRedeemAddressInvalid, err.Error())
+	case errors.Is(err, ErrPhononMismatch):
+		writeAPIError(w, http.StatusConflict, errKeyPhononMismatch, err.Error())
+	case errors.Is(err, ErrPhononNotFound):
+		writeAPIError(w, http.StatusNotFound, errKeyPhononMismatch, err.Error())
+	default:
+		return writeConfirmationError(w, op, err)
+	}
+	return true
+}
+
+// redeemTransaction is the transaction a redeem would submit, before it is signed
+type redeemTransaction struct {
+	Type    string
+	ChainID int
+	From    string
+	To      string
+	// the phonon's denomination in base units. The transaction sends the on chain balance of From less the fee
+	MaxValue string
+	GasLimit uint64
+	// whether this client signs and submits the transaction through the chain's RPC endpoint, which reports the rest
+	Broadcast bool
+	Nonce     *uint64 `json:",omitempty"`
+	Balance   string  `json:",omitempty"`
+	GasPrice  string  `json:",omitempty"`
+	Fee       string  `json:",omitempty"`
+	// base units sent to To
+	Value string `json:",omitempty"`
+}
+
+// redeemPlan is what a redeem would do with one phonon
+type redeemPlan struct {
+	Phonon confirmedPhonon
+	// RedeemAddress in canonical form
+	RedeemAddress string
+	Transaction   *redeemTransaction `json:",omitempty"`
+	// why the phonon could not be redeemed. The card refuses before destroying it
+	Err string `json:",omitempty"`
+}
+
+// planRedeem describes the transaction that redeeming p, as described by onCard, to redeemAddress would build
+func (apiSession apiSession) planRedeem(ctx context.Context, p *model.Phonon, onCard confirmedPhonon, redeemAddress string) redeemPlan {
+	plan := redeemPlan{Phonon: onCard}
+	plan.Phonon.RedeemAddress = redeemAddress
+	plan.RedeemAddress, _ = address.Validate(p.CurrencyType, redeemAddress)
+	// only Ethereum has a chain service to redeem through, unless the chain has an RPC endpoint
+	sweeps := apiSession.sweeps(p)
+	if p.CurrencyType != model.Ethereum && !sweeps {
+		plan.Err = chain.ErrCurrencyTypeUnsupported.Error()
+		return plan
+	}
+	pubKey, err := model.PhononPubKeyToECDSA(p.PubKey)
+	if err != nil {
+		plan.Err = err.Error()
+		return plan
+	}
+	plan.Transaction = &redeemTransaction{
+		Type:     "legacy",
+		ChainID:  p.ChainID,
+		From:     ethcrypto.PubkeyToAddress(*pubKey).Hex(),
+		To:       plan.RedeemAddress,
+		MaxValue: onCard.Value,
+		GasLimit: onchain.SweepGasLimit,
+	}
+	if sweeps {
+		apiSession.planSweep(ctx, p, &plan)
+	}
+	return plan
+}
+
+/*
+dryRunRedeem answers a redeem request with what it would do, validating it against the card without destroying
+anything. It needs no confirmation token.
+*/
+func (apiSession apiSession) dryRunRedeem(w http.ResponseWriter, r *http.Request, sess *orchestrator.Session, reqs []*redeemPhononRequest, keyIndices []model.PhononKeyIndex) {
+	op, ok := apiSession.lockCard(w, r, sess, "redeemDryRun")
+	if !ok {
+		return
+	}
+	defer op.done()
+	onCard, err := apiSession.describeOnCard(op, sess, keyIndices)
+	if err == nil {
+		err = matchRedeem(reqs, onCard)
+	}
+	if writeRedeemError(w, op, err) {
+		return
+	}
+	plans := make([]redeemPlan, 0, len(reqs))
+	for i, req := range reqs {
+		plans = append(plans, apiSession.planRedeem(op.ctx, req.P, onCard[i], req.RedeemAddress))
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(plans)
+	if err != nil {
+		log.Error("unable to encode redeem dry run: ", err)
+	}
+}
@@ -0,0 +1,16 @@
+package gui
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func (apiSession apiSession) listCurrencies(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	enc.Encode(apiSession.registry.Currencies())
+}
+
+func (apiSession apiSession) listChains(w http.ResponseWriter, r *http.Request) {
+	enc := json.NewEncoder(w)
+	enc.Encode(apiSession.registry.Chains())
+}
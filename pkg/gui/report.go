@@ -0,0 +1,153 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/deposits"
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/GridPlus/phonon-client/internal/report"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+parseReportTime reads a report bound, either an RFC 3339 time or a date. A date as the end of the period includes
+the whole day
+*/
+func parseReportTime(s string, end bool) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("invalid time %q, expected an RFC 3339 time or a date", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func parseReportPeriod(v url.Values) (from, to time.Time, err error) {
+	if s := v.Get("from"); s != "" {
+		from, err = parseReportTime(s, false)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		to, err = parseReportTime(s, true)
+		if err != nil {
+			return from, to, err
+		}
+	}
+	if !to.IsZero() && !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+// cardHoldings lists what the session's card holds now, waiting for the card if another operation is using it
+func (apiSession apiSession) cardHoldings(r *http.Request, sess *orchestrator.Session) report.Holdings {
+	h := report.Holdings{CardID: sess.GetCardId()}
+	h.Name, _ = sess.GetName()
+	if !sess.IsUnlocked() {
+		h.Err = errors.New("card is locked")
+		return h
+	}
+	op := apiSession.startOperation(r.Context(), "report")
+	defer op.done()
+	err := apiSession.acquireCard(op, sess, r.URL.Query().Get("wait") != "false")
+	if err == nil {
+		err = op.run(func() error {
+			phonons, err := sess.ListPhonons(0, 0, 0)
+			if err == nil {
+				h.Phonons = phonons
+			}
+			return err
+		})
+	}
+	if err != nil {
+		// an abandoned call may still be filling in the holdings
+		return report.Holdings{CardID: h.CardID, Name: h.Name, Err: err}
+	}
+	for _, d := range apiSession.deposits.List(h.CardID) {
+		if d.Status != deposits.StatusFinalized && d.Phonon != nil && d.Phonon.PubKey != nil {
+			h.Unfunded = append(h.Unfunded, d.Phonon.PubKey.String())
+		}
+	}
+	return h
+}
+
+/*
+buildReport states holdings and movements for the period of the request, for cardID or, when it is empty, for every
+connected card and every card with movements in the period
+*/
+func (apiSession apiSession) buildReport(r *http.Request, cardID string, from, to time.Time) report.Report {
+	now := time.Now().UTC()
+	events := apiSession.history.Query(history.Filter{CardID: cardID, Kinds: report.Kinds, From: from})
+
+	var cards []report.Holdings
+	seen := make(map[string]bool)
+	for _, sess := range apiSession.t.ListSessions() {
+		id := sess.GetCardId()
+		if cardID != "" && !strings.EqualFold(id, cardID) {
+			continue
+		}
+		seen[id] = true
+		cards = append(cards, apiSession.cardHoldings(r, sess))
+	}
+	for _, e := range events {
+		if seen[e.CardID] || (!to.IsZero() && !e.Time.Before(to)) {
+			continue
+		}
+		seen[e.CardID] = true
+		cards = append(cards, report.Holdings{CardID: e.CardID, Err: errors.New("card is not connected")})
+	}
+	if cardID != "" && len(cards) == 0 {
+		cards = append(cards, report.Holdings{CardID: cardID, Err: errors.New("card is not connected")})
+	}
+	return report.Build(apiSession.registry, cards, events, from, to, now)
+}
+
+func (apiSession apiSession) accountingReport(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from, to, err := parseReportPeriod(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	switch format {
+	case "":
+		format = "json"
+	case "json", "csv", "html":
+	default:
+		http.Error(w, "unknown format, use json, csv or html", http.StatusBadRequest)
+		return
+	}
+	rep := apiSession.buildReport(r, query.Get("cardID"), from, to)
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		err = enc.Encode(rep)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="phonon-statement.csv"`)
+		err = report.WriteCSV(w, rep)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = report.WriteHTML(w, rep)
+	}
+	if err != nil {
+		log.Error("unable to write report: ", err)
+	}
+}
@@ -0,0 +1,334 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type selectionStrategy string
+
+const (
+	// after an exact match, prefer the smallest overshoot, then the fewest phonons
+	selectMinOvershoot = selectionStrategy("minOvershoot")
+	// after an exact match, prefer the fewest phonons, then the smallest overshoot
+	selectFewestPhonons = selectionStrategy("fewestPhonons")
+)
+
+// the number of subsets the selection search visits before settling for the best one found so far
+const selectionSearchLimit = 100000
+
+var ErrInsufficientFunds = errors.New("the card does not hold enough unlocked phonons of this currency")
+
+type sendAmountRequest struct {
+	CurrencyType model.CurrencyType
+	// amount in the currency's base units, as a decimal string
+	Amount   string
+	Strategy selectionStrategy
+	// send the phonons selected by the preview whose token is in the X-Confirmation-Token header
+	Confirm bool
+}
+
+type selectedPhonon struct {
+	KeyIndex     model.PhononKeyIndex
+	PubKey       string
+	Denomination model.Denomination
+}
+
+type phononSelection struct {
+	CurrencyType model.CurrencyType
+	Strategy     selectionStrategy
+	Amount       string
+	Total        string
+	// how much the selected phonons exceed the amount. The counterparty owes this back as change
+	Remainder string
+	Exact     bool
+	Phonons   []selectedPhonon
+	// the request body for phonon/send that commits this selection
+	SendRequest []sendPhononRequest
+	// the token that sends exactly these phonons when the request is repeated with Confirm, returned by the preview
+	Confirmation *confirmation `json:",omitempty"`
+	// the outcome of the send when the request was confirmed
+	Send *sendResponse `json:",omitempty"`
+	// the amounts in whole units, for showing to the user
+	Display *selectionDisplay `json:",omitempty"`
+	// the selected phonons as the card described them, to check against before they are sent
+	confirmed []confirmedPhonon
+}
+
+type selectionDisplay struct {
+	Amount    string
+	Total     string
+	Remainder string
+}
+
+// parseSendAmountRequest decodes and checks a send by amount request body without consulting the card
+func parseSendAmountRequest(body []byte) (sendAmountRequest, *big.Int, error) {
+	var req sendAmountRequest
+	err := json.Unmarshal(body, &req)
+	if err != nil {
+		return req, nil, fmt.Errorf("unable to decode send amount request: %w", err)
+	}
+	amount, ok := new(big.Int).SetString(req.Amount, 10)
+	if !ok || amount.Sign() <= 0 {
+		return req, nil, fmt.Errorf("amount %q is not a positive integer of base units", req.Amount)
+	}
+	switch req.Strategy {
+	case "":
+		req.Strategy = selectMinOvershoot
+	case selectMinOvershoot, selectFewestPhonons:
+	default:
+		return req, nil, fmt.Errorf("unknown selection strategy %q", req.Strategy)
+	}
+	return req, amount, nil
+}
+
+/*
+sendAmount selects phonons of one currency covering an amount and returns the selection with a confirmation token.
+Repeating the request with Confirm and the token sends exactly the selected phonons in a single transfer, provided
+the card still holds them as they were selected.
+*/
+func (apiSession apiSession) sendAmount(w http.ResponseWriter, r *http.Request) {
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Unable to read body", http.StatusBadRequest)
+		return
+	}
+	req, amount, err := parseSendAmountRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := apiSession.registry.Currency(req.CurrencyType); !ok {
+		http.Error(w, fmt.Sprintf("unknown currency type %d, see /currencies", req.CurrencyType), http.StatusBadRequest)
+		return
+	}
+	if req.Confirm {
+		apiSession.sendSelection(w, r, sess, req, amount)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "sendAmount")
+	if !ok {
+		return
+	}
+	defer op.done()
+	selection, err := apiSession.selectPhonons(op, sess, req.CurrencyType, amount, req.Strategy)
+	if writeOperationError(w, op, err) {
+		return
+	}
+	if err == ErrInsufficientFunds {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "unable to select phonons: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	previewed := selection
+	c, err := apiSession.confirmations.issue(confirmation{
+		Operation: confirmSendAmount,
+		CardID:    sess.GetCardId(),
+		Phonons:   selection.confirmed,
+		selection: &previewed,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	selection.Confirmation = &c
+	enc := json.NewEncoder(w)
+	err = enc.Encode(selection)
+	if err != nil {
+		log.Error("unable to encode phonon selection: ", err)
+	}
+}
+
+// sendSelection sends the phonons of the previewed selection whose token r carries, if req asks for the same amount
+func (apiSession apiSession) sendSelection(w http.ResponseWriter, r *http.Request, sess *orchestrator.Session, req sendAmountRequest, amount *big.Int) {
+	c, err := apiSession.confirmations.take(r.Header.Get(confirmationTokenHeader), confirmSendAmount, sess.GetCardId())
+	if err == nil && (c.selection.CurrencyType != req.CurrencyType || c.selection.Amount != amount.String() || c.selection.Strategy != req.Strategy) {
+		err = ErrConfirmationInvalid
+	}
+	if writeConfirmationError(w, nil, err) {
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "sendAmount")
+	if !ok {
+		return
+	}
+	defer op.done()
+	err = apiSession.verifyConfirmed(op, sess, c, "")
+	if writeConfirmationError(w, op, err) {
+		return
+	}
+	selection := *c.selection
+	resp, err := apiSession.sendWithResults(op, sess, selection.SendRequest)
+	if writeOperationError(w, op, err) {
+		return
+	}
+	selection.Send = &resp
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	enc := json.NewEncoder(w)
+	err = enc.Encode(selection)
+	if err != nil {
+		log.Error("unable to encode phonon selection: ", err)
+	}
+}
+
+/*
+selectPhonons picks phonons of currencyType on the card whose values add up to at least amount. A set adding up to
+exactly amount is always preferred; otherwise strategy decides between overshoot and phonon count. Phonons held by
+unsettled transfers or proposals are left out. Returns ErrInsufficientFunds if the eligible phonons fall short.
+*/
+func (apiSession apiSession) selectPhonons(op *operation, sess *orchestrator.Session, currencyType model.CurrencyType, amount *big.Int, strategy selectionStrategy) (phononSelection, error) {
+	selection := phononSelection{
+		CurrencyType: currencyType,
+		Strategy:     strategy,
+		Amount:       amount.String(),
+	}
+	var phonons []*model.Phonon
+	err := op.run(func() (err error) {
+		phonons, err = sess.ListPhonons(currencyType, 0, 0)
+		return err
+	})
+	if err != nil {
+		return selection, err
+	}
+	cardID := sess.GetCardId()
+	eligible := []*model.Phonon{}
+	for _, p := range phonons {
+		if p.CurrencyType != currencyType {
+			continue
+		}
+		if _, locked := apiSession.phononLocked(cardID, p.KeyIndex, ""); locked {
+			continue
+		}
+		eligible = append(eligible, p)
+	}
+	chosen := choosePhonons(eligible, amount, strategy)
+	if chosen == nil {
+		return selection, ErrInsufficientFunds
+	}
+
+	total := new(big.Int)
+	for _, p := range chosen {
+		var pubKey model.PhononPubKey
+		err = op.run(func() (err error) {
+			pubKey, err = sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+			return err
+		})
+		if err != nil {
+			return selection, err
+		}
+		keyIndex := p.KeyIndex
+		selection.Phonons = append(selection.Phonons, selectedPhonon{
+			KeyIndex:     p.KeyIndex,
+			PubKey:       pubKey.String(),
+			Denomination: p.Denomination,
+		})
+		selection.SendRequest = append(selection.SendRequest, sendPhononRequest{KeyIndex: &keyIndex, PubKey: pubKey.String()})
+		selection.confirmed = append(selection.confirmed, newConfirmedPhonon(apiSession.registry, p, pubKey))
+		total.Add(total, p.Denomination.Value())
+	}
+	selection.Total = total.String()
+	remainder := new(big.Int).Sub(total, amount)
+	selection.Remainder = remainder.String()
+	selection.Exact = remainder.Sign() == 0
+	selection.Display = &selectionDisplay{
+		Amount:    apiSession.registry.FormatAmount(currencyType, amount),
+		Total:     apiSession.registry.FormatAmount(currencyType, total),
+		Remainder: apiSession.registry.FormatAmount(currencyType, remainder),
+	}
+	return selection, nil
+}
+
+/*
+choosePhonons searches subsets of phonons for the best cover of amount under strategy, returning nil if all of them
+together fall short. The search is exhaustive for small cards and gives up after selectionSearchLimit subsets on
+large ones, keeping the best cover found, which starts out as the greedy largest-first pick.
+*/
+func choosePhonons(phonons []*model.Phonon, amount *big.Int, strategy selectionStrategy) []*model.Phonon {
+	sorted := append([]*model.Phonon{}, phonons...)
+	values := make(map[*model.Phonon]*big.Int, len(sorted))
+	for _, p := range sorted {
+		values[p] = p.Denomination.Value()
+	}
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return values[sorted[a]].Cmp(values[sorted[b]]) > 0
+	})
+	// remaining[i] is the sum of the values from i onwards, to prune branches that can no longer reach amount
+	remaining := make([]*big.Int, len(sorted)+1)
+	remaining[len(sorted)] = new(big.Int)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = new(big.Int).Add(remaining[i+1], values[sorted[i]])
+	}
+	if remaining[0].Cmp(amount) < 0 {
+		return nil
+	}
+
+	var best []*model.Phonon
+	var bestOvershoot *big.Int
+	better := func(overshoot *big.Int, count int) bool {
+		if best == nil {
+			return true
+		}
+		cmp := overshoot.Cmp(bestOvershoot)
+		if (overshoot.Sign() == 0) != (bestOvershoot.Sign() == 0) {
+			return overshoot.Sign() == 0
+		}
+		if strategy == selectFewestPhonons && count != len(best) {
+			return count < len(best)
+		}
+		if cmp != 0 {
+			return cmp < 0
+		}
+		return count < len(best)
+	}
+
+	visited := 0
+	current := []*model.Phonon{}
+	var search func(i int, sum *big.Int)
+	search = func(i int, sum *big.Int) {
+		visited++
+		if sum.Cmp(amount) >= 0 {
+			// adding more phonons can only add overshoot and count
+			overshoot := new(big.Int).Sub(sum, amount)
+			if better(overshoot, len(current)) {
+				best = append([]*model.Phonon{}, current...)
+				bestOvershoot = overshoot
+			}
+			return
+		}
+		if i == len(sorted) || visited > selectionSearchLimit {
+			return
+		}
+		if new(big.Int).Add(sum, remaining[i]).Cmp(amount) < 0 {
+			return
+		}
+		if best != nil && bestOvershoot.Sign() == 0 && len(current)+1 >= len(best) {
+			// an exact cover with no more phonons than this branch could reach is already known
+			return
+		}
+		current = append(current, sorted[i])
+		search(i+1, new(big.Int).Add(sum, values[sorted[i]]))
+		current = current[:len(current)-1]
+		search(i+1, sum)
+	}
+	search(0, new(big.Int))
+	return best
+}
@@ -0,0 +1,88 @@
+package gui
+
+import (
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+)
+
+// phononsOf makes a phonon of each value, with key indices counting from 1
+func phononsOf(t *testing.T, values ...int64) []*model.Phonon {
+	t.Helper()
+	phonons := []*model.Phonon{}
+	for i, v := range values {
+		d, err := model.NewDenomination(big.NewInt(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		phonons = append(phonons, &model.Phonon{KeyIndex: model.PhononKeyIndex(i + 1), Denomination: d})
+	}
+	return phonons
+}
+
+func chosenValues(chosen []*model.Phonon) string {
+	values := []int64{}
+	for _, p := range chosen {
+		values = append(values, p.Denomination.Value().Int64())
+	}
+	sort.Slice(values, func(a, b int) bool { return values[a] > values[b] })
+	s := []string{}
+	for _, v := range values {
+		s = append(s, big.NewInt(v).String())
+	}
+	return strings.Join(s, " ")
+}
+
+func TestChoosePhonons(t *testing.T) {
+	tests := []struct {
+		values   []int64
+		amount   int64
+		strategy selectionStrategy
+		want     string
+	}{
+		// an exact match wins under either strategy, even over a single phonon with overshoot
+		{[]int64{100, 30, 20, 50}, 50, selectMinOvershoot, "50"},
+		{[]int64{100, 30, 20}, 50, selectMinOvershoot, "30 20"},
+		{[]int64{100, 30, 20}, 50, selectFewestPhonons, "30 20"},
+		// of the exact matches, the fewest phonons
+		{[]int64{10, 10, 10, 10, 10, 25, 25}, 50, selectMinOvershoot, "25 25"},
+		// no exact match: the smallest overshoot, or the fewest phonons
+		{[]int64{100, 40, 20}, 55, selectMinOvershoot, "40 20"},
+		{[]int64{100, 40, 20}, 55, selectFewestPhonons, "100"},
+		// of the smallest overshoots, the fewest phonons
+		{[]int64{70, 40, 30, 10}, 65, selectMinOvershoot, "70"},
+		// of the fewest phonons, the smallest overshoot
+		{[]int64{200, 100, 40, 30}, 65, selectFewestPhonons, "100"},
+		{[]int64{5}, 5, selectFewestPhonons, "5"},
+	}
+	for _, tt := range tests {
+		chosen := choosePhonons(phononsOf(t, tt.values...), big.NewInt(tt.amount), tt.strategy)
+		if got := chosenValues(chosen); got != tt.want {
+			t.Errorf("choosePhonons(%v, %d, %s) = %s, want %s", tt.values, tt.amount, tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestChoosePhononsInsufficient(t *testing.T) {
+	if chosen := choosePhonons(phononsOf(t, 20, 30), big.NewInt(51), selectMinOvershoot); chosen != nil {
+		t.Errorf("expected nil when the phonons fall short, got %s", chosenValues(chosen))
+	}
+	if chosen := choosePhonons(nil, big.NewInt(1), selectFewestPhonons); chosen != nil {
+		t.Errorf("expected nil for no phonons, got %s", chosenValues(chosen))
+	}
+}
+
+func TestChoosePhononsSearchLimit(t *testing.T) {
+	// far more subsets than the search visits, with no exact match: the best cover found is still a cover
+	values := []int64{}
+	for i := 0; i < 40; i++ {
+		values = append(values, 2)
+	}
+	chosen := choosePhonons(phononsOf(t, values...), big.NewInt(41), selectMinOvershoot)
+	if got := chosenValues(chosen); got != strings.TrimSpace(strings.Repeat("2 ", 21)) {
+		t.Errorf("expected 21 phonons of 2, got %s", got)
+	}
+}
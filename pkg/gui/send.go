@@ -0,0 +1,330 @@
+package gui
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GridPlus/phonon-client/internal/history"
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	log "github.com/sirupsen/logrus"
+)
+
+type sendStatus string
+
+const (
+	sendStatusSent = sendStatus("sent")
+	// the phonons left the card but the counterparty did not accept them. The journal keeps the transfer packet
+	sendStatusRejected = sendStatus("rejectedByCounterparty")
+	sendStatusNotFound = sendStatus("notFound")
+	// the phonon is part of another transfer that has not been settled
+	sendStatusLocked = sendStatus("locked")
+	// the phonon was valid but stayed on the card because another phonon was invalid or the card refused the send
+	sendStatusNotSent = sendStatus("notSent")
+)
+
+var ErrSendEmpty = errors.New("no phonons to send")
+var ErrSendInvalid = errors.New("some phonons cannot be sent, nothing was sent")
+
+// sendPhononRequest accepts the phonon objects returned by listPhonons, of which only the key index and public key
+// are used. The public key is optional but guards against a key index that has since been reused
+type sendPhononRequest struct {
+	KeyIndex *model.PhononKeyIndex
+	PubKey   string
+}
+
+type sendPhononResult struct {
+	KeyIndex model.PhononKeyIndex
+	PubKey   string `json:",omitempty"`
+	Status   sendStatus
+	Err      string `json:",omitempty"`
+}
+
+// counterpartyAck is the counterparty's answer to a transfer
+type counterpartyAck struct {
+	CardID     string `json:",omitempty"`
+	Accepted   bool
+	Err        string `json:",omitempty"`
+	TransferID string `json:",omitempty"`
+	Time       time.Time
+}
+
+type sendResponse struct {
+	Results         []sendPhononResult
+	Acknowledgement *counterpartyAck `json:",omitempty"`
+	// set when the phonons were sent with allowCertificateChange to a contact whose card presented an unexpected
+	// identity certificate
+	CounterpartyWarning string `json:",omitempty"`
+}
+
+// parseSendRequest decodes and checks a send request body without consulting the card
+func parseSendRequest(body []byte) ([]sendPhononRequest, error) {
+	var reqs []sendPhononRequest
+	err := json.Unmarshal(body, &reqs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode send request: %w", err)
+	}
+	if len(reqs) == 0 {
+		return nil, ErrSendEmpty
+	}
+	seen := make(map[model.PhononKeyIndex]bool)
+	for i, req := range reqs {
+		if req.KeyIndex == nil {
+			return nil, fmt.Errorf("phonon %d has no KeyIndex", i)
+		}
+		if seen[*req.KeyIndex] {
+			return nil, fmt.Errorf("phonon with KeyIndex %d is listed more than once", *req.KeyIndex)
+		}
+		seen[*req.KeyIndex] = true
+		reqs[i].PubKey = strings.ToLower(strings.TrimPrefix(req.PubKey, "0x"))
+	}
+	return reqs, nil
+}
+
+/*
+sendWithResults checks each requested phonon against the card and, if all of them can be sent, sends them to the
+session's counterparty in a single transfer. The card moves phonons all or nothing, so either every phonon is sent
+or none are. Returns ErrSendInvalid when a phonon was rejected before sending, or the send's error.
+*/
+func (apiSession apiSession) sendWithResults(op *operation, sess *orchestrator.Session, reqs []sendPhononRequest) (sendResponse, error) {
+	resp, toSend, err := apiSession.checkSend(op, sess, reqs)
+	if err != nil {
+		return resp, err
+	}
+	return apiSession.completeSend(op, sess, resp, toSend)
+}
+
+/*
+checkSend checks each requested phonon against the card, returning the results so far and the phonons to send.
+Returns ErrSendInvalid if any phonon cannot be sent, and no results at all if the card could not be checked.
+*/
+func (apiSession apiSession) checkSend(op *operation, sess *orchestrator.Session, reqs []sendPhononRequest) (sendResponse, []model.Phonon, error) {
+	resp := sendResponse{Results: make([]sendPhononResult, len(reqs))}
+	var onCard map[model.PhononKeyIndex]*model.Phonon
+	err := op.run(func() error {
+		phonons, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			return err
+		}
+		onCard = make(map[model.PhononKeyIndex]*model.Phonon)
+		for _, p := range phonons {
+			onCard[p.KeyIndex] = p
+		}
+		return nil
+	})
+	if err != nil {
+		return sendResponse{}, nil, err
+	}
+
+	cardID := sess.GetCardId()
+	toSend := []model.Phonon{}
+	invalid := false
+	for i, req := range reqs {
+		res := &resp.Results[i]
+		res.KeyIndex = *req.KeyIndex
+		p, ok := onCard[*req.KeyIndex]
+		if !ok {
+			res.Status = sendStatusNotFound
+			res.Err = "no phonon with this key index on the card"
+			invalid = true
+			continue
+		}
+		var pubKey model.PhononPubKey
+		err = op.run(func() (err error) {
+			pubKey, err = sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+			return err
+		})
+		if err != nil {
+			return sendResponse{}, nil, err
+		}
+		res.PubKey = pubKey.String()
+		if req.PubKey != "" && req.PubKey != strings.ToLower(res.PubKey) {
+			res.Status = sendStatusNotFound
+			res.Err = "the phonon at this key index has a different public key"
+			invalid = true
+			continue
+		}
+		if reason, locked := apiSession.phononLocked(cardID, p.KeyIndex, res.PubKey); locked {
+			res.Status = sendStatusLocked
+			res.Err = reason
+			invalid = true
+			continue
+		}
+		res.Status = sendStatusNotSent
+		toSend = append(toSend, model.Phonon{
+			KeyIndex:     p.KeyIndex,
+			PubKey:       pubKey,
+			CurveType:    p.CurveType,
+			Denomination: p.Denomination,
+			CurrencyType: p.CurrencyType,
+		})
+	}
+	if invalid {
+		return resp, nil, ErrSendInvalid
+	}
+	return resp, toSend, nil
+}
+
+// completeSend sends the phonons checked by checkSend and fills in their results
+func (apiSession apiSession) completeSend(op *operation, sess *orchestrator.Session, resp sendResponse, toSend []model.Phonon) (sendResponse, error) {
+	ack := &counterpartyAck{}
+	var sendErr error
+	err := op.run(func() error {
+		if sess.RemoteCard != nil {
+			crt, err := sess.RemoteCard.GetCertificate()
+			if err == nil {
+				ack.CardID = cardIDFromPubKey(crt.PubKey)
+			}
+		}
+		released := apiSession.releases.startSend(sess)
+		transfer, journaled, err := apiSession.sendPhonons(sess, toSend)
+		ack.Time = time.Now()
+		if journaled {
+			ack.TransferID = transfer.ID
+		}
+		// once the card released the phonons, whatever went wrong happened on the counterparty's side
+		if err == nil || released() {
+			ack.Accepted = err == nil
+			if err != nil {
+				ack.Err = err.Error()
+			}
+			resp.Acknowledgement = ack
+		}
+		sendErr = err
+		return nil
+	})
+	if err != nil {
+		return resp, err
+	}
+	if resp.Acknowledgement != nil {
+		// the phonons left the card whether or not the counterparty confirmed them
+		var events []history.Event
+		for i := range toSend {
+			e := history.PhononEvent(history.KindSent, sess.GetCardId(), &toSend[i])
+			e.Counterparty = ack.CardID
+			e.TransferID = ack.TransferID
+			if sendErr != nil {
+				e.Note = "the counterparty did not confirm receipt: " + sendErr.Error()
+			}
+			events = append(events, e)
+		}
+		apiSession.record(events...)
+	}
+	if sendErr == nil && ack.CardID != "" {
+		pubKeys := make([]string, 0, len(toSend))
+		for _, p := range toSend {
+			pubKeys = append(pubKeys, p.PubKey.String())
+		}
+		apiSession.moveLabels(sess.GetCardId(), ack.CardID, pubKeys)
+	}
+	for i := range resp.Results {
+		res := &resp.Results[i]
+		switch {
+		case sendErr == nil:
+			res.Status = sendStatusSent
+		case resp.Acknowledgement != nil:
+			res.Status = sendStatusRejected
+			res.Err = sendErr.Error()
+		default:
+			res.Err = sendErr.Error()
+		}
+	}
+	return resp, sendErr
+}
+
+/*
+releaseCard remembers whether the card released the phonons of its last send. The orchestrator returns the same
+errors whether the card refused to send or the counterparty refused the phonons after they left the card.
+*/
+type releaseCard struct {
+	model.PhononCard
+	mtex     sync.Mutex
+	released bool
+}
+
+func (c *releaseCard) SendPhonons(keyIndices []model.PhononKeyIndex, extendedRequest bool) ([]byte, error) {
+	packet, err := c.PhononCard.SendPhonons(keyIndices, extendedRequest)
+	c.mtex.Lock()
+	c.released = err == nil
+	c.mtex.Unlock()
+	return packet, err
+}
+
+// releaseCards holds the releaseCard of each session
+type releaseCards struct {
+	mtex  sync.Mutex
+	cards map[*orchestrator.Session]*releaseCard
+}
+
+func newReleaseCards() *releaseCards {
+	return &releaseCards{cards: make(map[*orchestrator.Session]*releaseCard)}
+}
+
+// newSession starts a session on card, watching whether the card releases the phonons it is asked to send
+func (apiSession apiSession) newSession(card model.PhononCard) (*orchestrator.Session, error) {
+	rc := &releaseCard{PhononCard: card}
+	sess, err := orchestrator.NewSession(rc)
+	if sess != nil {
+		apiSession.releases.mtex.Lock()
+		apiSession.releases.cards[sess] = rc
+		apiSession.releases.mtex.Unlock()
+	}
+	return sess, err
+}
+
+// forget stops watching a session that was not kept
+func (rcs *releaseCards) forget(sess *orchestrator.Session) {
+	rcs.mtex.Lock()
+	delete(rcs.cards, sess)
+	rcs.mtex.Unlock()
+}
+
+/*
+startSend forgets the outcome of the session's previous send and returns a function reporting whether the card
+released the phonons of the next one. It must be called with the card held.
+*/
+func (rcs *releaseCards) startSend(sess *orchestrator.Session) (released func() bool) {
+	rcs.mtex.Lock()
+	rc, ok := rcs.cards[sess]
+	rcs.mtex.Unlock()
+	if !ok {
+		log.Errorf("card %s is not watched for released phonons", sess.GetCardId())
+		return func() bool { return false }
+	}
+	rc.mtex.Lock()
+	rc.released = false
+	rc.mtex.Unlock()
+	return func() bool {
+		rc.mtex.Lock()
+		defer rc.mtex.Unlock()
+		return rc.released
+	}
+}
+
+/*
+phononLocked reports whether the phonon at keyIndex on cardID is tied up in another transfer, and why. pubKey is
+compared when both it and the other transfer's record of the phonon are known.
+*/
+func (apiSession apiSession) phononLocked(cardID string, keyIndex model.PhononKeyIndex, pubKey string) (reason string, locked bool) {
+	if transferID, ok := apiSession.journal.Holds(cardID, keyIndex, pubKey); ok {
+		return fmt.Sprintf("part of journaled transfer %s, which has not been settled", transferID), true
+	}
+	if proposalID, ok := apiSession.proposals.holds(cardID, keyIndex, pubKey); ok {
+		return fmt.Sprintf("offered in pending transfer proposal %s", proposalID), true
+	}
+	return "", false
+}
+
+// cardIDFromPubKey derives a card's ID from its identity public key the way the orchestrator does
+func cardIDFromPubKey(pubKey []byte) string {
+	key, err := ethcrypto.UnmarshalPubkey(pubKey)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", ethcrypto.FromECDSAPub(key))[:16]
+}
@@ -0,0 +1,288 @@
+package gui
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/PhononDAO/phonon-core/pkg/orchestrator"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultOperationTimeouts bound each operation, keyed by the lower case operation name handlers pass to lockCard or
+// startOperation. Operations without an entry use "default". A zero duration disables the deadline.
+var defaultOperationTimeouts = map[string]time.Duration{
+	"default":          30 * time.Second,
+	"mineNativePhonon": 10 * time.Second,
+	"pair":             2 * time.Minute,
+	"send":             2 * time.Minute,
+	"sendAmount":       2 * time.Minute,
+	"acceptProposal":   2 * time.Minute,
+	"redeemPhonons":    2 * time.Minute,
+	"initDeposit":      time.Minute,
+	"finalizeDeposit":  2 * time.Minute,
+	"connectRemote":    time.Minute,
+	"report":           time.Minute,
+	"validatePhonons":  time.Minute,
+}
+
+type operationTimeouts map[string]time.Duration
+
+// newOperationTimeouts overlays the configured timeouts on the defaults. Keys are compared case insensitively since
+// the config loader lower cases them
+func newOperationTimeouts(configured map[string]time.Duration) operationTimeouts {
+	t := make(operationTimeouts)
+	for op, d := range defaultOperationTimeouts {
+		t[strings.ToLower(op)] = d
+	}
+	for op, d := range configured {
+		t[strings.ToLower(op)] = d
+	}
+	return t
+}
+
+func (t operationTimeouts) forOperation(op string) time.Duration {
+	if d, ok := t[strings.ToLower(op)]; ok {
+		return d
+	}
+	return t["default"]
+}
+
+/*
+operation carries the deadline of one API operation, derived from the request context so that a client going away
+cancels it as well. The orchestrator calls themselves cannot be interrupted, so run abandons a call that outlives
+the deadline: the handler responds straight away while the call finishes in the background. An operation holding
+the card keeps it until the abandoned call returns and the card state has been checked again. Calls that destroy
+phonons are never abandoned, see runDestructive.
+*/
+type operation struct {
+	name string
+	// parent is the context the operation was started under, normally the request's
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	// queue is the card's queue and release frees the card. Both nil when the operation does not hold one
+	queue   *cardQueue
+	release func()
+	// abandoned is called when a call is abandoned, and the function it returns once that call finally returns
+	abandoned func() (settled func(err error))
+
+	mtex     sync.Mutex
+	detached bool
+}
+
+// startOperation begins the operation name under parent, normally the request context
+func (apiSession apiSession) startOperation(parent context.Context, name string) *operation {
+	o := &operation{name: name, parent: parent}
+	if d := apiSession.timeouts.forOperation(name); d > 0 {
+		o.ctx, o.cancel = context.WithTimeout(parent, d)
+	} else {
+		o.ctx, o.cancel = context.WithCancel(parent)
+	}
+	return o
+}
+
+// done ends the operation, releasing the card unless an abandoned call is still using it
+func (o *operation) done() {
+	o.cancel()
+	o.mtex.Lock()
+	detached, release := o.detached, o.release
+	o.mtex.Unlock()
+	if !detached && release != nil {
+		release()
+	}
+}
+
+/*
+releaseCard frees the card before the operation ends, for work after its last card call that has no need to hold the
+card, while keeping the operation's deadline. A call abandoned by run frees the card itself once it returns.
+*/
+func (o *operation) releaseCard() {
+	o.mtex.Lock()
+	defer o.mtex.Unlock()
+	if o.detached || o.release == nil {
+		return
+	}
+	o.release()
+	o.release = nil
+}
+
+// run calls fn, returning its error, or the context's error if the deadline passes or the request is cancelled first
+func (o *operation) run(fn func() error) error {
+	err := o.ctx.Err()
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	select {
+	case err = <-result:
+		return err
+	case <-o.ctx.Done():
+	}
+
+	o.mtex.Lock()
+	o.detached = true
+	o.mtex.Unlock()
+	var settled func(error)
+	if o.abandoned != nil {
+		settled = o.abandoned()
+	}
+	go func() {
+		err := <-result
+		if settled != nil {
+			settled(err)
+		}
+		if o.release != nil {
+			o.release()
+		}
+	}()
+	return o.ctx.Err()
+}
+
+/*
+runDestructive calls fn and waits for it to return however long it takes, holding the card throughout. It is used
+for calls that destroy a phonon and return its private key: abandoning one would leave the key with nobody. The
+deadline is only checked before fn is called, so that a call that has not started yet is not made.
+*/
+func (o *operation) runDestructive(fn func() error) error {
+	err := o.ctx.Err()
+	if err != nil {
+		return err
+	}
+	return fn()
+}
+
+// requestEnded reports whether the request that started the operation has gone away, so it cannot be answered
+func (o *operation) requestEnded() bool {
+	return o.parent.Err() != nil
+}
+
+// operationErrorStatus reports the status code and error key for an error returned by run when the call was
+// abandoned. ok is false for any other error
+func operationErrorStatus(err error) (status int, key string, ok bool) {
+	switch err {
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout, errKeyOperationTimeout, true
+	case context.Canceled:
+		return statusClientClosedRequest, errKeyRequestCancelled, true
+	}
+	return 0, "", false
+}
+
+// writeOperationError writes the error response for a call abandoned by run, returning false without writing
+// anything for any other error
+func writeOperationError(w http.ResponseWriter, o *operation, err error) bool {
+	status, key, ok := operationErrorStatus(err)
+	if !ok {
+		return false
+	}
+	writeAPIError(w, status, key, operationError(o, err).Error())
+	return true
+}
+
+// operationError describes an error returned by run, naming the operation if the call was abandoned
+func operationError(o *operation, err error) error {
+	switch err {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%s did not complete in time", o.name)
+	case context.Canceled:
+		return fmt.Errorf("%s was cancelled", o.name)
+	}
+	return err
+}
+
+// abandonedOperation records the last operation on a card whose call outlived its request
+type abandonedOperation struct {
+	Operation   string
+	AbandonedAt time.Time
+	Settled     bool
+	SettledAt   time.Time `json:",omitempty"`
+	// error the abandoned call returned once it completed
+	Err   string     `json:",omitempty"`
+	State *cardState `json:",omitempty"`
+}
+
+// cardState is what is known about a card after an abandoned call settles
+type cardState struct {
+	Responsive       bool
+	Err              string `json:",omitempty"`
+	Initialized      bool
+	PairedToTerminal bool
+	Unlocked         bool
+	RemoteStatus     model.RemotePairingStatus
+	PhononCount      int `json:",omitempty"`
+}
+
+/*
+checkCardState asks the card to identify itself to confirm it still responds, then refreshes the session's view of
+it. An abandoned call may have left the card in any state, so callers should not assume the call took effect or not.
+*/
+func checkCardState(sess *orchestrator.Session) cardState {
+	s := cardState{
+		Initialized:      sess.IsInitialized(),
+		PairedToTerminal: sess.IsPairedToTerminal(),
+		Unlocked:         sess.IsUnlocked(),
+		RemoteStatus:     sess.RemoteConnectionStatus(),
+	}
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err == nil {
+		_, _, err = sess.IdentifyCard(nonce)
+	}
+	if err != nil {
+		s.Err = err.Error()
+		return s
+	}
+	s.Responsive = true
+	if s.Unlocked {
+		phonons, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			s.Err = err.Error()
+			return s
+		}
+		s.PhononCount = len(phonons)
+	}
+	return s
+}
+
+// abandon records that op's call on the card was abandoned and returns the function recording how it settled
+func (q *cardQueue) abandon(sess *orchestrator.Session, op string) func(err error) {
+	a := &abandonedOperation{
+		Operation:   op,
+		AbandonedAt: time.Now(),
+	}
+	q.mtex.Lock()
+	q.abandoned = a
+	q.mtex.Unlock()
+	log.Infof("abandoned %s on card %s, the card stays busy until the call returns", op, sess.GetCardId())
+	return func(err error) {
+		state := checkCardState(sess)
+		log.Infof("abandoned %s on card %s settled. err: %v, card state: %+v", op, sess.GetCardId(), err, state)
+		q.mtex.Lock()
+		defer q.mtex.Unlock()
+		a.Settled = true
+		a.SettledAt = time.Now()
+		if err != nil {
+			a.Err = err.Error()
+		}
+		a.State = &state
+	}
+}
+
+// remoteAbandoned logs the outcome of an abandoned call that talks to a counterparty rather than the card
+func remoteAbandoned(sess *orchestrator.Session, op string) func() func(error) {
+	return func() func(error) {
+		log.Infof("abandoned %s on card %s", op, sess.GetCardId())
+		return func(err error) {
+			log.Infof("abandoned %s on card %s settled. err: %v, remote status: %v", op, sess.GetCardId(), err, sess.RemoteConnectionStatus())
+		}
+	}
+}
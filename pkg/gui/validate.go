@@ -0,0 +1,92 @@
+package gui
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/PhononDAO/phonon-core/pkg/model"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseKeyIndices reads a comma separated list of key indices. An empty list selects every phonon
+func parseKeyIndices(s string) (map[model.PhononKeyIndex]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ret := make(map[model.PhononKeyIndex]bool)
+	for _, field := range strings.Split(s, ",") {
+		i, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key index %q", field)
+		}
+		ret[model.PhononKeyIndex(i)] = true
+	}
+	return ret, nil
+}
+
+/*
+validatePhonons checks the phonons of a card against their chains, all of them or those named by keyIndex. A phonon
+on a chain without an RPC endpoint is reported as unvalidated rather than failing the request.
+*/
+func (apiSession apiSession) validatePhonons(w http.ResponseWriter, r *http.Request) {
+	sess, err := apiSession.sessionFromMuxVars(mux.Vars(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	selected, err := parseKeyIndices(r.URL.Query().Get("keyIndex"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op, ok := apiSession.lockCard(w, r, sess, "validatePhonons")
+	if !ok {
+		return
+	}
+	defer op.done()
+	var phonons []*model.Phonon
+	err = op.run(func() error {
+		listed, err := sess.ListPhonons(0, 0, 0)
+		if err != nil {
+			return err
+		}
+		var ret []*model.Phonon
+		for _, p := range listed {
+			if selected != nil && !selected[p.KeyIndex] {
+				continue
+			}
+			if p.PubKey == nil {
+				p.PubKey, err = sess.GetPhononPubKey(p.KeyIndex, p.CurveType)
+				if err != nil {
+					return err
+				}
+			}
+			ret = append(ret, p)
+		}
+		phonons = ret
+		return nil
+	})
+	if writeOperationError(w, op, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if selected != nil && len(phonons) < len(selected) {
+		http.Error(w, ErrPhononNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	// the chains are queried without holding the card
+	op.releaseCard()
+	results := apiSession.validator.ValidateAll(op.ctx, sess.GetCardId(), phonons)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(results)
+	if err != nil {
+		log.Error("unable to encode phonon validation: ", err)
+	}
+}